@@ -0,0 +1,137 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/cofide/cofide-sdk-go/internal/xdsconfig"
+)
+
+// Client provides SPIFFE mTLS credentials for gRPC clients, backed by SPIRE.
+type Client struct {
+	*spirehelper.SPIREHelper
+
+	// xdsConfig is the xDS configuration set by the options.
+	xdsConfig xdsconfig.Config
+
+	// xdsClient is the xDS client of the dialer and resolver, if xDS is used.
+	xdsClient *xds.XDSClient
+
+	// dialer resolves addresses via xDS when an xDS server is configured.
+	dialer *transport.Dialer
+
+	// resolverBuilder resolves cofide:/// targets via xDS when an xDS server
+	// is configured.
+	resolverBuilder resolver.Builder
+
+	// closed is set by Close.
+	closed atomic.Bool
+}
+
+// NewClient creates a new Client, blocking until SPIRE is ready.
+//
+// Use NewClientWithContext to bound the time spent waiting for SPIRE.
+func NewClient(opts ...ClientOption) (*Client, error) {
+	return NewClientWithContext(context.Background(), opts...)
+}
+
+// NewClientWithContext creates a new Client, waiting until SPIRE is ready or
+// ctx is done. If ctx is done first, an error describing the most recent SPIRE
+// bootstrap failure is returned.
+//
+// ctx only bounds construction of the client. The lifetime of the underlying
+// SPIRE sources is controlled by WithContext.
+func NewClientWithContext(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		SPIREHelper: spirehelper.NewSPIREHelper(context.Background()),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.xdsConfig.FromEnv(); err != nil {
+		return nil, err
+	}
+
+	c.EnsureSPIRE()
+	if err := c.WaitReadyContext(ctx); err != nil {
+		// Stop the bootstrap, which the caller has no client to close.
+		_ = c.Close()
+		return nil, err
+	}
+
+	xdsClient, err := c.xdsConfig.NewClient(c.SPIREHelper)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if xdsClient != nil {
+		c.xdsClient = xdsClient
+		c.dialer = transport.NewDialer(
+			xdsClient,
+			transport.WithLogger(c.Logger),
+			transport.WithMetrics(c.Metrics),
+			transport.WithDiscoveryTimeout(c.xdsConfig.DiscoveryTimeout),
+		)
+		c.resolverBuilder = &xdsResolverBuilder{client: xdsClient}
+	}
+
+	return c, nil
+}
+
+// DialOptions returns the grpc.DialOption required to dial a server using
+// SPIFFE mTLS. If an xDS server is configured, the options also resolve
+// service names using endpoints discovered via xDS, either when dialing or
+// using the cofide scheme, e.g. cofide:///my-service.
+func (c *Client) DialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(grpccredentials.MTLSClientCredentials(c.X509Source, c.BundleSource, c.TLSAuthorizer())),
+	}
+
+	if c.dialer != nil {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return c.dialer.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
+	if c.resolverBuilder != nil {
+		opts = append(opts, grpc.WithResolvers(c.resolverBuilder))
+	}
+
+	return opts
+}
+
+// ResolverBuilder returns a gRPC resolver for the cofide scheme, which resolves
+// targets such as cofide:///my-service using endpoints discovered via xDS, and
+// updates the addresses as the endpoints change. It returns nil if no xDS
+// server is configured. The resolver is included in DialOptions, or may be
+// registered globally using resolver.Register.
+func (c *Client) ResolverBuilder() resolver.Builder {
+	return c.resolverBuilder
+}
+
+// NewClientConn creates a grpc.ClientConn for target using DialOptions
+// followed by opts.
+//
+// If an xDS server is configured and target has no scheme, the passthrough
+// scheme is used so that the service name, rather than a DNS-resolved address,
+// is resolved via xDS.
+func (c *Client) NewClientConn(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if c.dialer != nil && !strings.Contains(target, "://") {
+		target = "passthrough:///" + target
+	}
+
+	return grpc.NewClient(target, append(c.DialOptions(), opts...)...)
+}
@@ -0,0 +1,306 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
+)
+
+type ClientOption func(*Client)
+
+// WithSPIREAddress sets the address of the SPIRE agent socket, e.g.
+// unix:///run/spire/sockets/agent.sock. Bare socket paths are treated as unix
+// socket addresses.
+func WithSPIREAddress(addr string) ClientOption {
+	return func(c *Client) {
+		c.SPIREAddr = addr
+	}
+}
+
+// WithSPIREFallbackAddresses sets the addresses of further SPIRE agent
+// sockets, tried in order if the socket set using WithSPIREAddress, or
+// otherwise resolved, is unavailable. Each socket is waited on for up to
+// attemptTimeout before trying the next, or 5 seconds if zero.
+func WithSPIREFallbackAddresses(attemptTimeout time.Duration, addrs ...string) ClientOption {
+	return func(c *Client) {
+		c.FallbackAddrs = addrs
+		c.AttemptTimeout = attemptTimeout
+	}
+}
+
+// WithSPIREBackoff sets the initial and maximum delays of the exponential
+// backoff between retries while waiting for SPIRE. A zero delay keeps its
+// default: the backoff starts at 200ms and is capped at 10s.
+func WithSPIREBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.BackoffInitialDelay = initial
+		c.BackoffMaxDelay = max
+	}
+}
+
+// WithSPIREBackoffJitter sets whether the backoff between retries while
+// waiting for SPIRE uses decorrelated jitter, picking each delay at random
+// between the initial delay and three times the previous delay, so that
+// workloads started together do not retry in step. By default the delay
+// doubles after each retry.
+func WithSPIREBackoffJitter(jitter bool) ClientOption {
+	return func(c *Client) {
+		c.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithXDSBackoff sets the initial and maximum delays of the exponential backoff
+// between retries of the xDS stream. A zero delay keeps its default: the
+// backoff starts at 200ms and is capped at 10s.
+func WithXDSBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.BackoffInitialDelay = initial
+		c.xdsConfig.BackoffMaxDelay = max
+	}
+}
+
+// WithXDSBackoffJitter sets whether the backoff between retries of the xDS
+// stream uses decorrelated jitter, picking each delay at random between the
+// initial delay and three times the previous delay, so that clients
+// reconnecting together do not retry in step. By default the delay doubles
+// after each retry.
+func WithXDSBackoffJitter(jitter bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithXDSLimits bounds the xDS responses accepted from the server. A response
+// with more than maxEndpoints endpoints for a service is rejected, retaining
+// the service's previous endpoints, and responses larger than maxRecvMsgSize
+// bytes fail to be received. A zero limit keeps its default: the number of
+// endpoints is not limited, and the gRPC default maximum size of 4MB applies.
+func WithXDSLimits(maxEndpoints, maxRecvMsgSize int) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.MaxEndpoints = maxEndpoints
+		c.xdsConfig.MaxRecvMsgSize = maxRecvMsgSize
+	}
+}
+
+// WithXDSDialOptions sets extra gRPC dial options for the connection to the
+// xDS server, e.g. keepalives, interceptors or transport credentials. The
+// connection is otherwise insecure.
+func WithXDSDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DialOptions = append(c.xdsConfig.DialOptions, opts...)
+	}
+}
+
+// WithSPIRESocketFallbacks sets where to look for the SPIRE agent socket if
+// no address is set using WithSPIREAddress or the SPIFFE_ENDPOINT_SOCKET
+// environment variable: first the environment variables envVars, then the
+// socket paths that exist, before the default unix:///tmp/spire.sock.
+func WithSPIRESocketFallbacks(envVars []string, paths []string) ClientOption {
+	return func(c *Client) {
+		c.SocketEnvVars = envVars
+		c.SocketPaths = paths
+	}
+}
+
+func WithContext(ctx context.Context) ClientOption {
+	return func(c *Client) {
+		c.Ctx = ctx
+	}
+}
+
+// WithSVIDMatch authorizes servers whose SPIFFE ID matches all of the provided
+// MatchFunc. It is shorthand for WithAuthorizer(id.AuthorizeMatch(funcs...)).
+func WithSVIDMatch(funcs ...id.MatchFunc) ClientOption {
+	return WithAuthorizer(id.AuthorizeMatch(funcs...))
+}
+
+// WithAuthorizer sets the authorizer used to verify server SPIFFE IDs. If
+// combined with WithSVIDMatch, the last applied option wins.
+func WithAuthorizer(authorizer tlsconfig.Authorizer) ClientOption {
+	return func(c *Client) {
+		c.Authorizer = authorizer
+	}
+}
+
+// WithAuthorizerAudit calls logFn with the outcome of each authorization of a
+// server SPIFFE ID by the authorizer set using WithAuthorizer or WithSVIDMatch,
+// e.g. to keep an audit log. The decision is not altered. If logFn is nil,
+// each decision is logged using the logger.
+func WithAuthorizerAudit(logFn func(id spiffeid.ID, allowed bool, err error)) ClientOption {
+	return func(c *Client) {
+		c.AuthorizerAudit = logFn
+		if logFn == nil {
+			c.AuthorizerAudit = c.LogAuthorization
+		}
+	}
+}
+
+// WithXDS sets the URI of an xDS server used to resolve addresses. If not
+// set, the EXPERIMENTAL_XDS_SERVER_URI environment variable is used.
+func WithXDS(serverURI string) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.ServerURI = serverURI
+	}
+}
+
+// WithXDSEnabled explicitly enables or disables xDS. By default xDS is enabled
+// if a server URI is set using WithXDS or the EXPERIMENTAL_XDS_SERVER_URI
+// environment variable. If not set, the EXPERIMENTAL_ENABLE_XDS environment
+// variable is used. If xDS is enabled but cannot be configured, e.g. because
+// no server URI is set, creating the client fails unless WithXDSFallback is
+// set.
+func WithXDSEnabled(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Enabled = &enabled
+	}
+}
+
+// WithXDSFallback sets whether the client falls back to dialing addresses
+// directly, logging a warning, if xDS is enabled but cannot be configured.
+// By default creating the client fails instead.
+func WithXDSFallback(fallback bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Fallback = fallback
+	}
+}
+
+// WithXDSNodeID sets the node ID sent to the xDS server. If not set, the
+// EXPERIMENTAL_XDS_NODE_ID environment variable is used, falling back to the
+// workload's SPIFFE ID.
+func WithXDSNodeID(nodeID string) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.NodeID = nodeID
+	}
+}
+
+// WithXDSDiscoveryTimeout sets how long to wait for the endpoints of a service
+// to be discovered via xDS when it is first dialed, so that the first request
+// is also routed via xDS. If the endpoints are not discovered in time, the
+// address is dialed directly. By default there is no wait.
+func WithXDSDiscoveryTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DiscoveryTimeout = timeout
+	}
+}
+
+// WithXDSSubscriptionTTL bounds the number of xDS subscriptions when many
+// distinct hosts are requested. The subscription of a service whose endpoints
+// have not been requested for ttl is evicted, along with its cached endpoints.
+// By default subscriptions are never evicted.
+func WithXDSSubscriptionTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.SubscriptionTTL = ttl
+	}
+}
+
+// WithXDSEndpointTTL bounds how long endpoints discovered via xDS are used
+// while the xDS stream is down. Once they have not been refreshed for ttl,
+// hosts are resolved using DNS instead. By default cached endpoints are used
+// indefinitely.
+func WithXDSEndpointTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.EndpointTTL = ttl
+	}
+}
+
+// WithXDSDropUnhealthy drops endpoints discovered via xDS whose health status
+// is neither HEALTHY nor UNKNOWN, e.g. DRAINING or UNHEALTHY endpoints. By
+// default such endpoints are only used if a service has no healthy endpoints.
+func WithXDSDropUnhealthy() ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DropUnhealthy = true
+	}
+}
+
+// WithXDSDuplicateWeightMax gives an endpoint whose address is listed more
+// than once for a service, e.g. in different localities, the maximum weight of
+// its duplicates. By default their weights are summed.
+func WithXDSDuplicateWeightMax() ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DuplicateWeight = xds.DuplicateWeightMax
+	}
+}
+
+// WithXDSMinReconnectInterval sets the minimum time between reconnections to
+// the xDS server, which bounds the reconnection rate if the server repeatedly
+// closes the stream. By default only the exponential backoff applies.
+func WithXDSMinReconnectInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.MinReconnectInterval = interval
+	}
+}
+
+// WithXDSInitialFetchTimeout sets how long to wait for the endpoints of a
+// service to be received from the xDS server. If they are not received in
+// time, a warning is logged and the service is treated as having no endpoints
+// until they are. By default there is no timeout.
+func WithXDSInitialFetchTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.InitialFetchTimeout = timeout
+	}
+}
+
+// WithXDSNode sets a template for the node sent to the xDS server, e.g. to set
+// its cluster, locality and metadata. The node ID is set using WithXDSNodeID.
+func WithXDSNode(node *core.Node) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Node = node
+	}
+}
+
+// WithX509Source sets an existing X509Source to use rather than creating one
+// from the SPIRE workload API.
+func WithX509Source(source *workloadapi.X509Source) ClientOption {
+	return func(c *Client) {
+		c.X509Source = source
+	}
+}
+
+// WithBundleSource sets an existing BundleSource to use rather than creating
+// one from the SPIRE workload API.
+func WithBundleSource(source *workloadapi.BundleSource) ClientOption {
+	return func(c *Client) {
+		c.BundleSource = source
+	}
+}
+
+// WithMetrics sets a recorder for xDS, SPIRE and dial metrics, e.g. to export them to Prometheus.
+// By default metrics are not recorded.
+func WithMetrics(recorder metrics.Recorder) ClientOption {
+	return func(c *Client) {
+		c.Metrics = recorder
+	}
+}
+
+// WithSVIDExpiryWarning logs a warning when the remaining validity of the
+// workload's X509-SVID drops below threshold without it having been rotated,
+// e.g. because the SPIRE agent is stuck. Callbacks for the warning can be
+// registered using OnSVIDExpiring. By default there is no warning.
+func WithSVIDExpiryWarning(threshold time.Duration) ClientOption {
+	return func(c *Client) {
+		c.SVIDExpiryThreshold = threshold
+	}
+}
+
+// WithLogger sets the logger for SPIRE bootstrap, SVID rotation, xDS discovery
+// and dialing. By default slog.Default() is used.
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(c *Client) {
+		if logger != nil {
+			c.Logger = logger
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc_test
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_grpc "github.com/cofide/cofide-sdk-go/grpc/client"
+)
+
+func TestClient_xdsEnabled(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/client")
+
+	running := spireGoroutines()
+	_, err = spiretest.NewGRPCClient(api, cofide_grpc.WithXDSEnabled(true))
+	assert.ErrorContains(t, err, "xDS is enabled but no xDS server URI is set")
+
+	// The SPIRE sources of the failed client are released.
+	assert.Eventually(t, func() bool {
+		return spireGoroutines() <= running
+	}, 10*time.Second, 10*time.Millisecond)
+
+	client, err := spiretest.NewGRPCClient(api, cofide_grpc.WithXDSEnabled(true), cofide_grpc.WithXDSFallback(true))
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Nil(t, client.ResolverBuilder())
+}
+
+func TestNewClientWithContext_notReady(t *testing.T) {
+	running := spireGoroutines()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// No SPIRE agent is listening on this socket.
+	spireAddr := "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+
+	client, err := cofide_grpc.NewClientWithContext(ctx, cofide_grpc.WithSPIREAddress(spireAddr))
+	assert.Nil(t, client)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The bootstrap does not keep retrying once construction fails.
+	assert.Eventually(t, func() bool {
+		return spireGoroutines() <= running
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// spireGoroutines returns the number of goroutines bootstrapping SPIRE or
+// watching its sources.
+func spireGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Count(string(buf[:n]), "spirehelper.(*SPIREHelper).")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
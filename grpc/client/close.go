@@ -0,0 +1,25 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc
+
+import (
+	"errors"
+)
+
+// Close releases the SPIRE sources and xDS client of the client, stopping
+// their background goroutines. Connections created using the client should be
+// closed first, as they can no longer resolve addresses via xDS or obtain new
+// SVIDs. Calls after the first have no effect.
+func (c *Client) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	var errs []error
+	if c.xdsClient != nil {
+		errs = append(errs, c.xdsClient.Close())
+	}
+	errs = append(errs, c.SPIREHelper.Close())
+	return errors.Join(errs...)
+}
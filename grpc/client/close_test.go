@@ -0,0 +1,34 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc_test
+
+import (
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_grpc "github.com/cofide/cofide-sdk-go/grpc/client"
+)
+
+func TestClient_Close(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/client")
+
+	client, err := spiretest.NewGRPCClient(api, cofide_grpc.WithXDS("passthrough:///xds-server"))
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+
+	// The SPIRE sources created by the client are closed.
+	_, err = client.X509Source.GetX509SVID()
+	assert.ErrorContains(t, err, "source is closed")
+	_, err = client.BundleSource.GetX509BundleForTrustDomain(ca.TrustDomain())
+	assert.ErrorContains(t, err, "source is closed")
+
+	// Closing again has no effect.
+	assert.NoError(t, client.Close())
+}
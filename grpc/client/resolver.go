@@ -0,0 +1,77 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc/resolver"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+)
+
+// Scheme is the target scheme of the resolver returned by
+// Client.ResolverBuilder, e.g. cofide:///my-service.
+const Scheme = "cofide"
+
+// xdsResolverBuilder builds resolvers for the cofide scheme, which resolve
+// service names using endpoints discovered via xDS.
+type xdsResolverBuilder struct {
+	client *xds.XDSClient
+}
+
+func (b *xdsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	service := target.Endpoint()
+	// Endpoints carry their own ports, so any port in the target is ignored.
+	if host, _, err := net.SplitHostPort(service); err == nil {
+		service = host
+	}
+	if service == "" {
+		return nil, fmt.Errorf("missing service name in target %q", target.URL.String())
+	}
+	if err := xds.ValidateServiceName(service); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target.URL.String(), err)
+	}
+
+	r := &xdsResolver{service: service, cc: cc}
+	r.cancel = b.client.Watch(service, r.update)
+	return r, nil
+}
+
+func (b *xdsResolverBuilder) Scheme() string {
+	return Scheme
+}
+
+// xdsResolver pushes the endpoints of a service to a gRPC ClientConn as they
+// are discovered via xDS.
+type xdsResolver struct {
+	service string
+	cc      resolver.ClientConn
+	cancel  func()
+}
+
+func (r *xdsResolver) update(endpoints []xds.Endpoint) {
+	if len(endpoints) == 0 {
+		r.cc.ReportError(fmt.Errorf("no endpoints discovered for %s", r.service))
+		return
+	}
+
+	endpoints = xds.PreferHealthy(endpoints)
+	addrs := make([]resolver.Address, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(ep.Host, strconv.Itoa(ep.Port))})
+	}
+	// An error means the update was rejected, e.g. by the balancer. A later
+	// update from xDS supersedes it, so there is nothing to do.
+	_ = r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// ResolveNow is a no-op, as updates are pushed by the xDS server.
+func (r *xdsResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *xdsResolver) Close() {
+	r.cancel()
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// fakeClientConn is a resolver.ClientConn that records updates.
+type fakeClientConn struct {
+	resolver.ClientConn
+
+	state resolver.State
+	err   error
+}
+
+func (cc *fakeClientConn) UpdateState(state resolver.State) error {
+	cc.state = state
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.err = err
+}
+
+func TestXDSResolver_update(t *testing.T) {
+	cc := &fakeClientConn{}
+	r := &xdsResolver{service: "test-service", cc: cc}
+
+	r.update([]xds.Endpoint{{Host: "1.2.3.4", Port: 4321}, {Host: "::1", Port: 8080}})
+	require.NoError(t, cc.err)
+	assert.Equal(t, []resolver.Address{{Addr: "1.2.3.4:4321"}, {Addr: "[::1]:8080"}}, cc.state.Addresses)
+
+	// Healthy endpoints are preferred.
+	r.update([]xds.Endpoint{{Host: "1.2.3.4", Port: 4321, HealthStatus: core.HealthStatus_DRAINING}, {Host: "1.2.3.5", Port: 4321}})
+	assert.Equal(t, []resolver.Address{{Addr: "1.2.3.5:4321"}}, cc.state.Addresses)
+
+	r.update([]xds.Endpoint{})
+	assert.ErrorContains(t, cc.err, "no endpoints discovered for test-service")
+}
+
+func TestXDSResolverBuilder_Scheme(t *testing.T) {
+	assert.Equal(t, "cofide", (&xdsResolverBuilder{}).Scheme())
+}
+
+func TestXDSResolverBuilder_Build_invalidService(t *testing.T) {
+	target, err := url.Parse("cofide:///test%20service")
+	require.NoError(t, err)
+
+	_, err = (&xdsResolverBuilder{}).Build(resolver.Target{URL: *target}, &fakeClientConn{}, resolver.BuildOptions{})
+	assert.ErrorIs(t, err, xds.ErrInvalidServiceName)
+}
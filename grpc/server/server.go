@@ -0,0 +1,62 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc_server
+
+import (
+	"context"
+
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"google.golang.org/grpc"
+
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+)
+
+// Server provides SPIFFE mTLS credentials for gRPC servers, backed by SPIRE.
+type Server struct {
+	*spirehelper.SPIREHelper
+}
+
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		SPIREHelper: spirehelper.NewSPIREHelper(context.Background()),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Close stops SPIRE bootstrap and releases the SPIRE sources created by the
+// server. Servers created using NewGRPCServer should be stopped first, as they
+// can no longer obtain new SVIDs.
+func (s *Server) Close() error {
+	return s.SPIREHelper.Close()
+}
+
+// ServerOptions returns the grpc.ServerOption required to serve using SPIFFE
+// mTLS, blocking until SPIRE is ready. An error is returned if SPIRE cannot be
+// bootstrapped, e.g. because its address is invalid or the context set using
+// WithContext is done.
+func (s *Server) ServerOptions() ([]grpc.ServerOption, error) {
+	s.EnsureSPIRE()
+	if err := s.WaitReadyContext(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return []grpc.ServerOption{
+		grpc.Creds(grpccredentials.MTLSServerCredentials(s.X509Source, s.BundleSource, s.TLSAuthorizer())),
+	}, nil
+}
+
+// NewGRPCServer creates a grpc.Server using ServerOptions followed by opts,
+// blocking until SPIRE is ready.
+func (s *Server) NewGRPCServer(opts ...grpc.ServerOption) (*grpc.Server, error) {
+	serverOpts, err := s.ServerOptions()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.NewServer(append(serverOpts, opts...)...), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc_server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+type ServerOption func(*Server)
+
+// WithSPIREAddress sets the address of the SPIRE agent socket, e.g.
+// unix:///run/spire/sockets/agent.sock. Bare socket paths are treated as unix
+// socket addresses.
+func WithSPIREAddress(addr string) ServerOption {
+	return func(s *Server) {
+		s.SPIREAddr = addr
+	}
+}
+
+// WithSPIREFallbackAddresses sets the addresses of further SPIRE agent
+// sockets, tried in order if the socket set using WithSPIREAddress, or
+// otherwise resolved, is unavailable. Each socket is waited on for up to
+// attemptTimeout before trying the next, or 5 seconds if zero.
+func WithSPIREFallbackAddresses(attemptTimeout time.Duration, addrs ...string) ServerOption {
+	return func(s *Server) {
+		s.FallbackAddrs = addrs
+		s.AttemptTimeout = attemptTimeout
+	}
+}
+
+// WithSPIREBackoff sets the initial and maximum delays of the exponential
+// backoff between retries while waiting for SPIRE. A zero delay keeps its
+// default: the backoff starts at 200ms and is capped at 10s.
+func WithSPIREBackoff(initial, max time.Duration) ServerOption {
+	return func(s *Server) {
+		s.BackoffInitialDelay = initial
+		s.BackoffMaxDelay = max
+	}
+}
+
+// WithSPIREBackoffJitter sets whether the backoff between retries while
+// waiting for SPIRE uses decorrelated jitter, picking each delay at random
+// between the initial delay and three times the previous delay, so that
+// workloads started together do not retry in step. By default the delay
+// doubles after each retry.
+func WithSPIREBackoffJitter(jitter bool) ServerOption {
+	return func(s *Server) {
+		s.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithSPIRESocketFallbacks sets where to look for the SPIRE agent socket if
+// no address is set using WithSPIREAddress or the SPIFFE_ENDPOINT_SOCKET
+// environment variable: first the environment variables envVars, then the
+// socket paths that exist, before the default unix:///tmp/spire.sock.
+func WithSPIRESocketFallbacks(envVars []string, paths []string) ServerOption {
+	return func(s *Server) {
+		s.SocketEnvVars = envVars
+		s.SocketPaths = paths
+	}
+}
+
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Ctx = ctx
+	}
+}
+
+// WithSVIDMatch authorizes clients whose SPIFFE ID matches all of the provided
+// MatchFunc. It is shorthand for WithAuthorizer(id.AuthorizeMatch(funcs...)).
+func WithSVIDMatch(funcs ...id.MatchFunc) ServerOption {
+	return WithAuthorizer(id.AuthorizeMatch(funcs...))
+}
+
+// WithAuthorizer sets the authorizer used to verify client SPIFFE IDs. If
+// combined with WithSVIDMatch, the last applied option wins.
+func WithAuthorizer(authorizer tlsconfig.Authorizer) ServerOption {
+	return func(s *Server) {
+		s.Authorizer = authorizer
+	}
+}
+
+// WithAuthorizerAudit calls logFn with the outcome of each authorization of a
+// client SPIFFE ID by the authorizer set using WithAuthorizer or WithSVIDMatch,
+// e.g. to keep an audit log. The decision is not altered. If logFn is nil,
+// each decision is logged using the logger.
+func WithAuthorizerAudit(logFn func(id spiffeid.ID, allowed bool, err error)) ServerOption {
+	return func(s *Server) {
+		s.AuthorizerAudit = logFn
+		if logFn == nil {
+			s.AuthorizerAudit = s.LogAuthorization
+		}
+	}
+}
+
+// WithX509Source sets an existing X509Source to use rather than creating one
+// from the SPIRE workload API.
+func WithX509Source(source *workloadapi.X509Source) ServerOption {
+	return func(s *Server) {
+		s.X509Source = source
+	}
+}
+
+// WithBundleSource sets an existing BundleSource to use rather than creating
+// one from the SPIRE workload API.
+func WithBundleSource(source *workloadapi.BundleSource) ServerOption {
+	return func(s *Server) {
+		s.BundleSource = source
+	}
+}
+
+// WithMetrics sets a recorder for SPIRE metrics, e.g. to export them to Prometheus.
+// By default metrics are not recorded.
+func WithMetrics(recorder metrics.Recorder) ServerOption {
+	return func(s *Server) {
+		s.Metrics = recorder
+	}
+}
+
+// WithSVIDExpiryWarning logs a warning when the remaining validity of the
+// workload's X509-SVID drops below threshold without it having been rotated,
+// e.g. because the SPIRE agent is stuck. Callbacks for the warning can be
+// registered using OnSVIDExpiring. By default there is no warning.
+func WithSVIDExpiryWarning(threshold time.Duration) ServerOption {
+	return func(s *Server) {
+		s.SVIDExpiryThreshold = threshold
+	}
+}
+
+// WithLogger sets the logger for SPIRE bootstrap and SVID rotation. By default
+// slog.Default() is used.
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		if logger != nil {
+			s.Logger = logger
+		}
+	}
+}
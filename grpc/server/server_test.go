@@ -0,0 +1,87 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_grpc_server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	cofide_grpc "github.com/cofide/cofide-sdk-go/grpc/client"
+	cofide_grpc_server "github.com/cofide/cofide-sdk-go/grpc/server"
+)
+
+func TestServer_ServerOptions(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	serverAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/server")
+	clientAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/client")
+	otherAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/other")
+
+	server := spiretest.NewGRPCServer(serverAPI, cofide_grpc_server.WithSVIDMatch(id.Equals("sa", "client")))
+	grpcServer, err := server.NewGRPCServer()
+	require.NoError(t, err)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = grpcServer.Serve(lis) }()
+	t.Cleanup(grpcServer.Stop)
+
+	check := func(api *spiretest.WorkloadAPI) (*healthpb.HealthCheckResponse, error) {
+		client, err := spiretest.NewGRPCClient(api, cofide_grpc.WithSVIDMatch(id.Equals("sa", "server")))
+		require.NoError(t, err)
+		conn, err := client.NewClientConn(lis.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	}
+
+	resp, err := check(clientAPI)
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// The server rejects a client with an unauthorized identity.
+	_, err = check(otherAPI)
+	assert.Error(t, err)
+}
+
+func TestServer_ServerOptions_notReady(t *testing.T) {
+	// SPIRE bootstrap fails immediately for an invalid address.
+	server := cofide_grpc_server.NewServer(cofide_grpc_server.WithSPIREAddress("http://invalid"))
+
+	_, err := server.ServerOptions()
+	assert.Error(t, err)
+	_, err = server.NewGRPCServer()
+	assert.Error(t, err)
+}
+
+func TestServer_Close(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/server")
+
+	server := spiretest.NewGRPCServer(api)
+	_, err = server.ServerOptions()
+	require.NoError(t, err)
+
+	require.NoError(t, server.Close())
+
+	// The SPIRE sources created by the server are closed.
+	_, err = server.X509Source.GetX509SVID()
+	assert.ErrorContains(t, err, "source is closed")
+	_, err = server.BundleSource.GetX509BundleForTrustDomain(ca.TrustDomain())
+	assert.ErrorContains(t, err, "source is closed")
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+type serverAuthorizerContextKey struct{}
+
+// WithServerAuthorizer returns a copy of ctx that sets the authorizer used to
+// verify the server's SPIFFE ID for requests using the context, overriding
+// the authorizer of the client set using WithAuthorizer or WithSVIDMatch.
+//
+// Connections are pooled per TLS config, so a connection verified using one
+// authorizer must not be reused for a request with another. Requests with a
+// server authorizer are therefore sent on dedicated connections that are
+// closed after the response, at the cost of a TLS handshake per request.
+func WithServerAuthorizer(ctx context.Context, authorizer tlsconfig.Authorizer) context.Context {
+	return context.WithValue(ctx, serverAuthorizerContextKey{}, authorizer)
+}
+
+// serverAuthorizerFromContext returns the server authorizer set in ctx, if any.
+func serverAuthorizerFromContext(ctx context.Context) (tlsconfig.Authorizer, bool) {
+	authorizer, ok := ctx.Value(serverAuthorizerContextKey{}).(tlsconfig.Authorizer)
+	return authorizer, ok && authorizer != nil
+}
+
+// serverAuthorizerTransport is an http.RoundTripper that sends requests with a
+// server authorizer, set using WithServerAuthorizer or for the request's host
+// using WithServerIDForHost, using a TLS config with that authorizer.
+type serverAuthorizerTransport struct {
+	base      http.RoundTripper
+	tlsConfig *tls.Config
+	bundle    x509bundle.Source
+
+	// hostAuthorizers maps lower case hostnames to their server authorizers.
+	hostAuthorizers map[string]tlsconfig.Authorizer
+	// audit is optionally called with the outcome of each authorization by
+	// a server authorizer, as for the client's authorizer.
+	audit func(id spiffeid.ID, allowed bool, err error)
+}
+
+func newServerAuthorizerTransport(base http.RoundTripper, tlsConfig *tls.Config, bundle x509bundle.Source, hostAuthorizers map[string]tlsconfig.Authorizer, audit func(id spiffeid.ID, allowed bool, err error)) *serverAuthorizerTransport {
+	return &serverAuthorizerTransport{
+		base:            base,
+		tlsConfig:       tlsConfig,
+		bundle:          bundle,
+		hostAuthorizers: hostAuthorizers,
+		audit:           audit,
+	}
+}
+
+// authorizer returns the server authorizer for req, if any. An authorizer set
+// in the request's context takes precedence over one for its host.
+func (t *serverAuthorizerTransport) authorizer(req *http.Request) (tlsconfig.Authorizer, bool) {
+	if authorizer, ok := serverAuthorizerFromContext(req.Context()); ok {
+		return authorizer, true
+	}
+	authorizer, ok := t.hostAuthorizers[strings.ToLower(req.URL.Hostname())]
+	return authorizer, ok
+}
+
+func (t *serverAuthorizerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorizer, ok := t.authorizer(req)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	if t.audit != nil {
+		authorizer = id.AuthorizeWithAudit(authorizer, t.audit)
+	}
+	tlsConfig := authorizerTLSConfig(t.tlsConfig, t.bundle, authorizer)
+	switch base := t.base.(type) {
+	case *transport.CofideTransport:
+		return base.RoundTripWithTLSConfig(req, tlsConfig)
+	case *http.Transport:
+		return transport.RoundTripWithTLSConfig(base, req, tlsConfig)
+	default:
+		return nil, fmt.Errorf("server authorizers are not supported by transport %T", t.base)
+	}
+}
+
+// CloseIdleConnections closes idle connections of the base transport.
+func (t *serverAuthorizerTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// authorizerTLSConfig returns a copy of tlsConfig, which is built by
+// tlsconfig.MTLSClientConfig, that verifies the server using authorizer.
+func authorizerTLSConfig(tlsConfig *tls.Config, bundle x509bundle.Source, authorizer tlsconfig.Authorizer) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.VerifyPeerCertificate = tlsconfig.VerifyPeerCertificate(bundle, authorizer)
+	return tlsConfig
+}
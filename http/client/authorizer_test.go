@@ -0,0 +1,234 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerAuthorizerTransport(t *testing.T) {
+	serverID := spiffeid.RequireFromString("spiffe://example.org/server")
+	ca, caKey := makeCA(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{makeServerSVID(t, ca, caKey, serverID)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The client's authorizer rejects all servers.
+	bundle := x509bundle.FromX509Authorities(serverID.TrustDomain(), []*x509.Certificate{ca})
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			return errors.New("unauthorized by client")
+		},
+	}
+	rt := newServerAuthorizerTransport(transport.NewHTTPTransport(nil, tlsConfig), tlsConfig, bundle, nil, nil)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr string
+	}{
+		{
+			name:    "client authorizer",
+			ctx:     context.Background(),
+			wantErr: "unauthorized by client",
+		},
+		{
+			name: "server authorizer",
+			ctx:  WithServerAuthorizer(context.Background(), tlsconfig.AuthorizeID(serverID)),
+		},
+		{
+			name:    "server authorizer for another ID",
+			ctx:     WithServerAuthorizer(context.Background(), tlsconfig.AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/other"))),
+			wantErr: `unexpected ID "spiffe://example.org/server"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(tt.ctx, http.MethodGet, srv.URL, nil)
+			require.NoError(t, err)
+
+			resp, err := rt.RoundTrip(req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			// The connection is not pooled.
+			assert.True(t, resp.Close)
+		})
+	}
+}
+
+func TestServerAuthorizerTransport_hostAuthorizers(t *testing.T) {
+	serverID := spiffeid.RequireFromString("spiffe://example.org/ns/prod/sa/server")
+	ca, caKey := makeCA(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{makeServerSVID(t, ca, caKey, serverID)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := &Client{}
+	WithServerIDForHost("LOCALHOST", id.Equals("sa", "server"))(c)
+	WithServerIDForHost("127.0.0.1", id.Equals("sa", "other"))(c)
+
+	// The client's authorizer rejects all servers.
+	bundle := x509bundle.FromX509Authorities(serverID.TrustDomain(), []*x509.Certificate{ca})
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			return errors.New("unauthorized by client")
+		},
+	}
+	rt := newServerAuthorizerTransport(transport.NewHTTPTransport(nil, tlsConfig), tlsConfig, bundle, c.hostAuthorizers, nil)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		host    string
+		wantErr string
+	}{
+		{
+			name: "host authorizer",
+			ctx:  context.Background(),
+			host: "localhost",
+		},
+		{
+			name:    "host authorizer for another ID",
+			ctx:     context.Background(),
+			host:    "127.0.0.1",
+			wantErr: "key sa does not match value other",
+		},
+		{
+			name: "server authorizer takes precedence",
+			ctx:  WithServerAuthorizer(context.Background(), tlsconfig.AuthorizeID(serverID)),
+			host: "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqURL := *srvURL
+			reqURL.Host = net.JoinHostPort(tt.host, srvURL.Port())
+			req, err := http.NewRequestWithContext(tt.ctx, http.MethodGet, reqURL.String(), nil)
+			require.NoError(t, err)
+
+			resp, err := rt.RoundTrip(req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestServerAuthorizerTransport_audit(t *testing.T) {
+	serverID := spiffeid.RequireFromString("spiffe://example.org/ns/prod/sa/server")
+	ca, caKey := makeCA(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{makeServerSVID(t, ca, caKey, serverID)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := &Client{}
+	WithServerIDForHost("localhost", id.Equals("sa", "server"))(c)
+	WithServerIDForHost("127.0.0.1", id.Equals("sa", "other"))(c)
+
+	type decision struct {
+		id      spiffeid.ID
+		allowed bool
+	}
+	var decisions []decision
+	audit := func(id spiffeid.ID, allowed bool, _ error) {
+		decisions = append(decisions, decision{id: id, allowed: allowed})
+	}
+
+	bundle := x509bundle.FromX509Authorities(serverID.TrustDomain(), []*x509.Certificate{ca})
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	rt := newServerAuthorizerTransport(transport.NewHTTPTransport(nil, tlsConfig), tlsConfig, bundle, c.hostAuthorizers, audit)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		reqURL := *srvURL
+		reqURL.Host = net.JoinHostPort(host, srvURL.Port())
+		req, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+		require.NoError(t, err)
+
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	assert.Equal(t, []decision{{id: serverID, allowed: true}, {id: serverID, allowed: false}}, decisions)
+}
+
+func makeCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func makeServerSVID(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, id spiffeid.ID) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	uri, err := url.Parse(id.String())
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		URIs:         []*url.URL{uri},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}
+}
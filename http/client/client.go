@@ -6,33 +6,90 @@ package cofide_http
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
 	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
 
 	"github.com/cofide/cofide-sdk-go/internal/transport"
 	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/cofide/cofide-sdk-go/internal/xdsconfig"
 )
 
-const defaultXDSNodeID = "node"
-
 type Client struct {
 	// internal HTTP client
 	http *http.Client
 
 	*spirehelper.SPIREHelper
 
-	// xdsServerURI is an optional URI of an xDS server to use when resolving addresses.
-	xdsServerURI string
+	// xdsConfig is the xDS configuration set by the options.
+	xdsConfig xdsconfig.Config
+
+	// dialContext is an optional function used to dial network addresses.
+	dialContext transport.DialContextFunc
+
+	// proxy optionally overrides the proxy, which is otherwise configured
+	// from the environment.
+	proxy func(*http.Request) (*url.URL, error)
+
+	// hostAuthorizers optionally maps lower case hostnames to the authorizers
+	// of their servers.
+	hostAuthorizers map[string]tlsconfig.Authorizer
+
+	// selector optionally selects the xDS endpoint that a request is sent to.
+	selector Selector
+
+	// weightOverride optionally overrides the weights of xDS endpoints for
+	// selection.
+	weightOverride func(service string, endpoint Endpoint) int
+
+	// minTLSVersion is an optional minimum TLS version for the client's TLS config.
+	minTLSVersion uint16
+
+	// cipherSuites is an optional list of cipher suites for the client's TLS config.
+	cipherSuites []uint16
+
+	// transportTemplate is an optional transport whose non-TLS settings are
+	// copied into the transport constructed by the client.
+	transportTemplate *http.Transport
+
+	// compression optionally overrides whether the transport requests and
+	// transparently decompresses gzip-encoded responses.
+	compression *bool
 
-	// xdsNodeID is an optional xDS node ID to use when resolving addresses.
-	xdsNodeID string
+	// retryMaxAttempts is the maximum number of attempts for idempotent requests.
+	retryMaxAttempts int
+
+	// retryOn determines whether a request should be retried.
+	retryOn func(*http.Response, error) bool
+
+	// retryBackoffInitialDelay and retryBackoffMaxDelay optionally override
+	// the delays of the backoff between retries, and retryBackoffStrategy how
+	// it grows.
+	retryBackoffInitialDelay time.Duration
+	retryBackoffMaxDelay     time.Duration
+	retryBackoffStrategy     backoff.Strategy
+
+	// preserveScheme leaves the scheme of http URLs unchanged, rather than
+	// rewriting it to https, and upgrades the requests in the transport.
+	preserveScheme bool
+
+	// defaultHeaders are set on requests that do not set them.
+	defaultHeaders http.Header
+
+	// middleware optionally wraps the transport, outermost first.
+	middleware []func(http.RoundTripper) http.RoundTripper
+
+	// xdsClient is the xDS client of the transport, if xDS is used.
+	xdsClient *xds.XDSClient
+
+	// closed is set by Close, after which requests fail.
+	closed atomic.Bool
 
 	/** FROM THIS POINT ALL PROPERTIES COME FROM net/http **/
 
@@ -86,46 +143,139 @@ type Client struct {
 	Timeout time.Duration
 }
 
+// NewClient creates a new Client, blocking until SPIRE is ready.
+//
+// Use NewClientWithContext to bound the time spent waiting for SPIRE.
 func NewClient(opts ...ClientOption) (*Client, error) {
+	return NewClientWithContext(context.Background(), opts...)
+}
+
+// NewClientWithContext creates a new Client, waiting until SPIRE is ready or
+// ctx is done. If ctx is done first, an error describing the most recent SPIRE
+// bootstrap failure is returned.
+//
+// ctx only bounds construction of the client. The lifetime of the underlying
+// SPIRE sources is controlled by WithContext.
+func NewClientWithContext(ctx context.Context, opts ...ClientOption) (*Client, error) {
 	c := &Client{
 		SPIREHelper: spirehelper.NewSPIREHelper(context.Background()),
-		xdsNodeID:   defaultXDSNodeID,
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
+	if err := c.xdsConfig.FromEnv(); err != nil {
+		return nil, err
+	}
 
 	// Ensure SPIRE is ready in order to use the x509Source and craft the
 	// tlsConfig for the custom transport
 	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.WaitReadyContext(ctx); err != nil {
+		// Stop the bootstrap, which the caller has no client to close.
+		_ = c.SPIREHelper.Close()
+		return nil, err
+	}
+
+	tlsConfig := c.newTLSConfig()
 
-	tlsConfig := tlsconfig.MTLSClientConfig(c.X509Source, c.BundleSource, c.Authorizer)
 	var err error
 	c.Transport, err = c.initTransport(tlsConfig)
 	if err != nil {
+		_ = c.SPIREHelper.Close()
 		return nil, err
 	}
+	c.Transport = newServerAuthorizerTransport(c.Transport, tlsConfig, c.BundleSource, c.hostAuthorizers, c.AuthorizerAudit)
+	if c.preserveScheme {
+		c.Transport = newHTTPSTransport(c.Transport)
+	}
+
+	if c.retryMaxAttempts > 1 {
+		c.Transport = newRetryTransport(c.Transport, c.retryMaxAttempts, c.retryOn,
+			backoff.WithDelays(c.retryBackoffInitialDelay, c.retryBackoffMaxDelay),
+			backoff.WithStrategy(c.retryBackoffStrategy))
+	}
+
+	if len(c.defaultHeaders) > 0 {
+		c.Transport = newDefaultHeaderTransport(c.Transport, c.defaultHeaders)
+	}
 
 	return c, nil
 }
 
+// newTLSConfig returns the client's mTLS config, using the SPIRE sources.
+func (c *Client) newTLSConfig() *tls.Config {
+	tlsConfig := tlsconfig.MTLSClientConfig(c.X509Source, c.BundleSource, c.TLSAuthorizer())
+	if c.minTLSVersion != 0 {
+		tlsConfig.MinVersion = c.minTLSVersion
+	}
+	if c.cipherSuites != nil {
+		tlsConfig.CipherSuites = c.cipherSuites
+	}
+	return tlsConfig
+}
+
+// TLSClientConfig waits until SPIRE is ready and returns an mTLS client config
+// for the client's SVID and authorizer, e.g. to connect to a database or
+// message broker using the workload's identity. The certificate is taken from
+// the X509Source for each handshake, so rotated SVIDs are used automatically.
+func (c *Client) TLSClientConfig() (*tls.Config, error) {
+	c.EnsureSPIRE()
+	if err := c.WaitReadyContext(context.Background()); err != nil {
+		return nil, err
+	}
+	return c.newTLSConfig(), nil
+}
+
 func (c *Client) initTransport(tlsConfig *tls.Config) (http.RoundTripper, error) {
-	if c.xdsServerURI == "" {
-		return &http.Transport{TLSClientConfig: tlsConfig}, nil
+	template := c.transportTemplate
+	if c.compression != nil {
+		// Copy the template, so that the caller's transport is not modified.
+		template = transport.NewHTTPTransport(template, nil)
+		template.DisableCompression = !*c.compression
+	}
+
+	// A dialer set using WithDialContext takes precedence over the template.
+	dialContext := c.dialContext
+	if dialContext == nil && template != nil {
+		dialContext = template.DialContext
 	}
 
-	xdsClient, err := xds.NewXDSClient(xds.XDSClientConfig{
-		Logger:    slog.Default(),
-		ServerURI: c.xdsServerURI,
-		NodeID:    c.xdsNodeID,
-	})
+	xdsClient, err := c.xdsConfig.NewClient(c.SPIREHelper)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create xDS client: %w", err)
+		return nil, err
+	}
+	if xdsClient == nil {
+		return c.newDefaultTransport(template, tlsConfig, dialContext), nil
 	}
+	c.xdsClient = xdsClient
+
+	return transport.NewCofideTransport(
+		xdsClient,
+		tlsConfig,
+		transport.WithTransportTemplate(template),
+		transport.WithProxy(c.proxy),
+		transport.WithSelector(c.selector),
+		transport.WithDialerOptions(
+			transport.WithLogger(c.Logger),
+			transport.WithMetrics(c.Metrics),
+			transport.WithDiscoveryTimeout(c.xdsConfig.DiscoveryTimeout),
+			transport.WithBaseDialContext(dialContext),
+			transport.WithWeightOverride(c.weightOverride),
+		),
+	), nil
+}
 
-	return transport.NewCofideTransport(xdsClient, tlsConfig), nil
+// newDefaultTransport returns a transport that does not use xDS.
+func (c *Client) newDefaultTransport(template *http.Transport, tlsConfig *tls.Config, dialContext transport.DialContextFunc) *http.Transport {
+	t := transport.NewHTTPTransport(template, tlsConfig)
+	if dialContext != nil {
+		t.DialContext = dialContext
+	}
+	if c.proxy != nil {
+		t.Proxy = c.proxy
+	}
+	return t
 }
 
 func (c *Client) getHttp() *http.Client {
@@ -137,8 +287,14 @@ func (c *Client) getHttp() *http.Client {
 		return c.http
 	}
 
+	rt := c.Transport
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		rt = c.middleware[i](rt)
+	}
+	rt = newClosedTransport(rt, &c.closed)
+
 	c.http = &http.Client{
-		Transport:     c.Transport,
+		Transport:     rt,
 		CheckRedirect: c.CheckRedirect,
 		Jar:           c.Jar,
 		Timeout:       c.Timeout,
@@ -147,7 +303,13 @@ func (c *Client) getHttp() *http.Client {
 	return c.http
 }
 
-func secureURL(u string) string {
+// secureURL returns u with an http scheme replaced by https, unless the scheme
+// is preserved.
+func (c *Client) secureURL(u string) string {
+	if c.preserveScheme {
+		return u
+	}
+
 	parsed, err := url.Parse(u)
 	if err != nil {
 		return u
@@ -160,15 +322,24 @@ func secureURL(u string) string {
 	return parsed.String()
 }
 
+// waitReady waits until SPIRE is ready or ctx is done, returning an error if
+// SPIRE cannot be bootstrapped, rather than sending requests without the SPIRE
+// sources.
+func (c *Client) waitReady(ctx context.Context) error {
+	c.EnsureSPIRE()
+	return c.WaitReadyContext(ctx)
+}
+
 func (c *Client) CloseIdleConnections() {
 	c.getHttp().CloseIdleConnections()
 }
 
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.waitReady(req.Context()); err != nil {
+		return nil, err
+	}
 
-	if req.URL.Scheme == "http" {
+	if !c.preserveScheme && req.URL.Scheme == "http" {
 		req.URL.Scheme = "https"
 	}
 
@@ -176,29 +347,55 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 }
 
 func (c *Client) Get(url string) (resp *http.Response, err error) {
-	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
 
-	return c.getHttp().Get(secureURL(url))
+	return c.getHttp().Get(c.secureURL(url))
 }
 
 func (c *Client) Head(url string) (resp *http.Response, err error) {
-	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
 
-	return c.getHttp().Head(secureURL(url))
+	return c.getHttp().Head(c.secureURL(url))
 }
 
+// Post issues a POST to the specified URL. Bodies of type *bytes.Buffer,
+// *bytes.Reader or *strings.Reader are replayed when following redirects and
+// when retrying, as Request.GetBody is set for them. Other bodies cannot be
+// replayed, so requests with them are neither redirected with their body nor
+// retried.
 func (c *Client) Post(url, contentType string, body io.Reader) (resp *http.Response, err error) {
-	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
 
-	return c.getHttp().Post(secureURL(url), contentType, body)
+	return c.getHttp().Post(c.secureURL(url), contentType, body)
 }
 
 func (c *Client) PostForm(url string, data url.Values) (resp *http.Response, err error) {
-	c.EnsureSPIRE()
-	c.WaitReady()
+	if err := c.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
 
-	return c.getHttp().PostForm(secureURL(url), data)
+	return c.getHttp().PostForm(c.secureURL(url), data)
+}
+
+// Put issues a PUT to the specified URL. As with Post, only bodies of type
+// *bytes.Buffer, *bytes.Reader or *strings.Reader are replayed when following
+// redirects and when retrying.
+func (c *Client) Put(url, contentType string, body io.Reader) (resp *http.Response, err error) {
+	if err := c.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.secureURL(url), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return c.getHttp().Do(req)
 }
@@ -5,38 +5,483 @@ package cofide_http
 
 import (
 	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
 	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
 )
 
 type ClientOption func(*Client)
 
+// WithSPIREAddress sets the address of the SPIRE agent socket, e.g.
+// unix:///run/spire/sockets/agent.sock. Bare socket paths are treated as unix
+// socket addresses.
 func WithSPIREAddress(addr string) ClientOption {
 	return func(h *Client) {
 		h.SPIREAddr = addr
 	}
 }
 
+// WithSPIREFallbackAddresses sets the addresses of further SPIRE agent
+// sockets, tried in order if the socket set using WithSPIREAddress, or
+// otherwise resolved, is unavailable. Each socket is waited on for up to
+// attemptTimeout before trying the next, or 5 seconds if zero.
+func WithSPIREFallbackAddresses(attemptTimeout time.Duration, addrs ...string) ClientOption {
+	return func(h *Client) {
+		h.FallbackAddrs = addrs
+		h.AttemptTimeout = attemptTimeout
+	}
+}
+
+// WithSPIREBackoff sets the initial and maximum delays of the exponential
+// backoff between retries while waiting for SPIRE. A zero delay keeps its
+// default: the backoff starts at 200ms and is capped at 10s.
+func WithSPIREBackoff(initial, max time.Duration) ClientOption {
+	return func(h *Client) {
+		h.BackoffInitialDelay = initial
+		h.BackoffMaxDelay = max
+	}
+}
+
+// WithSPIREBackoffJitter sets whether the backoff between retries while
+// waiting for SPIRE uses decorrelated jitter, picking each delay at random
+// between the initial delay and three times the previous delay, so that
+// workloads started together do not retry in step. By default the delay
+// doubles after each retry.
+func WithSPIREBackoffJitter(jitter bool) ClientOption {
+	return func(h *Client) {
+		h.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithXDSBackoff sets the initial and maximum delays of the exponential backoff
+// between retries of the xDS stream. A zero delay keeps its default: the
+// backoff starts at 200ms and is capped at 10s.
+func WithXDSBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.BackoffInitialDelay = initial
+		c.xdsConfig.BackoffMaxDelay = max
+	}
+}
+
+// WithXDSBackoffJitter sets whether the backoff between retries of the xDS
+// stream uses decorrelated jitter, picking each delay at random between the
+// initial delay and three times the previous delay, so that clients
+// reconnecting together do not retry in step. By default the delay doubles
+// after each retry.
+func WithXDSBackoffJitter(jitter bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithXDSLimits bounds the xDS responses accepted from the server. A response
+// with more than maxEndpoints endpoints for a service is rejected, retaining
+// the service's previous endpoints, and responses larger than maxRecvMsgSize
+// bytes fail to be received. A zero limit keeps its default: the number of
+// endpoints is not limited, and the gRPC default maximum size of 4MB applies.
+func WithXDSLimits(maxEndpoints, maxRecvMsgSize int) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.MaxEndpoints = maxEndpoints
+		c.xdsConfig.MaxRecvMsgSize = maxRecvMsgSize
+	}
+}
+
+// WithXDSDialOptions sets extra gRPC dial options for the connection to the
+// xDS server, e.g. keepalives, interceptors or transport credentials. The
+// connection is otherwise insecure.
+func WithXDSDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DialOptions = append(c.xdsConfig.DialOptions, opts...)
+	}
+}
+
+// WithSPIRESocketFallbacks sets where to look for the SPIRE agent socket if
+// no address is set using WithSPIREAddress or the SPIFFE_ENDPOINT_SOCKET
+// environment variable: first the environment variables envVars, then the
+// socket paths that exist, before the default unix:///tmp/spire.sock.
+func WithSPIRESocketFallbacks(envVars []string, paths []string) ClientOption {
+	return func(h *Client) {
+		h.SocketEnvVars = envVars
+		h.SocketPaths = paths
+	}
+}
+
 func WithContext(ctx context.Context) ClientOption {
 	return func(h *Client) {
 		h.Ctx = ctx
 	}
 }
 
+// WithSVIDMatch authorizes peers whose SPIFFE ID matches all of the provided
+// MatchFunc. It is shorthand for WithAuthorizer(id.AuthorizeMatch(funcs...)).
 func WithSVIDMatch(funcs ...id.MatchFunc) ClientOption {
+	return WithAuthorizer(id.AuthorizeMatch(funcs...))
+}
+
+// WithAuthorizer sets the authorizer used to verify peer SPIFFE IDs. If
+// combined with WithSVIDMatch, the last applied option wins.
+func WithAuthorizer(authorizer tlsconfig.Authorizer) ClientOption {
 	return func(h *Client) {
-		h.Authorizer = id.AuthorizeMatch(funcs...)
+		h.Authorizer = authorizer
+	}
+}
+
+// WithAuthorizerAudit calls logFn with the outcome of each authorization of a
+// peer SPIFFE ID by the authorizer set using WithAuthorizer or WithSVIDMatch,
+// or by a server authorizer set using WithServerIDForHost or
+// WithServerAuthorizer, e.g. to keep an audit log. The decision is not
+// altered. If logFn is nil, each decision is logged using the logger.
+func WithAuthorizerAudit(logFn func(id spiffeid.ID, allowed bool, err error)) ClientOption {
+	return func(c *Client) {
+		c.AuthorizerAudit = logFn
+		if logFn == nil {
+			c.AuthorizerAudit = c.LogAuthorization
+		}
 	}
 }
 
+// WithServerIDForHost authorizes the servers of requests to host, which is
+// matched case-insensitively against the request URL's hostname, when their
+// SPIFFE IDs match all of the provided MatchFunc, rather than using the
+// client's authorizer. An authorizer set using WithServerAuthorizer takes
+// precedence. As with WithServerAuthorizer, these requests are sent on
+// dedicated connections.
+func WithServerIDForHost(host string, match ...id.MatchFunc) ClientOption {
+	return func(c *Client) {
+		if c.hostAuthorizers == nil {
+			c.hostAuthorizers = make(map[string]tlsconfig.Authorizer)
+		}
+		c.hostAuthorizers[strings.ToLower(host)] = id.AuthorizeMatch(match...)
+	}
+}
+
+// WithPreserveScheme leaves the scheme of http URLs unchanged, rather than
+// rewriting it to https. The requests are still sent using mTLS by the
+// client's transport, but the request's URL, as seen by middleware, redirect
+// policies and cookie jars, keeps the scheme that the caller set.
+func WithPreserveScheme() ClientOption {
+	return func(c *Client) {
+		c.preserveScheme = true
+	}
+}
+
+// WithDefaultHeader adds a header that is set on every request, unless the
+// request sets the header itself, e.g. a tenant ID or correlation header.
+func WithDefaultHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		if c.defaultHeaders == nil {
+			c.defaultHeaders = make(http.Header)
+		}
+		c.defaultHeaders.Add(key, value)
+	}
+}
+
+// WithDefaultHeaders adds headers that are set on every request, as
+// WithDefaultHeader.
+func WithDefaultHeaders(headers http.Header) ClientOption {
+	return func(c *Client) {
+		for key, values := range headers {
+			for _, value := range values {
+				WithDefaultHeader(key, value)(c)
+			}
+		}
+	}
+}
+
+// WithXDS sets the URI of an xDS server used to resolve addresses. If not
+// set, the EXPERIMENTAL_XDS_SERVER_URI environment variable is used.
 func WithXDS(serverURI string) ClientOption {
 	return func(c *Client) {
-		c.xdsServerURI = serverURI
+		c.xdsConfig.ServerURI = serverURI
+	}
+}
+
+// WithXDSEnabled explicitly enables or disables xDS. By default xDS is enabled
+// if a server URI is set using WithXDS or the EXPERIMENTAL_XDS_SERVER_URI
+// environment variable. If not set, the EXPERIMENTAL_ENABLE_XDS environment
+// variable is used. If xDS is enabled but cannot be configured, e.g. because
+// no server URI is set, creating the client fails unless WithXDSFallback is
+// set.
+func WithXDSEnabled(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Enabled = &enabled
+	}
+}
+
+// WithXDSFallback sets whether the client falls back to the default
+// transport, logging a warning, if xDS is enabled but cannot be configured.
+// By default creating the client fails instead.
+func WithXDSFallback(fallback bool) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Fallback = fallback
 	}
 }
 
+// WithXDSNodeID sets the node ID sent to the xDS server. If not set, the
+// EXPERIMENTAL_XDS_NODE_ID environment variable is used, falling back to the
+// workload's SPIFFE ID.
 func WithXDSNodeID(nodeID string) ClientOption {
 	return func(c *Client) {
-		c.xdsNodeID = nodeID
+		c.xdsConfig.NodeID = nodeID
+	}
+}
+
+// WithXDSDiscoveryTimeout sets how long to wait for the endpoints of a service
+// to be discovered via xDS when it is first dialed, so that the first request
+// is also routed via xDS. If the endpoints are not discovered in time, the
+// address is dialed directly. By default there is no wait.
+func WithXDSDiscoveryTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DiscoveryTimeout = timeout
+	}
+}
+
+// WithXDSSubscriptionTTL bounds the number of xDS subscriptions when many
+// distinct hosts are requested. The subscription of a service whose endpoints
+// have not been requested for ttl is evicted, along with its cached endpoints.
+// By default subscriptions are never evicted.
+func WithXDSSubscriptionTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.SubscriptionTTL = ttl
+	}
+}
+
+// WithXDSEndpointTTL bounds how long endpoints discovered via xDS are used
+// while the xDS stream is down. Once they have not been refreshed for ttl,
+// hosts are resolved using DNS instead. By default cached endpoints are used
+// indefinitely.
+func WithXDSEndpointTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.EndpointTTL = ttl
+	}
+}
+
+// WithXDSDropUnhealthy drops endpoints discovered via xDS whose health status
+// is neither HEALTHY nor UNKNOWN, e.g. DRAINING or UNHEALTHY endpoints. By
+// default such endpoints are only used if a service has no healthy endpoints.
+func WithXDSDropUnhealthy() ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DropUnhealthy = true
+	}
+}
+
+// WithXDSDuplicateWeightMax gives an endpoint whose address is listed more
+// than once for a service, e.g. in different localities, the maximum weight of
+// its duplicates. By default their weights are summed.
+func WithXDSDuplicateWeightMax() ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.DuplicateWeight = xds.DuplicateWeightMax
+	}
+}
+
+// WithXDSMinReconnectInterval sets the minimum time between reconnections to
+// the xDS server, which bounds the reconnection rate if the server repeatedly
+// closes the stream. By default only the exponential backoff applies.
+func WithXDSMinReconnectInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.MinReconnectInterval = interval
+	}
+}
+
+// WithXDSInitialFetchTimeout sets how long to wait for the endpoints of a
+// service to be received from the xDS server. If they are not received in
+// time, a warning is logged and the service is treated as having no endpoints
+// until they are. By default there is no timeout.
+func WithXDSInitialFetchTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.InitialFetchTimeout = timeout
+	}
+}
+
+// WithXDSNode sets a template for the node sent to the xDS server, e.g. to set
+// its cluster, locality and metadata. The node ID is set using WithXDSNodeID.
+func WithXDSNode(node *core.Node) ClientOption {
+	return func(c *Client) {
+		c.xdsConfig.Node = node
+	}
+}
+
+// WithSelector sets the selector of the endpoint of a service discovered via
+// xDS that a request is sent to. By default endpoints are selected at random
+// in proportion to their weights, preferring healthy endpoints.
+func WithSelector(selector Selector) ClientOption {
+	return func(c *Client) {
+		c.selector = selector
+	}
+}
+
+// WithWeightOverride overrides the weights of the endpoints of services
+// discovered via xDS when selecting the endpoint that a request is sent to,
+// e.g. to send a fixed share of requests to a canary regardless of its xDS
+// weight. If override returns a non-negative weight, it replaces the
+// endpoint's weight. An endpoint whose weight is overridden to zero is never
+// selected.
+func WithWeightOverride(override func(service string, endpoint Endpoint) int) ClientOption {
+	return func(c *Client) {
+		c.weightOverride = override
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version accepted by the client, e.g.
+// tls.VersionTLS13. Certificates and trust roots are still supplied by SPIRE.
+func WithMinTLSVersion(version uint16) ClientOption {
+	return func(c *Client) {
+		c.minTLSVersion = version
+	}
+}
+
+// WithCipherSuites restricts the cipher suites offered by the client for TLS
+// 1.2 and below. TLS 1.3 cipher suites are not configurable. Certificates and
+// trust roots are still supplied by SPIRE.
+func WithCipherSuites(suites []uint16) ClientOption {
+	return func(c *Client) {
+		c.cipherSuites = suites
+	}
+}
+
+// WithTransportTemplate sets a transport whose non-TLS settings (e.g.
+// MaxIdleConns, MaxIdleConnsPerHost, IdleConnTimeout) are copied into the
+// transport constructed by the client. The SPIRE-derived TLS config always
+// takes precedence over any TLS settings on the template.
+func WithTransportTemplate(template *http.Transport) ClientOption {
+	return func(c *Client) {
+		c.transportTemplate = template
+	}
+}
+
+// WithCompression sets whether the client requests gzip-encoded responses and
+// transparently decompresses them, for both the plain and xDS transports. It
+// takes precedence over DisableCompression of any transport template. By
+// default compression is enabled.
+func WithCompression(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.compression = &enabled
+	}
+}
+
+// WithDialContext sets the function used to dial network addresses, e.g. to
+// use a custom resolver or to dial via a proxy. When xDS is enabled, it is
+// used both to dial the endpoints discovered via xDS and to dial hosts that
+// have no endpoints. It takes precedence over the DialContext of a transport
+// set using WithTransportTemplate.
+func WithDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(c *Client) {
+		c.dialContext = dialContext
+	}
+}
+
+// WithProxy sets the proxy for requests, overriding the default of
+// http.ProxyFromEnvironment. When xDS is enabled, the proxy is only used for
+// hosts that are not resolved via xDS; endpoints discovered via xDS are
+// dialed directly.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(c *Client) {
+		c.proxy = proxy
+	}
+}
+
+// WithX509Source sets an existing X509Source to use rather than creating one
+// from the SPIRE workload API.
+func WithX509Source(source *workloadapi.X509Source) ClientOption {
+	return func(c *Client) {
+		c.X509Source = source
+	}
+}
+
+// WithBundleSource sets an existing BundleSource to use rather than creating
+// one from the SPIRE workload API.
+func WithBundleSource(source *workloadapi.BundleSource) ClientOption {
+	return func(c *Client) {
+		c.BundleSource = source
+	}
+}
+
+// WithRetry retries idempotent requests up to maxAttempts times in total,
+// waiting with an exponential backoff between attempts. A request is retried
+// when retryOn returns true for the response and error of an attempt. If
+// retryOn is nil, requests are retried on transport errors and 502, 503 and
+// 504 responses.
+//
+// Requests using GET, HEAD, OPTIONS, TRACE, PUT or DELETE are idempotent, as
+// are requests with an Idempotency-Key or X-Idempotency-Key header. Request
+// bodies are replayed using Request.GetBody, and requests with a body but no
+// GetBody are not retried. Retries stop when the request context is done,
+// including when the client Timeout expires.
+func WithRetry(maxAttempts int, retryOn func(*http.Response, error) bool) ClientOption {
+	return func(c *Client) {
+		c.retryMaxAttempts = maxAttempts
+		c.retryOn = retryOn
+	}
+}
+
+// WithRetryBackoff sets the initial and maximum delays of the exponential
+// backoff between retries of requests; see WithRetry. A zero delay keeps its
+// default: the backoff starts at 200ms and is capped at 10s.
+func WithRetryBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retryBackoffInitialDelay = initial
+		c.retryBackoffMaxDelay = max
+	}
+}
+
+// WithRetryBackoffJitter sets whether the backoff between retries of requests
+// uses decorrelated jitter, picking each delay at random between the initial
+// delay and three times the previous delay, so that clients retrying together
+// do not retry in step; see WithRetry. By default the delay doubles after
+// each retry.
+func WithRetryBackoffJitter(jitter bool) ClientOption {
+	return func(c *Client) {
+		c.retryBackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithRoundTripperMiddleware wraps the client's transport, e.g. to inject
+// tracing headers or record request metrics. Middleware is applied in order,
+// so the first wraps the others, and sees each request once regardless of any
+// retries.
+func WithRoundTripperMiddleware(middleware ...func(http.RoundTripper) http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+// WithMetrics sets a recorder for xDS, SPIRE and dial metrics, e.g. to export them to Prometheus.
+// By default metrics are not recorded.
+func WithMetrics(recorder metrics.Recorder) ClientOption {
+	return func(c *Client) {
+		c.Metrics = recorder
+	}
+}
+
+// WithSVIDExpiryWarning logs a warning when the remaining validity of the
+// workload's X509-SVID drops below threshold without it having been rotated,
+// e.g. because the SPIRE agent is stuck. Callbacks for the warning can be
+// registered using OnSVIDExpiring. By default there is no warning.
+func WithSVIDExpiryWarning(threshold time.Duration) ClientOption {
+	return func(c *Client) {
+		c.SVIDExpiryThreshold = threshold
+	}
+}
+
+// WithLogger sets the logger for SPIRE bootstrap, SVID rotation, xDS discovery
+// and dialing. By default slog.Default() is used.
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(c *Client) {
+		if logger != nil {
+			c.Logger = logger
+		}
 	}
 }
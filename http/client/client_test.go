@@ -0,0 +1,432 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestNewClientWithContext_notReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// No SPIRE agent is listening on this socket.
+	spireAddr := "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+
+	client, err := NewClientWithContext(ctx, WithSPIREAddress(spireAddr))
+	assert.Nil(t, client)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewClientWithContext_notReadyStopsBootstrap(t *testing.T) {
+	running := bootstrapGoroutines()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// No SPIRE agent is listening on this socket.
+	spireAddr := "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+
+	_, err := NewClientWithContext(ctx, WithSPIREAddress(spireAddr))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The bootstrap does not keep retrying once construction fails.
+	assert.Eventually(t, func() bool {
+		return bootstrapGoroutines() <= running
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// bootstrapGoroutines returns the number of goroutines bootstrapping SPIRE.
+func bootstrapGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Count(string(buf[:n]), "spirehelper.(*SPIREHelper).bootstrap(")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func TestClient_initTransport_withXDS(t *testing.T) {
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+	for _, opt := range []ClientOption{WithXDS("passthrough:///xds-server"), WithXDSNodeID("test-node")} {
+		opt(c)
+	}
+
+	rt, err := c.initTransport(&tls.Config{})
+	require.NoError(t, err)
+	assert.IsType(t, &transport.CofideTransport{}, rt)
+}
+
+func TestClient_initTransport_withXDSDialOptions(t *testing.T) {
+	var dialed atomic.Bool
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+	for _, opt := range []ClientOption{
+		WithXDS("passthrough:///xds-server"),
+		WithXDSNodeID("test-node"),
+		WithXDSDialOptions(grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			dialed.Store(true)
+			return nil, errors.New("dial refused")
+		})),
+	} {
+		opt(c)
+	}
+
+	rt, err := c.initTransport(&tls.Config{})
+	require.NoError(t, err)
+
+	// The first request for a service starts the xDS watch, which dials the
+	// xDS server using the dial options.
+	req, err := http.NewRequest(http.MethodGet, "https://service.invalid/", nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	assert.Eventually(t, dialed.Load, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_initTransport_withoutXDS(t *testing.T) {
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+
+	rt, err := c.initTransport(&tls.Config{})
+	require.NoError(t, err)
+	assert.IsType(t, &http.Transport{}, rt)
+}
+
+func TestClient_initTransport_withCompression(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			_, _ = io.WriteString(w, "uncompressed")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		_, _ = io.WriteString(gw, "compressed")
+		_ = gw.Close()
+	}))
+	defer srv.Close()
+
+	for _, xdsServerURI := range []string{"", "passthrough:///xds-server"} {
+		for _, enabled := range []bool{true, false} {
+			t.Run(fmt.Sprintf("xds=%s,enabled=%t", xdsServerURI, enabled), func(t *testing.T) {
+				c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+				template := &http.Transport{DisableCompression: enabled}
+				for _, opt := range []ClientOption{
+					WithXDS(xdsServerURI),
+					WithXDSNodeID("test-node"),
+					WithTransportTemplate(template),
+					WithCompression(enabled),
+				} {
+					opt(c)
+				}
+
+				rt, err := c.initTransport(&tls.Config{})
+				require.NoError(t, err)
+
+				resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				if enabled {
+					// The gzip-encoded response is decompressed.
+					assert.Equal(t, "compressed", string(body))
+					assert.True(t, resp.Uncompressed)
+				} else {
+					assert.Equal(t, "uncompressed", string(body))
+				}
+				// The template is not modified.
+				assert.Equal(t, enabled, template.DisableCompression)
+			})
+		}
+	}
+}
+
+func TestClient_initTransport_xdsEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []ClientOption
+		wantType http.RoundTripper
+		wantErr  string
+	}{
+		{
+			name:    "enabled without server URI",
+			opts:    []ClientOption{WithXDSEnabled(true)},
+			wantErr: "xDS is enabled but no xDS server URI is set",
+		},
+		{
+			name:     "enabled without server URI with fallback",
+			opts:     []ClientOption{WithXDSEnabled(true), WithXDSFallback(true)},
+			wantType: &http.Transport{},
+		},
+		{
+			name:     "disabled with server URI",
+			opts:     []ClientOption{WithXDSEnabled(false), WithXDS("passthrough:///xds-server")},
+			wantType: &http.Transport{},
+		},
+		{
+			name:     "enabled with server URI",
+			opts:     []ClientOption{WithXDSEnabled(true), WithXDS("passthrough:///xds-server"), WithXDSNodeID("test-node")},
+			wantType: &transport.CofideTransport{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+			for _, opt := range tt.opts {
+				opt(c)
+			}
+
+			rt, err := c.initTransport(&tls.Config{})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.wantType, rt)
+		})
+	}
+}
+
+func TestClient_initTransport_withDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, xdsServerURI := range []string{"", "passthrough:///xds-server"} {
+		t.Run("xds="+xdsServerURI, func(t *testing.T) {
+			var dialed atomic.Bool
+			c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+			for _, opt := range []ClientOption{
+				WithXDS(xdsServerURI),
+				WithXDSNodeID("test-node"),
+				WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+					dialed.Store(true)
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				}),
+			} {
+				opt(c)
+			}
+
+			rt, err := c.initTransport(&tls.Config{})
+			require.NoError(t, err)
+
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.True(t, dialed.Load())
+		})
+	}
+}
+
+func TestClient_initTransport_withProxy(t *testing.T) {
+	var proxied atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.Host == "service.invalid")
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	for _, xdsServerURI := range []string{"", "passthrough:///xds-server"} {
+		t.Run("xds="+xdsServerURI, func(t *testing.T) {
+			proxied.Store(false)
+			c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+			for _, opt := range []ClientOption{
+				WithXDS(xdsServerURI),
+				WithXDSNodeID("test-node"),
+				WithProxy(http.ProxyURL(proxyURL)),
+			} {
+				opt(c)
+			}
+
+			rt, err := c.initTransport(&tls.Config{})
+			require.NoError(t, err)
+
+			resp, err := (&http.Client{Transport: rt}).Get("http://service.invalid/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.True(t, proxied.Load())
+		})
+	}
+}
+
+func TestClient_redirectReplaysBody(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/old":
+			http.Redirect(w, r, "/new", http.StatusTemporaryRedirect)
+		case attempts.Add(1)%2 == 1:
+			// Fail the first attempt of each redirected request, so that it
+			// is retried.
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = io.Copy(w, r.Body)
+		}
+	}))
+	defer srv.Close()
+
+	// Post and Put send requests created using http.NewRequest, which sets
+	// GetBody for these bodies, through the client's transport.
+	c := &Client{Transport: newRetryTransport(srv.Client().Transport, 2, nil, backoff.WithDelays(time.Millisecond, time.Millisecond))}
+
+	tests := []struct {
+		name   string
+		method string
+		body   func(string) io.Reader
+	}{
+		{
+			name:   "post",
+			method: http.MethodPost,
+			body:   func(s string) io.Reader { return strings.NewReader(s) },
+		},
+		{
+			name:   "put",
+			method: http.MethodPut,
+			body:   func(s string) io.Reader { return bytes.NewBufferString(s) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+"/old", tt.body("hello"))
+			require.NoError(t, err)
+			// POST requests are only retried with an idempotency key.
+			req.Header.Set("Idempotency-Key", tt.name)
+			resp, err := c.getHttp().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "hello", string(body))
+		})
+	}
+}
+
+func TestClient_notReady(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request")
+	}))
+	defer srv.Close()
+
+	// SPIRE bootstrap fails immediately for an invalid address, so requests
+	// fail rather than being sent without the SPIRE sources.
+	c := &Client{
+		SPIREHelper: spirehelper.NewSPIREHelper(context.Background()),
+		Transport:   srv.Client().Transport,
+	}
+	c.SPIREAddr = "http://invalid"
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+	_, err = c.Get(srv.URL)
+	assert.Error(t, err)
+	_, err = c.Post(srv.URL, "text/plain", strings.NewReader("hello"))
+	assert.Error(t, err)
+}
+
+func TestClient_withLogger(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+	WithLogger(logger)(c)
+	assert.Same(t, logger, c.Logger)
+
+	// A nil logger is ignored.
+	WithLogger(nil)(c)
+	assert.Same(t, logger, c.Logger)
+}
+
+func TestClient_TLSClientConfig_notReady(t *testing.T) {
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+	c.SPIREAddr = "http://invalid"
+
+	_, err := c.TLSClientConfig()
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// headerMiddleware returns a middleware that sets a header on requests, and
+// records the header values it has seen, e.g. to propagate a trace ID.
+func headerMiddleware(value string, seen *[]string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			*seen = append(*seen, req.Header.Get("X-Trace"))
+			req.Header.Set("X-Trace", req.Header.Get("X-Trace")+value)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+func TestClient_WithRoundTripperMiddleware(t *testing.T) {
+	var got string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Get("X-Trace")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	c := &Client{Transport: base}
+	var seen []string
+	WithRoundTripperMiddleware(headerMiddleware("a", &seen), headerMiddleware("b", &seen))(c)
+
+	resp, err := c.getHttp().Get("https://example.org")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// The first middleware wraps the second.
+	assert.Equal(t, "ab", got)
+	assert.Equal(t, []string{"", "a"}, seen)
+}
+
+func TestClient_withBackoffJitter(t *testing.T) {
+	c := &Client{SPIREHelper: spirehelper.NewSPIREHelper(context.Background())}
+	WithSPIREBackoffJitter(true)(c)
+	WithXDSBackoffJitter(true)(c)
+	WithRetryBackoffJitter(true)(c)
+
+	assert.Equal(t, backoff.StrategyDecorrelatedJitter, c.BackoffStrategy)
+	assert.Equal(t, backoff.StrategyDecorrelatedJitter, c.xdsConfig.BackoffStrategy)
+	assert.Equal(t, backoff.StrategyDecorrelatedJitter, c.retryBackoffStrategy)
+
+	WithRetryBackoffJitter(false)(c)
+	assert.Equal(t, backoff.StrategyExponential, c.retryBackoffStrategy)
+}
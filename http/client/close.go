@@ -0,0 +1,60 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrClientClosed is returned for requests made after the client is closed.
+var ErrClientClosed = errors.New("cofide http client is closed")
+
+// Close closes idle connections and releases the SPIRE sources and xDS client
+// of the client, stopping their background goroutines. Requests made after
+// Close fail with an error wrapping ErrClientClosed. Calls after the first
+// have no effect.
+func (c *Client) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	c.CloseIdleConnections()
+
+	var errs []error
+	if c.xdsClient != nil {
+		errs = append(errs, c.xdsClient.Close())
+	}
+	errs = append(errs, c.SPIREHelper.Close())
+	return errors.Join(errs...)
+}
+
+// closedTransport is an http.RoundTripper that fails requests once closed is
+// set, and otherwise sends them using base.
+type closedTransport struct {
+	base   http.RoundTripper
+	closed *atomic.Bool
+}
+
+func newClosedTransport(base http.RoundTripper, closed *atomic.Bool) *closedTransport {
+	return &closedTransport{base: base, closed: closed}
+}
+
+func (t *closedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.closed.Load() {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, ErrClientClosed
+	}
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of the base transport.
+func (t *closedTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_test
+
+import (
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_http "github.com/cofide/cofide-sdk-go/http/client"
+)
+
+func TestClient_Close(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/client")
+
+	client, err := spiretest.NewHTTPClient(api)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+
+	// The SPIRE sources created by the client are closed.
+	_, err = client.X509Source.GetX509SVID()
+	assert.ErrorContains(t, err, "source is closed")
+	_, err = client.BundleSource.GetX509BundleForTrustDomain(ca.TrustDomain())
+	assert.ErrorContains(t, err, "source is closed")
+
+	_, err = client.Get("http://127.0.0.1:1")
+	assert.ErrorIs(t, err, cofide_http.ErrClientClosed)
+
+	// Closing again has no effect.
+	assert.NoError(t, client.Close())
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"net/http"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+)
+
+// Endpoint is an endpoint of a service discovered via xDS.
+type Endpoint = xds.Endpoint
+
+// Selector selects the endpoint of a service discovered via xDS that a request
+// is sent to.
+type Selector = transport.Selector
+
+// HashKeyFunc returns the key of a request used to select its endpoint by
+// consistent hashing, and false if the request has no key.
+type HashKeyFunc = transport.HashKeyFunc
+
+// NewRingHashSelector returns a Selector that sends requests with the same key
+// to the same endpoint while the endpoints of the service are unchanged, e.g.
+// for session affinity. Endpoints are weighted by their xDS weights. Requests
+// without a key are sent to an endpoint selected at random.
+func NewRingHashSelector(key HashKeyFunc) Selector {
+	return transport.NewRingHashSelector(key)
+}
+
+// NewLeastRequestSelector returns a Selector that sends requests to the
+// endpoint with the fewest requests in flight relative to its xDS weight, e.g.
+// to reduce tail latency when endpoints have uneven processing times. A request
+// is in flight until its response body is closed.
+func NewLeastRequestSelector() Selector {
+	return transport.LeastRequestSelector{}
+}
+
+// HeaderHashKey returns a HashKeyFunc that keys requests by the value of a
+// header.
+func HeaderHashKey(name string) HashKeyFunc {
+	return transport.HeaderHashKey(name)
+}
+
+// CookieHashKey returns a HashKeyFunc that keys requests by the value of a
+// cookie.
+func CookieHashKey(name string) HashKeyFunc {
+	return transport.CookieHashKey(name)
+}
+
+// ResolvedEndpoint returns the xDS endpoint that served a request, if its host
+// was resolved via xDS. req should be the Request of the response, e.g.
+//
+//	resp, err := client.Get("https://my-service/")
+//	if ep, ok := cofide_http.ResolvedEndpoint(resp.Request); ok {
+//		log.Printf("served by %s:%d weight %d", ep.Host, ep.Port, ep.Weight)
+//	}
+func ResolvedEndpoint(req *http.Request) (Endpoint, bool) {
+	if req == nil {
+		return Endpoint{}, false
+	}
+	return transport.EndpointFromContext(req.Context())
+}
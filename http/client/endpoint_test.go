@@ -0,0 +1,31 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+)
+
+func TestResolvedEndpoint(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://my-service/", nil)
+	assert.NoError(t, err)
+
+	_, ok := ResolvedEndpoint(req)
+	assert.False(t, ok)
+
+	_, ok = ResolvedEndpoint(nil)
+	assert.False(t, ok)
+
+	endpoint := Endpoint{Host: "1.2.3.4", Port: 4321, Weight: 42}
+	req = req.WithContext(transport.ContextWithEndpoint(req.Context(), endpoint))
+
+	got, ok := ResolvedEndpoint(req)
+	assert.True(t, ok)
+	assert.Equal(t, endpoint, got)
+}
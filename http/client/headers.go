@@ -0,0 +1,46 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import "net/http"
+
+// defaultHeaderTransport is an http.RoundTripper that adds default headers to
+// requests that do not already set them.
+type defaultHeaderTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func newDefaultHeaderTransport(base http.RoundTripper, headers http.Header) *defaultHeaderTransport {
+	return &defaultHeaderTransport{base: base, headers: headers}
+}
+
+func (t *defaultHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var missing []string
+	for key := range t.headers {
+		if _, ok := req.Header[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	// Clone the request, as a RoundTripper must not modify it.
+	headerReq := req.Clone(req.Context())
+	for _, key := range missing {
+		headerReq.Header[key] = append([]string(nil), t.headers[key]...)
+	}
+
+	resp, err := t.base.RoundTrip(headerReq)
+	restoreRequest(resp, req)
+	return resp, err
+}
+
+// CloseIdleConnections closes idle connections of the base transport.
+func (t *defaultHeaderTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
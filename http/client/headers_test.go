@@ -0,0 +1,70 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+)
+
+func TestDefaultHeaderTransport(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	c := &Client{}
+	WithDefaultHeader("X-Tenant-ID", "tenant-1")(c)
+	WithDefaultHeaders(http.Header{"X-Correlation-Id": {"default"}, "Accept": {"application/json", "text/plain"}})(c)
+	client := &http.Client{Transport: newDefaultHeaderTransport(http.DefaultTransport, c.defaultHeaders)}
+
+	// Default headers are added to requests.
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "tenant-1", got.Get("X-Tenant-ID"))
+	assert.Equal(t, "default", got.Get("X-Correlation-ID"))
+	assert.Equal(t, []string{"application/json", "text/plain"}, got.Values("Accept"))
+
+	// Headers set on the request take precedence, and the request is not modified.
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Correlation-ID", "request")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "tenant-1", got.Get("X-Tenant-ID"))
+	assert.Equal(t, []string{"request"}, got.Values("X-Correlation-ID"))
+	assert.Empty(t, req.Header.Get("X-Tenant-ID"))
+	assert.Empty(t, resp.Request.Header.Get("X-Tenant-ID"))
+}
+
+func TestDefaultHeaderTransport_resolvedEndpoint(t *testing.T) {
+	endpoint := Endpoint{Host: "1.2.3.4", Port: 4321, Weight: 42}
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// Like CofideTransport, record the endpoint in the request.
+		req = req.WithContext(transport.ContextWithEndpoint(req.Context(), endpoint))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	c := &Client{}
+	WithDefaultHeader("X-Tenant-ID", "tenant-1")(c)
+	rt := newDefaultHeaderTransport(newHTTPSTransport(base), c.defaultHeaders)
+
+	req, err := http.NewRequest(http.MethodGet, "http://my-service/path", nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	got, ok := ResolvedEndpoint(resp.Request)
+	assert.True(t, ok)
+	assert.Equal(t, endpoint, got)
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+)
+
+// retryTransport is an http.RoundTripper that retries idempotent requests,
+// waiting with an exponential backoff between attempts.
+type retryTransport struct {
+	base        http.RoundTripper
+	maxAttempts int
+	retryOn     func(*http.Response, error) bool
+	backoffOpts []backoff.BackoffOption
+}
+
+func newRetryTransport(base http.RoundTripper, maxAttempts int, retryOn func(*http.Response, error) bool, backoffOpts ...backoff.BackoffOption) *retryTransport {
+	if retryOn == nil {
+		retryOn = defaultRetryOn
+	}
+
+	return &retryTransport{
+		base:        base,
+		maxAttempts: maxAttempts,
+		retryOn:     retryOn,
+		backoffOpts: backoffOpts,
+	}
+}
+
+// CloseIdleConnections closes idle connections of the base transport.
+func (t *retryTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// defaultRetryOn retries on transport errors and gateway errors, which are
+// typical while endpoints are being replaced.
+func defaultRetryOn(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.maxAttempts <= 1 || !isRetryable(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	b := backoff.NewBackoff(t.backoffOpts...)
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.Body != nil && req.Body != http.NoBody {
+			// The body of the previous attempt has been consumed, so rewind it.
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= t.maxAttempts || !t.retryOn(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(b.Duration()):
+		}
+	}
+}
+
+// isRetryable returns whether req is idempotent and its body, if any, can be
+// replayed. Requests using non-idempotent methods such as POST are considered
+// idempotent if they have an Idempotency-Key or X-Idempotency-Key header.
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
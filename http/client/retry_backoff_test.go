@@ -0,0 +1,40 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_http "github.com/cofide/cofide-sdk-go/http/client"
+)
+
+func TestWithRetryBackoff(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/client")
+
+	client, err := spiretest.NewHTTPClient(api,
+		cofide_http.WithRetry(2, nil),
+		cofide_http.WithRetryBackoff(time.Minute, time.Minute),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	// Nothing is listening, so the request is retried after the backoff,
+	// which outlasts the request.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1:1", nil)
+	require.NoError(t, err)
+
+	_, err = client.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
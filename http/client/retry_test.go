@@ -0,0 +1,127 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyServer returns a server that responds with 503 to the first failures
+// requests, and echoes the request body afterwards.
+func newFlakyServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+func newTestRetryClient(maxAttempts int) *http.Client {
+	rt := newRetryTransport(http.DefaultTransport, maxAttempts, nil, backoff.WithInitialDelay(time.Millisecond))
+	return &http.Client{Transport: rt}
+}
+
+func TestRetryTransport_get(t *testing.T) {
+	srv, count := newFlakyServer(t, 2)
+
+	resp, err := newTestRetryClient(3).Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), count.Load())
+}
+
+func TestRetryTransport_maxAttempts(t *testing.T) {
+	srv, count := newFlakyServer(t, 5)
+
+	resp, err := newTestRetryClient(3).Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(3), count.Load())
+}
+
+func TestRetryTransport_postNotIdempotent(t *testing.T) {
+	srv, count := newFlakyServer(t, 1)
+
+	resp, err := newTestRetryClient(3).Post(srv.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), count.Load())
+}
+
+func TestRetryTransport_postIdempotencyKey(t *testing.T) {
+	srv, count := newFlakyServer(t, 2)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set("Idempotency-Key", "42")
+
+	resp, err := newTestRetryClient(3).Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, int32(3), count.Load())
+}
+
+func TestRetryTransport_contextCancelled(t *testing.T) {
+	srv, count := newFlakyServer(t, 5)
+
+	rt := newRetryTransport(http.DefaultTransport, 3, nil, backoff.WithInitialDelay(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	_, err = (&http.Client{Transport: rt}).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), count.Load())
+}
+
+// idleClosingTransport records calls to CloseIdleConnections.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed atomic.Bool
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed.Store(true)
+}
+
+func TestClient_Close_withRetry(t *testing.T) {
+	base := &idleClosingTransport{RoundTripper: http.DefaultTransport}
+	c := &Client{
+		SPIREHelper: spirehelper.NewSPIREHelper(context.Background()),
+		Transport:   newRetryTransport(base, 3, nil),
+	}
+
+	require.NoError(t, c.Close())
+	assert.True(t, base.closed.Load())
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import "net/http"
+
+// httpsTransport is an http.RoundTripper that sends http requests as https
+// requests, so that they use mTLS, without modifying the requests' URLs.
+type httpsTransport struct {
+	base http.RoundTripper
+}
+
+func newHTTPSTransport(base http.RoundTripper) *httpsTransport {
+	return &httpsTransport{base: base}
+}
+
+func (t *httpsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.base.RoundTrip(req)
+	}
+
+	// Clone the request, which also copies its URL.
+	httpsReq := req.Clone(req.Context())
+	httpsReq.URL.Scheme = "https"
+
+	resp, err := t.base.RoundTrip(httpsReq)
+	restoreRequest(resp, req)
+	return resp, err
+}
+
+// restoreRequest sets the Request of resp, which was sent as a modified copy of
+// req, back to req. The context of the copy is kept, as it records the
+// endpoint that served the request; see ResolvedEndpoint.
+func restoreRequest(resp *http.Response, req *http.Request) {
+	if resp == nil {
+		return
+	}
+	if resp.Request == nil {
+		resp.Request = req
+		return
+	}
+	resp.Request = req.WithContext(resp.Request.Context())
+}
+
+// CloseIdleConnections closes idle connections of the base transport.
+func (t *httpsTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
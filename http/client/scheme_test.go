@@ -0,0 +1,67 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+)
+
+func TestHTTPSTransport(t *testing.T) {
+	var gotTLS bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTLS = r.TLS != nil
+	}))
+	defer srv.Close()
+
+	rt := newHTTPSTransport(srv.Client().Transport)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+srv.Listener.Addr().String()+"/path", nil)
+	require.NoError(t, err)
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, gotTLS)
+	// The request's scheme is preserved.
+	assert.Equal(t, "http", req.URL.Scheme)
+	assert.Equal(t, req.URL, resp.Request.URL)
+}
+
+func TestHTTPSTransport_resolvedEndpoint(t *testing.T) {
+	endpoint := Endpoint{Host: "1.2.3.4", Port: 4321, Weight: 42}
+	rt := newHTTPSTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// Like CofideTransport, record the endpoint in the request.
+		req = req.WithContext(transport.ContextWithEndpoint(req.Context(), endpoint))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://my-service/path", nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// The response's request has the original scheme, and the endpoint.
+	assert.Equal(t, "http", resp.Request.URL.Scheme)
+	got, ok := ResolvedEndpoint(resp.Request)
+	assert.True(t, ok)
+	assert.Equal(t, endpoint, got)
+}
+
+func TestClient_secureURL(t *testing.T) {
+	c := &Client{}
+	assert.Equal(t, "https://service/path", c.secureURL("http://service/path"))
+	assert.Equal(t, "https://service/path", c.secureURL("https://service/path"))
+
+	WithPreserveScheme()(c)
+	assert.Equal(t, "http://service/path", c.secureURL("http://service/path"))
+}
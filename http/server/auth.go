@@ -0,0 +1,85 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// ErrAnonymousPeer is returned by PeerID when the peer of a request did not
+// present a certificate, e.g. when the server is configured using
+// WithClientAuth to allow anonymous clients.
+var ErrAnonymousPeer = errors.New("anonymous peer: no client certificate presented")
+
+// PeerID returns the SPIFFE ID presented by the peer of a request served over
+// mTLS. If the peer did not present a certificate, ErrAnonymousPeer is
+// returned.
+func PeerID(r *http.Request) (*id.SPIFFEID, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrAnonymousPeer
+	}
+
+	spiffeID, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peer SPIFFE ID: %w", err)
+	}
+
+	return id.FromSpiffeID(spiffeID), nil
+}
+
+// RequireMatch returns a handler that serves requests using h if the SPIFFE
+// ID of the peer matches all of funcs. Otherwise it responds with 401
+// Unauthorized if the peer did not present an ID, or 403 Forbidden.
+func RequireMatch(h http.Handler, funcs ...id.MatchFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerID, err := PeerID(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if err := peerID.Matches(funcs...); err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AuthMux is a request multiplexer that authorizes the peer of each request
+// against the MatchFunc of the route it matches. Routes without MatchFunc rely
+// on the server's Authorizer alone, which is applied to every connection.
+type AuthMux struct {
+	mux *http.ServeMux
+}
+
+// NewAuthMux returns a new AuthMux.
+func NewAuthMux() *AuthMux {
+	return &AuthMux{mux: http.NewServeMux()}
+}
+
+// Handle registers h for pattern, as for http.ServeMux, requiring the SPIFFE
+// ID of the peer to match all of funcs.
+func (m *AuthMux) Handle(pattern string, h http.Handler, funcs ...id.MatchFunc) {
+	if len(funcs) > 0 {
+		h = RequireMatch(h, funcs...)
+	}
+	m.mux.Handle(pattern, h)
+}
+
+// HandleFunc registers f for pattern, as for http.ServeMux, requiring the
+// SPIFFE ID of the peer to match all of funcs.
+func (m *AuthMux) HandleFunc(pattern string, f func(http.ResponseWriter, *http.Request), funcs ...id.MatchFunc) {
+	m.Handle(pattern, http.HandlerFunc(f), funcs...)
+}
+
+func (m *AuthMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.ServeHTTP(w, r)
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+)
+
+func TestAuthMux(t *testing.T) {
+	mux := NewAuthMux()
+	mux.HandleFunc("/public", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {}, id.Equals("role", "admin"))
+	mux.HandleFunc("/payments/", func(w http.ResponseWriter, r *http.Request) {}, id.Equals("ns", "payments"))
+
+	tests := []struct {
+		name     string
+		path     string
+		peerID   string
+		wantCode int
+	}{
+		{
+			name:     "public route with any peer",
+			path:     "/public",
+			peerID:   "spiffe://example.org/ns/default/role/user",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "public route without peer",
+			path:     "/public",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "admin route with admin peer",
+			path:     "/admin",
+			peerID:   "spiffe://example.org/ns/default/role/admin",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "admin route with user peer",
+			path:     "/admin",
+			peerID:   "spiffe://example.org/ns/default/role/user",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "admin route without peer",
+			path:     "/admin",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "payments route with payments peer",
+			path:     "/payments/charge",
+			peerID:   "spiffe://example.org/ns/payments/role/user",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "payments route with admin peer in other namespace",
+			path:     "/payments/charge",
+			peerID:   "spiffe://example.org/ns/default/role/admin",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown route",
+			path:     "/unknown",
+			peerID:   "spiffe://example.org/ns/default/role/admin",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.peerID != "" {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{makeSVID(t, tt.peerID)}}
+			}
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := PeerID(req)
+	assert.ErrorIs(t, err, ErrAnonymousPeer)
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{makeSVID(t, "spiffe://example.org/ns/default")}}
+	peerID, err := PeerID(req)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/ns/default", peerID.String())
+}
+
+// makeSVID returns a self-signed certificate with a SPIFFE ID URI SAN.
+func makeSVID(t *testing.T, spiffeID string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	uri, err := url.Parse(spiffeID)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(raw)
+	require.NoError(t, err)
+	return cert
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_http_server "github.com/cofide/cofide-sdk-go/http/server"
+)
+
+func TestServer_WithBundleSource(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	otherCA, err := spiretest.NewCA("other.org")
+	require.NoError(t, err)
+
+	// The server's X509Source only has the bundle of its own trust domain,
+	// while its BundleSource also has the bundle of the client's.
+	serverAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/server")
+	bundleAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/bundles")
+	bundleAPI.SetFederatedBundles(otherCA.Bundle())
+	clientAPI := spiretest.NewWorkloadAPI(t, otherCA, "spiffe://other.org/client")
+	clientAPI.SetFederatedBundles(ca.Bundle())
+
+	bundleSource, err := workloadapi.NewBundleSource(context.Background(),
+		workloadapi.WithClientOptions(workloadapi.WithAddr(bundleAPI.Addr())))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bundleSource.Close() })
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := spiretest.NewHTTPServer(serverAPI, &http.Server{Handler: handler},
+		cofide_http_server.WithBundleSource(bundleSource))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// Serving stops once the listener is closed.
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(func() { _ = lis.Close() })
+
+	client, err := spiretest.NewHTTPClient(clientAPI)
+	require.NoError(t, err)
+
+	// The client SVID is verified against the server's BundleSource.
+	resp, err := client.Get("http://" + lis.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connAgeTracker closes connections once they are older than a maximum age,
+// so that clients re-handshake and are presented with the current SVID.
+// Connections are only closed while idle: one that is active when it reaches
+// the maximum age is closed once its in-flight requests are complete.
+type connAgeTracker struct {
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]*trackedConn
+}
+
+// trackedConn is the state of a connection tracked by a connAgeTracker.
+type trackedConn struct {
+	state http.ConnState
+	aged  bool
+	timer *time.Timer
+}
+
+func newConnAgeTracker(maxAge time.Duration) *connAgeTracker {
+	return &connAgeTracker{
+		maxAge: maxAge,
+		conns:  make(map[net.Conn]*trackedConn),
+	}
+}
+
+// connState returns an http.Server ConnState hook that tracks connections,
+// and then calls next, if set.
+func (t *connAgeTracker) connState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		t.update(conn, state)
+		if next != nil {
+			next(conn, state)
+		}
+	}
+}
+
+// update records the new state of conn, closing it if it is idle and aged.
+func (t *connAgeTracker) update(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		t.conns[conn] = &trackedConn{
+			state: state,
+			timer: time.AfterFunc(t.maxAge, func() { t.expire(conn) }),
+		}
+	case http.StateClosed, http.StateHijacked:
+		if tc, ok := t.conns[conn]; ok {
+			tc.timer.Stop()
+			delete(t.conns, conn)
+		}
+	default:
+		tc, ok := t.conns[conn]
+		if !ok {
+			return
+		}
+		tc.state = state
+		if tc.aged && state == http.StateIdle {
+			_ = conn.Close()
+		}
+	}
+}
+
+// expire marks conn as aged, closing it if it is not active.
+func (t *connAgeTracker) expire(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc, ok := t.conns[conn]
+	if !ok {
+		return
+	}
+	tc.aged = true
+	if tc.state != http.StateActive {
+		_ = conn.Close()
+	}
+}
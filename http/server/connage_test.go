@@ -0,0 +1,53 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnAgeTracker(t *testing.T) {
+	const maxAge = 100 * time.Millisecond
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// Remain active beyond the maximum age.
+			time.Sleep(2 * maxAge)
+		}
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	}))
+	srv.Config.ConnState = newConnAgeTracker(maxAge).connState(nil)
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	get := func(path string) string {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// A young connection is reused.
+	first := get("/")
+	assert.Equal(t, first, get("/"))
+
+	// An idle connection is closed once aged.
+	time.Sleep(2 * maxAge)
+	second := get("/")
+	assert.NotEqual(t, first, second)
+
+	// An active connection completes its request, and is then closed.
+	assert.Equal(t, second, get("/slow"))
+	assert.NotEqual(t, second, get("/"))
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"net/http"
+)
+
+// Drain prepares the server to be shut down, e.g. during a rolling deploy.
+// The ReadinessHandler reports the server as not ready, so that load balancers
+// stop routing new connections to it, and keep-alives are disabled, so that
+// existing connections are closed once their in-flight requests complete.
+// The server continues to serve until Shutdown is called, typically after a
+// drain window.
+func (s *Server) Drain() {
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+
+	s.draining.Store(true)
+	// If the http.Server has not been created yet, e.g. because SPIRE is not
+	// ready, creating it here would build its TLS config from sources that
+	// are not yet available, so keep-alives are disabled once it is created.
+	if s.http != nil {
+		s.http.SetKeepAlivesEnabled(false)
+	}
+}
+
+// Draining returns whether Drain has been called.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// ReadinessHandler returns a handler for a readiness probe. It responds with
+// 200 OK once SPIRE is ready, and with 503 Service Unavailable before then or
+// once the server is draining.
+func (s *Server) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case s.Draining():
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+		case !s.Ready():
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
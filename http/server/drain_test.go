@@ -0,0 +1,60 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server_test
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Drain_serving(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	serverAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/server")
+	clientAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/client")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := spiretest.NewHTTPServer(serverAPI, &http.Server{Handler: handler})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lis.Close() })
+
+	go func() { _ = server.Serve(lis) }()
+
+	client, err := spiretest.NewHTTPClient(clientAPI)
+	require.NoError(t, err)
+	get := func() *http.Response {
+		resp, err := client.Get("http://" + lis.Addr().String())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		return resp
+	}
+	assert.False(t, get().Close)
+
+	// Drain and register a shutdown function while the server is serving.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		server.Drain()
+	}()
+	go func() {
+		defer wg.Done()
+		server.RegisterOnShutdown(func() {})
+	}()
+	wg.Wait()
+
+	// Keep-alives are disabled once draining.
+	assert.True(t, get().Close)
+}
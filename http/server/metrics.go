@@ -0,0 +1,89 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// metricsReadHeaderTimeout bounds how long the metrics listener waits for the
+// headers of a request.
+const metricsReadHeaderTimeout = 10 * time.Second
+
+// startMetrics starts serving the metrics handler on its own listener, if one
+// is configured and it has not already been started. It returns an error if
+// the listener could not be created.
+func (s *Server) startMetrics() error {
+	if s.metricsAddr == "" {
+		return nil
+	}
+
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+
+	if s.metricsSrv != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	if s.metricsAuthorizer != nil {
+		ln = tls.NewListener(ln, s.metricsTLSConfig())
+	}
+
+	s.metricsLn = ln
+	s.metricsSrv = &http.Server{
+		Handler:           s.metricsHandler,
+		ReadHeaderTimeout: metricsReadHeaderTimeout,
+	}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Error("Failed to serve metrics", "error", err)
+		}
+	}(s.metricsSrv)
+	return nil
+}
+
+// metricsTLSConfig returns the mTLS config of the metrics listener, which
+// requires a client SVID that is authorized by the metrics authorizer.
+func (s *Server) metricsTLSConfig() *tls.Config {
+	tlsConfig := s.newTLSConfig()
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyPeerCertificate = tlsconfig.VerifyPeerCertificate(s.BundleSource, s.metricsAuthorizer)
+	return tlsConfig
+}
+
+// closeMetrics closes the metrics listener, if it has been started.
+func (s *Server) closeMetrics() error {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+
+	if s.metricsSrv == nil {
+		return nil
+	}
+	return s.metricsSrv.Close()
+}
+
+// shutdownMetrics gracefully shuts down the metrics listener, if it has been
+// started.
+func (s *Server) shutdownMetrics(ctx context.Context) error {
+	s.metricsMu.Lock()
+	srv := s.metricsSrv
+	s.metricsMu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
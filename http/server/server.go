@@ -5,21 +5,74 @@ package cofide_http_server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"golang.org/x/net/http2"
 )
 
 type Server struct {
-	// internal HTTP server
-	http *http.Server
+	// internal HTTP server, created once SPIRE is ready. httpMu guards it, and
+	// onShutdown and http2Err, as it is created by the goroutine serving while
+	// e.g. Drain is called concurrently.
+	http   *http.Server
+	httpMu sync.Mutex
 
 	// consumer given http server
 	upstreamHTTP *http.Server
 
 	*spirehelper.SPIREHelper
+
+	// minTLSVersion is an optional minimum TLS version for the server's TLS config.
+	minTLSVersion uint16
+
+	// cipherSuites is an optional list of cipher suites for the server's TLS config.
+	cipherSuites []uint16
+
+	// clientAuth optionally relaxes the default of requiring a client SVID.
+	clientAuth *tls.ClientAuthType
+
+	// http2 is an optional HTTP/2 configuration for the server.
+	http2 *http2.Server
+
+	// http2Err is any error encountered configuring HTTP/2, returned when serving.
+	http2Err error
+
+	// startupTimeout optionally bounds how long serving waits for SPIRE.
+	startupTimeout time.Duration
+
+	// connAge optionally closes connections older than a maximum age.
+	connAge *connAgeTracker
+
+	// metricsAddr is an optional address of a separate listener for the
+	// metricsHandler, which is protected by mTLS if metricsAuthorizer is set.
+	metricsAddr       string
+	metricsHandler    http.Handler
+	metricsAuthorizer tlsconfig.Authorizer
+
+	// metricsSrv serves the metrics listener metricsLn once started.
+	metricsSrv *http.Server
+	metricsLn  net.Listener
+	metricsMu  sync.Mutex
+
+	// draining is set by Drain, and reported by the ReadinessHandler.
+	draining atomic.Bool
+
+	// onShutdown are the functions registered using RegisterOnShutdown
+	// before the internal HTTP server is created.
+	onShutdown []func()
 }
 
 func NewServer(server *http.Server, opts ...ServerOption) *Server {
@@ -36,6 +89,9 @@ func NewServer(server *http.Server, opts ...ServerOption) *Server {
 }
 
 func (s *Server) getHttp() *http.Server {
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+
 	if s.http != nil {
 		s.http.Handler = s.upstreamHTTP.Handler
 		s.http.Addr = s.upstreamHTTP.Addr
@@ -44,7 +100,7 @@ func (s *Server) getHttp() *http.Server {
 		s.http.WriteTimeout = s.upstreamHTTP.WriteTimeout
 		s.http.IdleTimeout = s.upstreamHTTP.IdleTimeout
 		s.http.MaxHeaderBytes = s.upstreamHTTP.MaxHeaderBytes
-		s.http.ConnState = s.upstreamHTTP.ConnState
+		s.http.ConnState = s.connState()
 		s.http.ErrorLog = s.upstreamHTTP.ErrorLog
 		s.http.BaseContext = s.upstreamHTTP.BaseContext
 		s.http.ConnContext = s.upstreamHTTP.ConnContext
@@ -53,10 +109,8 @@ func (s *Server) getHttp() *http.Server {
 		return s.http
 	}
 
-	tlsConfig := tlsconfig.MTLSServerConfig(s.X509Source, s.X509Source, s.Authorizer)
-
 	s.http = &http.Server{
-		TLSConfig: tlsConfig,
+		TLSConfig: s.newTLSConfig(),
 
 		Handler:                      s.upstreamHTTP.Handler,
 		Addr:                         s.upstreamHTTP.Addr,
@@ -65,18 +119,133 @@ func (s *Server) getHttp() *http.Server {
 		WriteTimeout:                 s.upstreamHTTP.WriteTimeout,
 		IdleTimeout:                  s.upstreamHTTP.IdleTimeout,
 		MaxHeaderBytes:               s.upstreamHTTP.MaxHeaderBytes,
-		ConnState:                    s.upstreamHTTP.ConnState,
+		ConnState:                    s.connState(),
 		ErrorLog:                     s.upstreamHTTP.ErrorLog,
 		BaseContext:                  s.upstreamHTTP.BaseContext,
 		ConnContext:                  s.upstreamHTTP.ConnContext,
 		DisableGeneralOptionsHandler: s.upstreamHTTP.DisableGeneralOptionsHandler,
 	}
 
+	if s.http2 != nil {
+		// Adds h2 to the TLS config's NextProtos so that ALPN negotiates HTTP/2.
+		s.http2Err = http2.ConfigureServer(s.http, s.http2)
+	}
+	if s.Draining() {
+		s.http.SetKeepAlivesEnabled(false)
+	}
+	for _, f := range s.onShutdown {
+		s.http.RegisterOnShutdown(f)
+	}
+
 	return s.http
 }
 
+// connState returns the ConnState hook of the internal HTTP server, which
+// tracks the age of connections if a maximum connection age is set.
+func (s *Server) connState() func(net.Conn, http.ConnState) {
+	if s.connAge == nil {
+		return s.upstreamHTTP.ConnState
+	}
+	return s.connAge.connState(s.upstreamHTTP.ConnState)
+}
+
+// newTLSConfig returns the server's mTLS config, using the SPIRE sources.
+// Client SVIDs are verified against the bundles of the BundleSource.
+func (s *Server) newTLSConfig() *tls.Config {
+	tlsConfig := tlsconfig.MTLSServerConfig(s.X509Source, s.BundleSource, s.TLSAuthorizer())
+	if s.minTLSVersion != 0 {
+		tlsConfig.MinVersion = s.minTLSVersion
+	}
+	if s.cipherSuites != nil {
+		tlsConfig.CipherSuites = s.cipherSuites
+	}
+	if s.clientAuth != nil {
+		setClientAuth(tlsConfig, *s.clientAuth)
+	}
+	return tlsConfig
+}
+
+// TLSConfig waits until SPIRE is ready and returns a TLS config for the
+// server's SVID and authorizer, e.g. to serve a protocol other than HTTP. Its
+// NextProtos are not set.
+func (s *Server) TLSConfig() (*tls.Config, error) {
+	if err := s.waitReady(context.Background()); err != nil {
+		return nil, err
+	}
+	return s.newTLSConfig(), nil
+}
+
+// Listener waits until SPIRE is ready and returns a listener that accepts TLS
+// connections from inner using TLSConfig.
+func (s *Server) Listener(inner net.Listener) (net.Listener, error) {
+	tlsConfig, err := s.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(inner, tlsConfig), nil
+}
+
+// setClientAuth sets the client authentication of tlsConfig, which is built
+// by tlsconfig.MTLSServerConfig and requires a client SVID. Any certificate
+// that is presented is verified against the SPIRE bundles and authorized,
+// rather than using ClientCAs.
+func setClientAuth(tlsConfig *tls.Config, clientAuth tls.ClientAuthType) {
+	switch clientAuth {
+	case tls.RequireAnyClientCert, tls.RequireAndVerifyClientCert:
+		// A client SVID is already required and verified.
+		return
+	case tls.RequestClientCert, tls.VerifyClientCertIfGiven:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	default:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	}
+
+	// Allow clients that do not present a certificate.
+	verify := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		return verify(rawCerts, verifiedChains)
+	}
+}
+
+// getServingHttp returns the internal HTTP server, or an error if it cannot be
+// used to serve. The metrics listener is started, if configured.
+func (s *Server) getServingHttp() (*http.Server, error) {
+	srv := s.getHttp()
+	s.httpMu.Lock()
+	http2Err := s.http2Err
+	s.httpMu.Unlock()
+	if http2Err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP/2: %w", http2Err)
+	}
+	if err := s.startMetrics(); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// waitReady waits until SPIRE is ready or ctx is done, for at most the startup
+// timeout if one is set.
+func (s *Server) waitReady(ctx context.Context) error {
+	s.EnsureSPIRE()
+
+	if s.startupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.startupTimeout)
+		defer cancel()
+	}
+
+	err := s.WaitReadyContext(ctx)
+	if err != nil && s.startupTimeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("server startup timed out after %s: %w", s.startupTimeout, err)
+	}
+	return err
+}
+
 func (w *Server) Close() error {
-	return w.getHttp().Close()
+	return errors.Join(w.getHttp().Close(), w.closeMetrics())
 }
 
 func (w *Server) ListenAndServe() error {
@@ -84,15 +253,67 @@ func (w *Server) ListenAndServe() error {
 }
 
 func (w *Server) ListenAndServeTLS(_, _ string) error {
-	w.EnsureSPIRE()
-	w.WaitReady()
-	return w.getHttp().ListenAndServeTLS("", "") // certs and keys verridden by SPIRE
+	if err := w.waitReady(context.Background()); err != nil {
+		return err
+	}
+	srv, err := w.getServingHttp()
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServeTLS("", "") // certs and keys verridden by SPIRE
+}
+
+// ListenAndServeWithGracefulShutdown starts the server and blocks until ctx is
+// done or SIGINT/SIGTERM is received. The server is then shut down, waiting at
+// most drainTimeout for in-flight requests to complete.
+func (w *Server) ListenAndServeWithGracefulShutdown(ctx context.Context, drainTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := w.waitReady(ctx); err != nil {
+		return err
+	}
+
+	srv, err := w.getServingHttp()
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServeTLS("", "") // certs and keys verridden by SPIRE
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := w.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
+// RegisterOnShutdown registers f to be called on Shutdown, as
+// http.Server.RegisterOnShutdown. It does not wait for SPIRE: if the server
+// has not been created yet, f is registered once it is.
 func (w *Server) RegisterOnShutdown(f func()) {
-	w.EnsureSPIRE()
-	w.WaitReady()
-	w.getHttp().RegisterOnShutdown(f)
+	w.httpMu.Lock()
+	defer w.httpMu.Unlock()
+
+	if w.http != nil {
+		w.http.RegisterOnShutdown(f)
+		return
+	}
+	w.onShutdown = append(w.onShutdown, f)
 }
 
 func (w *Server) Serve(l net.Listener) error {
@@ -100,9 +321,14 @@ func (w *Server) Serve(l net.Listener) error {
 }
 
 func (w *Server) ServeTLS(l net.Listener, _, _ string) error {
-	w.EnsureSPIRE()
-	w.WaitReady()
-	return w.getHttp().ServeTLS(l, "", "") // certs and keys verridden by SPIRE
+	if err := w.waitReady(context.Background()); err != nil {
+		return err
+	}
+	srv, err := w.getServingHttp()
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(l, "", "") // certs and keys verridden by SPIRE
 }
 
 func (w *Server) SetKeepAlivesEnabled(v bool) {
@@ -110,5 +336,5 @@ func (w *Server) SetKeepAlivesEnabled(v bool) {
 }
 
 func (w *Server) Shutdown(ctx context.Context) error {
-	return w.getHttp().Shutdown(ctx)
+	return errors.Join(w.getHttp().Shutdown(ctx), w.shutdownMetrics(ctx))
 }
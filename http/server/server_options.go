@@ -5,26 +5,230 @@ package cofide_http_server
 
 import (
 	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"time"
 
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
 	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/net/http2"
 )
 
 type ServerOption func(*Server)
 
+// WithSPIREAddress sets the address of the SPIRE agent socket, e.g.
+// unix:///run/spire/sockets/agent.sock. Bare socket paths are treated as unix
+// socket addresses.
 func WithSPIREAddress(addr string) ServerOption {
 	return func(h *Server) {
 		h.SPIREAddr = addr
 	}
 }
 
+// WithSPIREFallbackAddresses sets the addresses of further SPIRE agent
+// sockets, tried in order if the socket set using WithSPIREAddress, or
+// otherwise resolved, is unavailable. Each socket is waited on for up to
+// attemptTimeout before trying the next, or 5 seconds if zero.
+func WithSPIREFallbackAddresses(attemptTimeout time.Duration, addrs ...string) ServerOption {
+	return func(h *Server) {
+		h.FallbackAddrs = addrs
+		h.AttemptTimeout = attemptTimeout
+	}
+}
+
+// WithSPIREBackoff sets the initial and maximum delays of the exponential
+// backoff between retries while waiting for SPIRE. A zero delay keeps its
+// default: the backoff starts at 200ms and is capped at 10s.
+func WithSPIREBackoff(initial, max time.Duration) ServerOption {
+	return func(h *Server) {
+		h.BackoffInitialDelay = initial
+		h.BackoffMaxDelay = max
+	}
+}
+
+// WithSPIREBackoffJitter sets whether the backoff between retries while
+// waiting for SPIRE uses decorrelated jitter, picking each delay at random
+// between the initial delay and three times the previous delay, so that
+// workloads started together do not retry in step. By default the delay
+// doubles after each retry.
+func WithSPIREBackoffJitter(jitter bool) ServerOption {
+	return func(h *Server) {
+		h.BackoffStrategy = backoff.JitterStrategy(jitter)
+	}
+}
+
+// WithSPIRESocketFallbacks sets where to look for the SPIRE agent socket if
+// no address is set using WithSPIREAddress or the SPIFFE_ENDPOINT_SOCKET
+// environment variable: first the environment variables envVars, then the
+// socket paths that exist, before the default unix:///tmp/spire.sock.
+func WithSPIRESocketFallbacks(envVars []string, paths []string) ServerOption {
+	return func(h *Server) {
+		h.SocketEnvVars = envVars
+		h.SocketPaths = paths
+	}
+}
+
 func WithContext(ctx context.Context) ServerOption {
 	return func(h *Server) {
 		h.Ctx = ctx
 	}
 }
 
+// WithSVIDMatch authorizes peers whose SPIFFE ID matches all of the provided
+// MatchFunc. It is shorthand for WithAuthorizer(id.AuthorizeMatch(funcs...)).
 func WithSVIDMatch(funcs ...id.MatchFunc) ServerOption {
+	return WithAuthorizer(id.AuthorizeMatch(funcs...))
+}
+
+// WithAuthorizer sets the authorizer used to verify peer SPIFFE IDs. If
+// combined with WithSVIDMatch, the last applied option wins.
+func WithAuthorizer(authorizer tlsconfig.Authorizer) ServerOption {
 	return func(h *Server) {
-		h.Authorizer = id.AuthorizeMatch(funcs...)
+		h.Authorizer = authorizer
+	}
+}
+
+// WithAuthorizerAudit calls logFn with the outcome of each authorization of a
+// peer SPIFFE ID by the authorizer set using WithAuthorizer or WithSVIDMatch,
+// e.g. to keep an audit log. The decision is not altered. If logFn is nil,
+// each decision is logged using the logger.
+func WithAuthorizerAudit(logFn func(id spiffeid.ID, allowed bool, err error)) ServerOption {
+	return func(s *Server) {
+		s.AuthorizerAudit = logFn
+		if logFn == nil {
+			s.AuthorizerAudit = s.LogAuthorization
+		}
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version accepted by the server, e.g.
+// tls.VersionTLS13. Certificates and trust roots are still supplied by SPIRE.
+func WithMinTLSVersion(version uint16) ServerOption {
+	return func(s *Server) {
+		s.minTLSVersion = version
+	}
+}
+
+// WithCipherSuites restricts the cipher suites accepted by the server for TLS
+// 1.2 and below. TLS 1.3 cipher suites are not configurable. Certificates and
+// trust roots are still supplied by SPIRE.
+func WithCipherSuites(suites []uint16) ServerOption {
+	return func(s *Server) {
+		s.cipherSuites = suites
+	}
+}
+
+// WithHTTP2 configures HTTP/2 on the server using cfg, e.g. to tune
+// MaxConcurrentStreams. HTTP/2 is negotiated via ALPN over the SPIRE-backed
+// mTLS connection.
+func WithHTTP2(cfg *http2.Server) ServerOption {
+	return func(s *Server) {
+		s.http2 = cfg
+	}
+}
+
+// WithClientAuth sets the client authentication policy of the server, which
+// by default requires clients to present an SVID. With
+// tls.VerifyClientCertIfGiven or tls.RequestClientCert, clients may connect
+// anonymously, and handlers can check for an identity using PeerID. A
+// certificate that is presented is always verified against the SPIRE bundles
+// and authorized.
+func WithClientAuth(clientAuth tls.ClientAuthType) ServerOption {
+	return func(s *Server) {
+		s.clientAuth = &clientAuth
+	}
+}
+
+// WithX509Source sets an existing X509Source to use rather than creating one
+// from the SPIRE workload API.
+func WithX509Source(source *workloadapi.X509Source) ServerOption {
+	return func(s *Server) {
+		s.X509Source = source
+	}
+}
+
+// WithBundleSource sets an existing BundleSource to use rather than creating
+// one from the SPIRE workload API.
+func WithBundleSource(source *workloadapi.BundleSource) ServerOption {
+	return func(s *Server) {
+		s.BundleSource = source
+	}
+}
+
+// WithMetrics sets a recorder for SPIRE metrics, e.g. to export them to Prometheus.
+// By default metrics are not recorded.
+func WithMetrics(recorder metrics.Recorder) ServerOption {
+	return func(s *Server) {
+		s.Metrics = recorder
+	}
+}
+
+// WithSVIDExpiryWarning logs a warning when the remaining validity of the
+// workload's X509-SVID drops below threshold without it having been rotated,
+// e.g. because the SPIRE agent is stuck. Callbacks for the warning can be
+// registered using OnSVIDExpiring. By default there is no warning.
+func WithSVIDExpiryWarning(threshold time.Duration) ServerOption {
+	return func(s *Server) {
+		s.SVIDExpiryThreshold = threshold
+	}
+}
+
+// WithLogger sets the logger for SPIRE bootstrap and SVID rotation. By default
+// slog.Default() is used.
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		if logger != nil {
+			s.Logger = logger
+		}
+	}
+}
+
+// WithStartupTimeout bounds how long ListenAndServe, ListenAndServeTLS,
+// ListenAndServeWithGracefulShutdown, Serve and ServeTLS wait for SPIRE to be
+// ready, after which they return an error rather than blocking. By default
+// they wait indefinitely.
+func WithStartupTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.startupTimeout = timeout
+	}
+}
+
+// WithMaxConnectionAge closes connections once they are older than maxAge,
+// forcing clients to reconnect and re-handshake with the server's current SVID.
+// This bounds how long an identity remains in use on a connection after it is
+// rotated. Connections are closed once idle, so a connection with a request
+// in flight, e.g. a long-lived stream, is closed when the request completes.
+// By default connections are never closed due to age.
+func WithMaxConnectionAge(maxAge time.Duration) ServerOption {
+	return func(s *Server) {
+		if maxAge > 0 {
+			s.connAge = newConnAgeTracker(maxAge)
+		}
+	}
+}
+
+// WithMetricsListener serves handler, e.g. a Prometheus handler for a
+// metrics.Recorder, on a separate listener at addr once the server starts
+// serving, so that metrics can be scraped without a workload identity. The
+// listener is plaintext unless WithMetricsAuthorizer is set, so addr should
+// usually be a loopback address, e.g. 127.0.0.1:9090.
+func WithMetricsListener(addr string, handler http.Handler) ServerOption {
+	return func(s *Server) {
+		s.metricsAddr = addr
+		s.metricsHandler = handler
+	}
+}
+
+// WithMetricsAuthorizer protects the listener set using WithMetricsListener
+// with mTLS using the server's SVID, authorizing scrapers using authorizer
+// rather than the server's authorizer.
+func WithMetricsAuthorizer(authorizer tlsconfig.Authorizer) ServerOption {
+	return func(s *Server) {
+		s.metricsAuthorizer = authorizer
 	}
 }
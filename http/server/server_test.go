@@ -0,0 +1,202 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package cofide_http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestServer_WithHTTP2(t *testing.T) {
+	s := NewServer(&http.Server{}, WithHTTP2(&http2.Server{MaxConcurrentStreams: 10}))
+
+	srv, err := s.getServingHttp()
+	require.NoError(t, err)
+	assert.Contains(t, srv.TLSConfig.NextProtos, "h2")
+	assert.Contains(t, srv.TLSNextProto, "h2")
+}
+
+func TestServer_WithClientAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		clientAuth     tls.ClientAuthType
+		wantClientAuth tls.ClientAuthType
+		wantAnonymous  bool
+	}{
+		{
+			name:           "verify if given",
+			clientAuth:     tls.VerifyClientCertIfGiven,
+			wantClientAuth: tls.RequestClientCert,
+			wantAnonymous:  true,
+		},
+		{
+			name:           "no client cert",
+			clientAuth:     tls.NoClientCert,
+			wantClientAuth: tls.NoClientCert,
+			wantAnonymous:  true,
+		},
+		{
+			name:           "require and verify",
+			clientAuth:     tls.RequireAndVerifyClientCert,
+			wantClientAuth: tls.RequireAnyClientCert,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(&http.Server{}, WithClientAuth(tt.clientAuth))
+
+			srv, err := s.getServingHttp()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantClientAuth, srv.TLSConfig.ClientAuth)
+
+			err = srv.TLSConfig.VerifyPeerCertificate(nil, nil)
+			if tt.wantAnonymous {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestServer_Ready(t *testing.T) {
+	s := NewServer(&http.Server{}, WithSPIREAddress("http://localhost:8081"))
+	assert.False(t, s.Ready())
+
+	// SPIRE bootstrap fails immediately for an invalid address.
+	s.EnsureSPIRE()
+	s.WaitReady()
+	assert.False(t, s.Ready())
+}
+
+func TestServer_WithStartupTimeout(t *testing.T) {
+	// No SPIRE agent is listening on this socket.
+	spireAddr := "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+	s := NewServer(&http.Server{Addr: "127.0.0.1:0"}, WithSPIREAddress(spireAddr), WithStartupTimeout(100*time.Millisecond))
+
+	err := s.ListenAndServe()
+	assert.ErrorContains(t, err, "server startup timed out after 100ms")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestServer_TLSConfig_notReady(t *testing.T) {
+	s := NewServer(&http.Server{}, WithSPIREAddress("http://localhost:8081"))
+
+	_, err := s.TLSConfig()
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	_, err = s.Listener(lis)
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+}
+
+func TestServer_WithMetricsListener(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	})
+	s := NewServer(&http.Server{}, WithMetricsListener("127.0.0.1:0", handler))
+
+	// The metrics listener is started once the server starts serving.
+	_, err := s.getServingHttp()
+	require.NoError(t, err)
+	_, err = s.getServingHttp()
+	require.NoError(t, err)
+
+	url := "http://" + s.metricsLn.Addr().String() + "/metrics"
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "metrics", string(body))
+
+	// Closing the server closes the metrics listener.
+	require.NoError(t, s.Close())
+	_, err = http.Get(url)
+	assert.Error(t, err)
+}
+
+func TestServer_WithMetricsListener_listenError(t *testing.T) {
+	s := NewServer(&http.Server{}, WithMetricsListener("invalid:address:0", http.NotFoundHandler()))
+
+	_, err := s.getServingHttp()
+	assert.ErrorContains(t, err, "failed to listen for metrics")
+}
+
+func TestServer_Drain(t *testing.T) {
+	s := NewServer(&http.Server{})
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		s.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	// The server is not ready until SPIRE is ready.
+	assert.Equal(t, http.StatusServiceUnavailable, probe())
+
+	assert.False(t, s.Draining())
+	s.Drain()
+	assert.True(t, s.Draining())
+	assert.Equal(t, http.StatusServiceUnavailable, probe())
+
+	// Draining before SPIRE is ready does not create the http.Server, whose
+	// TLS config would be built without the SPIRE sources.
+	assert.Nil(t, s.http)
+}
+
+func TestServer_Drain_concurrent(t *testing.T) {
+	s := NewServer(&http.Server{})
+
+	// Serving creates the http.Server once SPIRE is ready, which may happen
+	// while the server is drained, e.g. during a deploy.
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		_, err := s.getServingHttp()
+		assert.NoError(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		s.Drain()
+	}()
+	go func() {
+		defer wg.Done()
+		s.RegisterOnShutdown(func() {})
+	}()
+	wg.Wait()
+
+	assert.True(t, s.Draining())
+}
+
+func TestServer_RegisterOnShutdown(t *testing.T) {
+	s := NewServer(&http.Server{})
+
+	// Registering before SPIRE is ready does not create the http.Server.
+	called := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(called) })
+	assert.Nil(t, s.http)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown function not called")
+	}
+}
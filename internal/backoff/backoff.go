@@ -4,16 +4,43 @@
 package backoff
 
 import (
+	"math/rand/v2"
 	"sync"
 	"time"
 )
 
-// Backoff is a simple exponential backoff implementation.
+// Strategy determines how the delays of a Backoff grow.
+type Strategy int
+
+const (
+	// StrategyExponential doubles the delay after each attempt.
+	StrategyExponential Strategy = iota
+	// StrategyDecorrelatedJitter picks each delay at random between the
+	// initial delay and three times the previous delay, so that clients that
+	// start retrying together do not stay synchronised.
+	StrategyDecorrelatedJitter
+)
+
+// JitterStrategy returns StrategyDecorrelatedJitter if jitter is set, and
+// otherwise StrategyExponential.
+func JitterStrategy(jitter bool) Strategy {
+	if jitter {
+		return StrategyDecorrelatedJitter
+	}
+	return StrategyExponential
+}
+
+// Backoff is a simple exponential backoff implementation. It is safe for
+// concurrent use.
 type Backoff struct {
 	InitialDelay time.Duration
 	MaxDelay     time.Duration
 	n            int
 
+	strategy Strategy
+	// prev is the previous delay, used by StrategyDecorrelatedJitter.
+	prev time.Duration
+
 	mutex sync.Mutex
 }
 
@@ -31,6 +58,27 @@ func WithMaxDelay(d time.Duration) BackoffOption {
 	}
 }
 
+// WithStrategy sets the strategy of the backoff. By default the delay doubles
+// after each attempt.
+func WithStrategy(strategy Strategy) BackoffOption {
+	return func(b *Backoff) {
+		b.strategy = strategy
+	}
+}
+
+// WithDelays sets the initial and maximum delays, keeping the default for
+// either that is zero.
+func WithDelays(initial, max time.Duration) BackoffOption {
+	return func(b *Backoff) {
+		if initial > 0 {
+			b.InitialDelay = initial
+		}
+		if max > 0 {
+			b.MaxDelay = max
+		}
+	}
+}
+
 func NewBackoff(opts ...BackoffOption) *Backoff {
 	b := &Backoff{
 		InitialDelay: time.Millisecond * 200,
@@ -45,14 +93,20 @@ func NewBackoff(opts ...BackoffOption) *Backoff {
 	return b
 }
 
-// Duration returns the next wait period for the backoff. Not goroutine-safe.
+// Duration returns the next wait period for the backoff. It is safe to call
+// concurrently with Duration and Reset.
 func (b *Backoff) Duration() time.Duration {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	if b.strategy == StrategyDecorrelatedJitter {
+		return b.decorrelatedJitter()
+	}
+
 	d := b.InitialDelay << b.n
-	// Check for overflow (d becomes non-positive) or if it exceeds MaxDelay.
-	if d < 0 || d > b.MaxDelay {
+	// Check for overflow (bits are shifted out, or d becomes negative) or if
+	// it exceeds MaxDelay.
+	if d>>b.n != b.InitialDelay || d < 0 || d > b.MaxDelay {
 		d = b.MaxDelay
 	}
 
@@ -60,7 +114,31 @@ func (b *Backoff) Duration() time.Duration {
 	return time.Duration(d)
 }
 
+// decorrelatedJitter returns a delay between the initial delay and three times
+// the previous delay, capped at the max delay. b.mutex must be held.
+func (b *Backoff) decorrelatedJitter() time.Duration {
+	prev := max(b.prev, b.InitialDelay)
+	upper := prev * 3
+	// Check for overflow (upper becomes non-positive) or if it exceeds MaxDelay.
+	if upper/3 != prev || upper > b.MaxDelay {
+		upper = b.MaxDelay
+	}
+
+	d := b.InitialDelay
+	if upper > d {
+		d += rand.N(upper - d + 1)
+	}
+	d = min(d, b.MaxDelay)
+
+	b.prev = d
+	return d
+}
+
 // Reset resets the backoff's state.
 func (b *Backoff) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	b.n = 0
+	b.prev = 0
 }
@@ -5,6 +5,7 @@ package backoff
 
 import (
 	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -46,3 +47,75 @@ func TestBackoff_overflow(t *testing.T) {
 	assert.Equal(t, time.Duration(math.MaxInt64-1), backoff.Duration())
 	assert.Equal(t, time.Duration(math.MaxInt64), backoff.Duration())
 }
+
+func TestBackoff_withDelays(t *testing.T) {
+	backoff := NewBackoff(WithDelays(time.Second, 3*time.Second))
+	assert.Equal(t, time.Second, backoff.Duration())
+	assert.Equal(t, 2*time.Second, backoff.Duration())
+	assert.Equal(t, 3*time.Second, backoff.Duration())
+
+	// Zero delays keep the defaults.
+	backoff = NewBackoff(WithDelays(0, 0))
+	assert.Equal(t, 200*time.Millisecond, backoff.InitialDelay)
+	assert.Equal(t, 10*time.Second, backoff.MaxDelay)
+}
+
+func TestBackoff_decorrelatedJitter(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, 2*time.Second
+	backoff := NewBackoff(WithInitialDelay(base), WithMaxDelay(maxDelay), WithStrategy(StrategyDecorrelatedJitter))
+
+	var reachedMax bool
+	for range 1000 {
+		prev := max(backoff.prev, base)
+		d := backoff.Duration()
+		assert.GreaterOrEqual(t, d, base)
+		assert.LessOrEqual(t, d, maxDelay)
+		assert.LessOrEqual(t, d, 3*prev)
+		if d > maxDelay/2 {
+			reachedMax = true
+		}
+	}
+	// The delays grow towards the max delay.
+	assert.True(t, reachedMax)
+
+	backoff.Reset()
+	assert.LessOrEqual(t, backoff.Duration(), 3*base)
+}
+
+func TestBackoff_decorrelatedJitter_overflow(t *testing.T) {
+	backoff := NewBackoff(WithInitialDelay(math.MaxInt64/2), WithMaxDelay(math.MaxInt64), WithStrategy(StrategyDecorrelatedJitter))
+	for range 10 {
+		assert.GreaterOrEqual(t, backoff.Duration(), time.Duration(math.MaxInt64/2))
+	}
+}
+
+func TestBackoff_concurrent(t *testing.T) {
+	// Run with -race to detect unsynchronised access to the backoff's state.
+	backoff := NewBackoff(WithMaxDelay(time.Second))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 1000 {
+				d := backoff.Duration()
+				assert.GreaterOrEqual(t, d, 200*time.Millisecond)
+				assert.LessOrEqual(t, d, time.Second)
+			}
+		})
+		wg.Go(func() {
+			for range 1000 {
+				backoff.Reset()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestBackoff_manyAttempts(t *testing.T) {
+	backoff := NewBackoff()
+	// The delay stays at the max delay once the shift overflows.
+	for range 100 {
+		backoff.Duration()
+	}
+	assert.Equal(t, 10*time.Second, backoff.Duration())
+}
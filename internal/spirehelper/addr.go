@@ -0,0 +1,64 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spirehelper
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const (
+	defaultSPIRESocketAddr = "unix:///tmp/spire.sock"
+
+	spiffeEndpointSocketEnvVar = "SPIFFE_ENDPOINT_SOCKET"
+)
+
+// DefaultSocketEnvVars are the environment variables checked, in order, for
+// the SPIRE agent socket address after SPIFFE_ENDPOINT_SOCKET.
+var DefaultSocketEnvVars = []string{"SPIRE_AGENT_SOCKET"}
+
+// DefaultSocketPaths are well-known SPIRE agent socket paths, used in order if
+// they exist and no address is set in the environment.
+var DefaultSocketPaths = []string{
+	"/run/spire/sockets/agent.sock",
+	"/run/spire/agent-sockets/spire-agent.sock",
+	"/tmp/spire-agent/public/api.sock",
+}
+
+// resolveAddr returns the SPIRE agent socket address to use when none is set
+// explicitly, along with a description of where it came from. The
+// SPIFFE_ENDPOINT_SOCKET environment variable is checked first, followed by
+// envVars, then paths that exist, before falling back to the default address.
+func resolveAddr(envVars, paths []string) (addr, source string) {
+	for _, envVar := range append([]string{spiffeEndpointSocketEnvVar}, envVars...) {
+		if addr := os.Getenv(envVar); addr != "" {
+			return addr, "environment variable " + envVar
+		}
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path, "path " + path
+		}
+	}
+
+	return defaultSPIRESocketAddr, "default"
+}
+
+// normalizeAddr returns addr as a workload API address, prefixing bare socket
+// paths with the unix scheme. An error is returned if addr is not a valid
+// unix or tcp address.
+func normalizeAddr(addr string) (string, error) {
+	if strings.HasPrefix(addr, "/") {
+		addr = "unix://" + addr
+	}
+
+	if err := workloadapi.ValidateAddress(addr); err != nil {
+		return "", fmt.Errorf("invalid SPIRE agent socket address %q: %w", addr, err)
+	}
+	return addr, nil
+}
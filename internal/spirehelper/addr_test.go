@@ -0,0 +1,123 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spirehelper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveAddr(t *testing.T) {
+	existingPath := filepath.Join(t.TempDir(), "agent.sock")
+	require.NoError(t, os.WriteFile(existingPath, nil, 0o600))
+	missingPath := filepath.Join(t.TempDir(), "missing.sock")
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		envVars    []string
+		paths      []string
+		wantAddr   string
+		wantSource string
+	}{
+		{
+			name:       "SPIFFE_ENDPOINT_SOCKET",
+			env:        map[string]string{"SPIFFE_ENDPOINT_SOCKET": "unix:///spiffe.sock", "TEST_SPIRE_SOCKET": "unix:///fallback.sock"},
+			envVars:    []string{"TEST_SPIRE_SOCKET"},
+			paths:      []string{existingPath},
+			wantAddr:   "unix:///spiffe.sock",
+			wantSource: "environment variable SPIFFE_ENDPOINT_SOCKET",
+		},
+		{
+			name:       "fallback environment variable",
+			env:        map[string]string{"TEST_SPIRE_SOCKET": "unix:///fallback.sock"},
+			envVars:    []string{"TEST_SPIRE_SOCKET"},
+			paths:      []string{existingPath},
+			wantAddr:   "unix:///fallback.sock",
+			wantSource: "environment variable TEST_SPIRE_SOCKET",
+		},
+		{
+			name:       "existing path",
+			envVars:    []string{"TEST_SPIRE_SOCKET"},
+			paths:      []string{missingPath, existingPath},
+			wantAddr:   "unix://" + existingPath,
+			wantSource: "path " + existingPath,
+		},
+		{
+			name:       "default",
+			envVars:    []string{"TEST_SPIRE_SOCKET"},
+			paths:      []string{missingPath},
+			wantAddr:   defaultSPIRESocketAddr,
+			wantSource: "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SPIFFE_ENDPOINT_SOCKET", "")
+			t.Setenv("TEST_SPIRE_SOCKET", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			addr, source := resolveAddr(tt.envVars, tt.paths)
+			assert.Equal(t, tt.wantAddr, addr)
+			assert.Equal(t, tt.wantSource, source)
+		})
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "unix",
+			addr: "unix:///run/spire.sock",
+			want: "unix:///run/spire.sock",
+		},
+		{
+			name: "bare path",
+			addr: "/run/spire.sock",
+			want: "unix:///run/spire.sock",
+		},
+		{
+			name: "tcp",
+			addr: "tcp://127.0.0.1:8081",
+			want: "tcp://127.0.0.1:8081",
+		},
+		{
+			name:    "unsupported scheme",
+			addr:    "http://localhost:8081",
+			wantErr: `invalid SPIRE agent socket address "http://localhost:8081"`,
+		},
+		{
+			name:    "relative path",
+			addr:    "spire.sock",
+			wantErr: `invalid SPIRE agent socket address "spire.sock"`,
+		},
+		{
+			name:    "tcp hostname",
+			addr:    "tcp://localhost:8081",
+			wantErr: "must be an IP:port",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeAddr(tt.addr)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
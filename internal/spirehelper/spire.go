@@ -4,95 +4,532 @@
 package spirehelper
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/cofide/cofide-sdk-go/internal/backoff"
 	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
-const defaultSPIRESocketAddr = "unix:///tmp/spire.sock"
+// defaultAttemptTimeout is how long to wait for each SPIRE agent socket
+// before trying the next, if there are several.
+const defaultAttemptTimeout = 5 * time.Second
 
 type SPIREHelper struct {
 	X509Source   *workloadapi.X509Source
 	BundleSource *workloadapi.BundleSource
-	SPIREAddr    string
 	Ctx          context.Context
 
+	// SPIREAddr is the address of the SPIRE agent socket. NewSPIREHelper sets
+	// it from SPIFFE_ENDPOINT_SOCKET. If empty, it is resolved from
+	// SocketEnvVars and SocketPaths by EnsureSPIRE; see resolveAddr.
+	SPIREAddr string
+	// SocketEnvVars are the fallback environment variables for SPIREAddr.
+	SocketEnvVars []string
+	// SocketPaths are the fallback socket paths for SPIREAddr.
+	SocketPaths []string
+	// FallbackAddrs are the addresses of further SPIRE agent sockets, tried in
+	// order if SPIREAddr is unavailable, e.g. in HA agent deployments.
+	FallbackAddrs []string
+	// AttemptTimeout is how long to wait for each socket before trying the
+	// next when there are FallbackAddrs. It defaults to 5 seconds.
+	AttemptTimeout time.Duration
+
+	// BackoffInitialDelay and BackoffMaxDelay bound the exponential backoff
+	// between SPIRE bootstrap retries. By default the backoff starts at 200ms
+	// and is capped at 10s.
+	BackoffInitialDelay time.Duration
+	BackoffMaxDelay     time.Duration
+	// BackoffStrategy determines how the backoff between SPIRE bootstrap
+	// retries grows. By default the delay doubles after each retry.
+	BackoffStrategy backoff.Strategy
+
 	Authorizer tlsconfig.Authorizer
 
+	// AuthorizerAudit is optionally called with the outcome of each
+	// authorization by Authorizer; see TLSAuthorizer.
+	AuthorizerAudit func(id spiffeid.ID, allowed bool, err error)
+
+	// Metrics is an optional recorder for SPIRE metrics.
+	Metrics metrics.Recorder
+
+	// Logger is the logger for SPIRE bootstrap and SVID updates.
+	Logger *slog.Logger
+
+	// SVIDExpiryThreshold enables a warning, logged and passed to any
+	// callbacks registered using OnSVIDExpiring, when the remaining validity
+	// of the current X509-SVID drops below the threshold without it having
+	// been rotated. This usually indicates a stuck SPIRE agent.
+	SVIDExpiryThreshold time.Duration
+
 	readyCh chan struct{}
 	backoff *backoff.Backoff
+	// cancel cancels Ctx, stopping bootstrap and the watches of the sources.
+	cancel context.CancelFunc
+
+	mu                  sync.Mutex
+	connectedAddr       string
+	bundleUpdated       time.Time
+	lastErr             error
+	readyErr            error
+	svidUpdateCallbacks []func(*x509svid.SVID)
+	svidExpiryCallbacks []func(*x509svid.SVID)
+	watchErrorCallbacks []func(error)
+	// ownedSources are the sources created, rather than provided up front,
+	// which are closed by Close.
+	ownedSources []io.Closer
 }
 
 func NewSPIREHelper(ctx context.Context) *SPIREHelper {
-	spireAddr := defaultSPIRESocketAddr
-	if addr := os.Getenv("SPIFFE_ENDPOINT_SOCKET"); addr != "" {
-		spireAddr = addr
-	}
-
 	return &SPIREHelper{
-		Ctx:        ctx,
-		SPIREAddr:  spireAddr,
-		Authorizer: tlsconfig.AuthorizeAny(),
+		Ctx:           ctx,
+		SPIREAddr:     os.Getenv(spiffeEndpointSocketEnvVar),
+		SocketEnvVars: DefaultSocketEnvVars,
+		SocketPaths:   DefaultSocketPaths,
+		Authorizer:    tlsconfig.AuthorizeAny(),
+		Metrics:       metrics.NoopRecorder{},
+		Logger:        slog.Default(),
 	}
 }
 
 func (s *SPIREHelper) EnsureSPIRE() {
+	// readyCh and readyErr are read concurrently, e.g. by readiness checks,
+	// so are only accessed while holding mu.
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.readyCh != nil {
 		return
 	}
-	if s.readyCh == nil {
-		s.readyCh = make(chan struct{})
-	}
+	readyCh := make(chan struct{})
+	s.readyCh = readyCh
+	s.Ctx, s.cancel = context.WithCancel(s.Ctx)
 	if s.backoff == nil {
-		s.backoff = backoff.NewBackoff()
+		s.backoff = backoff.NewBackoff(
+			backoff.WithDelays(s.BackoffInitialDelay, s.BackoffMaxDelay),
+			backoff.WithStrategy(s.BackoffStrategy),
+		)
+	}
+	if s.Metrics == nil {
+		s.Metrics = metrics.NoopRecorder{}
+	}
+	if s.Logger == nil {
+		s.Logger = slog.Default()
+	}
+	if s.SPIREAddr == "" {
+		var source string
+		s.SPIREAddr, source = resolveAddr(s.SocketEnvVars, s.SocketPaths)
+		s.Logger.Debug("Resolved SPIRE agent socket address", "addr", s.SPIREAddr, "source", source)
 	}
 
+	// An invalid address will never succeed, so fail without retrying.
+	addrs := make([]string, 0, 1+len(s.FallbackAddrs))
+	for _, addr := range append([]string{s.SPIREAddr}, s.FallbackAddrs...) {
+		addr, err := normalizeAddr(addr)
+		if err != nil {
+			s.readyErr = err
+			close(readyCh)
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+	s.SPIREAddr = addrs[0]
+
 	go func() {
-		for {
-			var err error
+		svid, err := s.bootstrap(addrs)
+		if err != nil {
+			s.mu.Lock()
+			s.readyErr = err
+			s.mu.Unlock()
 
-			s.X509Source, err = workloadapi.NewX509Source(s.Ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(s.SPIREAddr)))
-			if err != nil {
-				time.Sleep(s.backoff.Duration())
-				continue
+			close(readyCh)
+			return
+		}
+
+		close(readyCh)
+
+		go s.watchBundleUpdates()
+		s.watchSVIDUpdates(svid)
+	}()
+}
+
+// bootstrap creates the SPIRE sources and fetches an X.509 SVID, trying each
+// of addrs in order, and retrying with backoff until successful or the context
+// is done.
+func (s *SPIREHelper) bootstrap(addrs []string) (*x509svid.SVID, error) {
+	start := time.Now()
+	for {
+		var svid *x509svid.SVID
+		var err error
+		for _, addr := range addrs {
+			if err := s.Ctx.Err(); err != nil {
+				return nil, fmt.Errorf("SPIRE bootstrap cancelled: %w", err)
 			}
 
-			// attempt to get an X.509 SVID
-			_, err = s.X509Source.GetX509SVID()
-			if err != nil {
-				time.Sleep(s.backoff.Duration())
-				continue
+			svid, err = s.initSourcesWithTimeout(addr, len(addrs) > 1)
+			if err == nil {
+				s.mu.Lock()
+				s.connectedAddr = addr
+				s.mu.Unlock()
+
+				s.backoff.Reset()
+				s.setLastError(nil)
+				s.Logger.Debug("SPIRE ready", "id", svid.ID.String(), "addr", addr, "elapsed", time.Since(start))
+				s.Metrics.SPIREReady(time.Since(start))
+				return svid, nil
 			}
+			s.setLastError(err)
+			s.Logger.Debug("SPIRE agent socket unavailable", "addr", addr, "error", err)
+		}
+
+		d := s.backoff.Duration()
+		s.Logger.Debug("SPIRE not ready, retrying", "addrs", addrs, "backoff", d, "error", err)
+		s.Metrics.Retry(metrics.ComponentSPIRE, d)
 
-			s.BundleSource, err = workloadapi.NewBundleSource(s.Ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(s.SPIREAddr)))
+		select {
+		case <-s.Ctx.Done():
+			return nil, fmt.Errorf("SPIRE bootstrap cancelled: %w: %w", s.Ctx.Err(), err)
+		case <-time.After(d):
+		}
+	}
+}
+
+// initSourcesWithTimeout calls initSources for addr, bounded by the attempt
+// timeout if timeout is true.
+func (s *SPIREHelper) initSourcesWithTimeout(addr string, timeout bool) (*x509svid.SVID, error) {
+	ctx := s.Ctx
+	if timeout {
+		attemptTimeout := s.AttemptTimeout
+		if attemptTimeout <= 0 {
+			attemptTimeout = defaultAttemptTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, attemptTimeout)
+		defer cancel()
+	}
+	return s.initSources(ctx, addr)
+}
+
+// initSources creates any SPIRE sources that were not provided up front using
+// the agent socket at addr, and attempts to get an X.509 SVID. Sources created
+// by a failed attempt are closed, so that both sources use the same socket.
+func (s *SPIREHelper) initSources(ctx context.Context, addr string) (_ *x509svid.SVID, err error) {
+	var created []io.Closer
+	if s.X509Source == nil {
+		s.Logger.Debug("Creating X509Source", "addr", addr)
+		x509Source, sourceErr := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(
+			workloadapi.WithAddr(addr),
+			workloadapi.WithLogger(watchErrorLogger{s: s}),
+		))
+		if sourceErr != nil {
+			return nil, fmt.Errorf("failed to create X509Source: %w", sourceErr)
+		}
+		s.X509Source = x509Source
+		created = append(created, x509Source)
+		defer func() {
 			if err != nil {
-				time.Sleep(s.backoff.Duration())
-				continue
+				_ = x509Source.Close()
+				s.X509Source = nil
 			}
+		}()
+	}
 
-			s.backoff.Reset()
+	svid, err := s.X509Source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get X509-SVID: %w", err)
+	}
 
-			break
+	if s.BundleSource == nil {
+		s.Logger.Debug("Creating BundleSource", "addr", addr)
+		bundleSource, err := workloadapi.NewBundleSource(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create BundleSource: %w", err)
 		}
+		s.BundleSource = bundleSource
+		created = append(created, bundleSource)
+		// The BundleSource is created once the first bundle is received.
+		s.bundleUpdatedAt(time.Now())
+	}
+
+	s.mu.Lock()
+	s.ownedSources = append(s.ownedSources, created...)
+	s.mu.Unlock()
+
+	return svid, nil
+}
+
+// Close stops SPIRE bootstrap and the watches of the sources, and closes the
+// sources that were created from the SPIRE workload API. Sources provided up
+// front are owned by the caller, and are not closed.
+func (s *SPIREHelper) Close() error {
+	s.mu.Lock()
+	cancel := s.cancel
+	sources := s.ownedSources
+	s.ownedSources = nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
 
-		close(s.readyCh)
+	errs := make([]error, 0, len(sources))
+	for _, source := range sources {
+		errs = append(errs, source.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// TLSAuthorizer returns the authorizer to use in TLS configs, which is
+// Authorizer, audited using AuthorizerAudit if it is set.
+func (s *SPIREHelper) TLSAuthorizer() tlsconfig.Authorizer {
+	if s.AuthorizerAudit == nil {
+		return s.Authorizer
+	}
+	return id.AuthorizeWithAudit(s.Authorizer, s.AuthorizerAudit)
+}
+
+// LogAuthorization logs the outcome of an authorization, for use as the
+// default AuthorizerAudit.
+func (s *SPIREHelper) LogAuthorization(peerID spiffeid.ID, allowed bool, err error) {
+	if allowed {
+		s.Logger.Info("Peer authorized", "id", peerID.String())
+		return
+	}
+	s.Logger.Warn("Peer not authorized", "id", peerID.String(), "error", err)
+}
+
+// ConnectedAddr returns the address of the SPIRE agent socket that the sources
+// were created from, or an empty string if SPIRE is not ready.
+func (s *SPIREHelper) ConnectedAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connectedAddr
+}
+
+// BundleLastUpdated returns when the trust bundle was last updated, and false
+// if no update has been observed yet, e.g. because SPIRE is not ready. A
+// bundle that has not been updated recently may indicate a stuck SPIRE agent,
+// even while the X509Source appears healthy.
+func (s *SPIREHelper) BundleLastUpdated() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bundleUpdated, !s.bundleUpdated.IsZero()
+}
+
+// bundleUpdatedAt records that the trust bundle was updated at the given
+// time, passing it to the metrics recorder if it is a BundleRecorder.
+func (s *SPIREHelper) bundleUpdatedAt(at time.Time) {
+	s.mu.Lock()
+	s.bundleUpdated = at
+	s.mu.Unlock()
+
+	if recorder, ok := s.Metrics.(metrics.BundleRecorder); ok {
+		recorder.BundleUpdated(at)
+	}
+}
+
+// watchBundleUpdates records updates of the trust bundle until the context is
+// done.
+func (s *SPIREHelper) watchBundleUpdates() {
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-s.BundleSource.Updated():
+			s.bundleUpdatedAt(time.Now())
+		}
+	}
+}
+
+// OnSVIDUpdate registers a callback that is invoked whenever the X509Source
+// observes a new SVID, e.g. after rotation. Callbacks are invoked sequentially
+// from a single goroutine and should not block.
+func (s *SPIREHelper) OnSVIDUpdate(f func(*x509svid.SVID)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.svidUpdateCallbacks = append(s.svidUpdateCallbacks, f)
+}
+
+// OnSVIDExpiring registers a callback that is invoked when the remaining
+// validity of the current X509-SVID drops below SVIDExpiryThreshold without it
+// having been rotated.
+func (s *SPIREHelper) OnSVIDExpiring(f func(*x509svid.SVID)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.svidExpiryCallbacks = append(s.svidExpiryCallbacks, f)
+}
+
+// watchSVIDUpdates invokes the registered SVID update callbacks whenever the
+// X509Source observes an SVID that differs from current, and warns if current
+// is about to expire. It returns when the context is done.
+func (s *SPIREHelper) watchSVIDUpdates(current *x509svid.SVID) {
+	var expiryTimer *time.Timer
+	var expiring <-chan time.Time
+	watchExpiry := func() {
+		if expiryTimer != nil {
+			expiryTimer.Stop()
+		}
+		expiryTimer, expiring = nil, nil
+		if d, ok := expiryWarningDelay(current, s.SVIDExpiryThreshold, time.Now()); ok {
+			expiryTimer = time.NewTimer(d)
+			expiring = expiryTimer.C
+		}
+	}
+	watchExpiry()
+	defer func() {
+		if expiryTimer != nil {
+			expiryTimer.Stop()
+		}
 	}()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-expiring:
+			expiring = nil
+			s.svidExpiring(current)
+			continue
+		case <-s.X509Source.Updated():
+		}
+
+		svid, err := s.X509Source.GetX509SVID()
+		if err != nil {
+			s.Logger.Debug("Failed to get updated X509-SVID", "error", err)
+			continue
+		}
+		if sameSVID(current, svid) {
+			continue
+		}
+		current = svid
+		s.Logger.Debug("X509-SVID updated", "id", svid.ID.String())
+		watchExpiry()
+
+		s.mu.Lock()
+		callbacks := append([]func(*x509svid.SVID){}, s.svidUpdateCallbacks...)
+		s.mu.Unlock()
+
+		for _, f := range callbacks {
+			f(svid)
+		}
+	}
 }
 
+// svidExpiring warns that svid is about to expire without having been rotated.
+func (s *SPIREHelper) svidExpiring(svid *x509svid.SVID) {
+	expiry := svid.Certificates[0].NotAfter
+	s.Logger.Warn("X509-SVID expires soon and has not been rotated", "id", svid.ID.String(), "expiry", expiry, "remaining", time.Until(expiry))
+
+	s.mu.Lock()
+	callbacks := append([]func(*x509svid.SVID){}, s.svidExpiryCallbacks...)
+	s.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(svid)
+	}
+}
+
+// expiryWarningDelay returns how long after now to warn that svid is about to
+// expire, given the expiry threshold. It returns false if the threshold is not
+// set.
+func expiryWarningDelay(svid *x509svid.SVID, threshold time.Duration, now time.Time) (time.Duration, bool) {
+	if threshold <= 0 || svid == nil || len(svid.Certificates) == 0 {
+		return 0, false
+	}
+	return max(svid.Certificates[0].NotAfter.Add(-threshold).Sub(now), 0), true
+}
+
+// sameSVID returns whether two SVIDs have the same leaf certificate.
+func sameSVID(a, b *x509svid.SVID) bool {
+	if a == nil || b == nil || len(a.Certificates) == 0 || len(b.Certificates) == 0 {
+		return a == b
+	}
+	return bytes.Equal(a.Certificates[0].Raw, b.Certificates[0].Raw)
+}
+
+// WaitReady waits until SPIRE is ready, or SPIRE bootstrap has been abandoned
+// because the helper's context is done. Use WaitReadyContext to distinguish
+// the two.
 func (s *SPIREHelper) WaitReady() {
 	// wait till readyCh is closed
-	<-s.readyCh
+	<-s.ready()
+}
+
+// WaitReadyContext waits until SPIRE is ready or ctx is done, whichever comes
+// first. If ctx is done first, the returned error wraps both the context error
+// and the most recent SPIRE bootstrap failure, if any. If SPIRE bootstrap was
+// abandoned because the helper's context is done, an error is returned.
+func (s *SPIREHelper) WaitReadyContext(ctx context.Context) error {
+	select {
+	case <-s.ready():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.readyErr
+	case <-ctx.Done():
+		if err := s.lastError(); err != nil {
+			return fmt.Errorf("SPIRE not ready: %w: %w", ctx.Err(), err)
+		}
+		return fmt.Errorf("SPIRE not ready: %w", ctx.Err())
+	}
+}
+
+// Ready reports whether SPIRE is ready, without blocking, e.g. for use in
+// readiness checks. It returns false until SPIRE bootstrap has succeeded, and
+// if SPIRE bootstrap has failed or has not been started with EnsureSPIRE.
+func (s *SPIREHelper) Ready() bool {
+	readyCh := s.ready()
+	if readyCh == nil {
+		return false
+	}
+
+	select {
+	case <-readyCh:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.readyErr == nil
+	default:
+		return false
+	}
+}
+
+// ready returns the channel that is closed once SPIRE bootstrap has finished,
+// or nil if it has not been started with EnsureSPIRE.
+func (s *SPIREHelper) ready() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyCh
+}
+
+func (s *SPIREHelper) setLastError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+}
+
+func (s *SPIREHelper) lastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
 }
 
 func (s *SPIREHelper) GetIdentity() (*id.SPIFFEID, error) {
 	s.EnsureSPIRE()
-	s.WaitReady()
+	if err := s.WaitReadyContext(context.Background()); err != nil {
+		return nil, err
+	}
 
 	// Get the SPIFFE ID from the X509Source
 	svid, err := s.X509Source.GetX509SVID()
@@ -104,3 +541,68 @@ func (s *SPIREHelper) GetIdentity() (*id.SPIFFEID, error) {
 
 	return id.FromSpiffeID(spiffeID), nil
 }
+
+// CurrentCertificate returns the leaf certificate of the current X509-SVID,
+// blocking until SPIRE is ready, e.g. to read SANs other than the SPIFFE ID.
+func (s *SPIREHelper) CurrentCertificate() (*x509.Certificate, error) {
+	s.EnsureSPIRE()
+	if err := s.WaitReadyContext(context.Background()); err != nil {
+		return nil, err
+	}
+
+	svid, err := s.X509Source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get X509-SVID: %w", err)
+	}
+	if len(svid.Certificates) == 0 {
+		return nil, fmt.Errorf("X509-SVID has no certificates")
+	}
+
+	return svid.Certificates[0], nil
+}
+
+// TrustBundle returns the X.509 authorities in the trust bundle for the trust
+// domain td, blocking until SPIRE is ready.
+func (s *SPIREHelper) TrustBundle(td string) ([]*x509.Certificate, error) {
+	bundle, err := s.x509Bundle(td)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle.X509Authorities(), nil
+}
+
+// TrustBundlePEM returns the X.509 authorities in the trust bundle for the
+// trust domain td as PEM-encoded certificates, blocking until SPIRE is ready.
+func (s *SPIREHelper) TrustBundlePEM(td string) ([]byte, error) {
+	bundle, err := s.x509Bundle(td)
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes, err := bundle.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal X.509 bundle: %w", err)
+	}
+
+	return pemBytes, nil
+}
+
+func (s *SPIREHelper) x509Bundle(td string) (*x509bundle.Bundle, error) {
+	trustDomain, err := spiffeid.TrustDomainFromString(td)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trust domain: %w", err)
+	}
+
+	s.EnsureSPIRE()
+	if err := s.WaitReadyContext(context.Background()); err != nil {
+		return nil, err
+	}
+
+	bundle, err := s.BundleSource.GetX509BundleForTrustDomain(trustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get X.509 bundle: %w", err)
+	}
+
+	return bundle, nil
+}
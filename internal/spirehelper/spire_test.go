@@ -0,0 +1,281 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spirehelper
+
+import (
+	"context"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSPIREHelper_EnsureSPIRE_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := NewSPIREHelper(ctx)
+	// No SPIRE agent is listening on this socket.
+	s.SPIREAddr = "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+	assert.False(t, s.Ready())
+	s.EnsureSPIRE()
+	assert.False(t, s.Ready())
+
+	cancel()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+
+	// WaitReadyContext should unblock with the cancellation error rather than the wait timeout.
+	err := s.WaitReadyContext(waitCtx)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, s.Ready())
+}
+
+func TestSPIREHelper_EnsureSPIRE_backoffStrategy(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.SPIREAddr = "http://localhost:8081"
+	s.BackoffStrategy = backoff.StrategyDecorrelatedJitter
+	s.EnsureSPIRE()
+
+	assert.Equal(t, backoff.NewBackoff(backoff.WithStrategy(backoff.StrategyDecorrelatedJitter)), s.backoff)
+}
+
+func TestNewSPIREHelper_addrFromEnv(t *testing.T) {
+	t.Setenv("SPIFFE_ENDPOINT_SOCKET", "unix:///run/test/agent.sock")
+
+	s := NewSPIREHelper(context.Background())
+	assert.Equal(t, "unix:///run/test/agent.sock", s.SPIREAddr)
+}
+
+func TestSPIREHelper_EnsureSPIRE_invalidAddr(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.SPIREAddr = "http://localhost:8081"
+	s.EnsureSPIRE()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+
+	// The error is returned without retrying until the wait times out.
+	err := s.WaitReadyContext(waitCtx)
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+	assert.NotErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, s.Ready())
+}
+
+func TestSPIREHelper_Ready_concurrentEnsureSPIRE(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.SPIREAddr = "http://localhost:8081"
+
+	// Readiness may be checked while SPIRE bootstrap is started, e.g. by a
+	// readiness handler.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.EnsureSPIRE()
+		}()
+		go func() {
+			defer wg.Done()
+			_ = s.Ready()
+		}()
+	}
+	wg.Wait()
+
+	s.WaitReady()
+	assert.False(t, s.Ready())
+}
+
+func TestSPIREHelper_EnsureSPIRE_fallbackAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewSPIREHelper(ctx)
+	// No SPIRE agent is listening on these sockets.
+	s.SPIREAddr = "unix://" + filepath.Join(t.TempDir(), "primary.sock")
+	s.FallbackAddrs = []string{filepath.Join(t.TempDir(), "secondary.sock")}
+	s.AttemptTimeout = 50 * time.Millisecond
+	s.EnsureSPIRE()
+
+	// Each attempt times out, so that the next socket is tried.
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.ErrorIs(collect, s.lastError(), context.DeadlineExceeded)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, s.Ready())
+	assert.Empty(t, s.ConnectedAddr())
+}
+
+func TestSPIREHelper_EnsureSPIRE_invalidFallbackAddr(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.SPIREAddr = "unix://" + filepath.Join(t.TempDir(), "spire.sock")
+	s.FallbackAddrs = []string{"http://localhost:8081"}
+	s.EnsureSPIRE()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+
+	err := s.WaitReadyContext(waitCtx)
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+}
+
+func TestSPIREHelper_CurrentCertificate_notReady(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.SPIREAddr = "http://localhost:8081"
+
+	_, err := s.CurrentCertificate()
+	assert.ErrorContains(t, err, "invalid SPIRE agent socket address")
+}
+
+func TestSPIREHelper_Ready(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	assert.False(t, s.Ready())
+
+	s.readyCh = make(chan struct{})
+	assert.False(t, s.Ready())
+
+	close(s.readyCh)
+	assert.True(t, s.Ready())
+}
+
+func TestExpiryWarningDelay(t *testing.T) {
+	now := time.Now()
+	svid := &x509svid.SVID{Certificates: []*x509.Certificate{{NotAfter: now.Add(time.Hour)}}}
+
+	tests := []struct {
+		name      string
+		svid      *x509svid.SVID
+		threshold time.Duration
+		wantDelay time.Duration
+		wantOK    bool
+	}{
+		{
+			name:      "no threshold",
+			svid:      svid,
+			threshold: 0,
+			wantOK:    false,
+		},
+		{
+			name:      "before threshold",
+			svid:      svid,
+			threshold: 10 * time.Minute,
+			wantDelay: 50 * time.Minute,
+			wantOK:    true,
+		},
+		{
+			name:      "within threshold",
+			svid:      svid,
+			threshold: 2 * time.Hour,
+			wantDelay: 0,
+			wantOK:    true,
+		},
+		{
+			name:      "no SVID",
+			threshold: 10 * time.Minute,
+			wantOK:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := expiryWarningDelay(tt.svid, tt.threshold, now)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantDelay, delay)
+		})
+	}
+}
+
+func TestSPIREHelper_OnSVIDExpiring(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	svid := &x509svid.SVID{
+		ID:           spiffeid.RequireFromString("spiffe://example.org/workload"),
+		Certificates: []*x509.Certificate{{NotAfter: time.Now().Add(time.Minute)}},
+	}
+
+	var got *x509svid.SVID
+	s.OnSVIDExpiring(func(svid *x509svid.SVID) {
+		got = svid
+	})
+
+	s.svidExpiring(svid)
+	assert.Equal(t, svid, got)
+}
+
+// bundleRecorder is a metrics.Recorder that records trust bundle updates.
+type bundleRecorder struct {
+	metrics.NoopRecorder
+	updated []time.Time
+}
+
+func (r *bundleRecorder) BundleUpdated(at time.Time) {
+	r.updated = append(r.updated, at)
+}
+
+func TestSPIREHelper_BundleLastUpdated(t *testing.T) {
+	recorder := &bundleRecorder{}
+	s := NewSPIREHelper(context.Background())
+	s.Metrics = recorder
+
+	_, ok := s.BundleLastUpdated()
+	assert.False(t, ok)
+
+	at := time.Now()
+	s.bundleUpdatedAt(at)
+
+	got, ok := s.BundleLastUpdated()
+	assert.True(t, ok)
+	assert.Equal(t, at, got)
+	assert.Equal(t, []time.Time{at}, recorder.updated)
+}
+
+func TestSPIREHelper_TLSAuthorizer(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+	s.Authorizer = tlsconfig.AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/allowed"))
+
+	var allowed []bool
+	s.AuthorizerAudit = func(_ spiffeid.ID, ok bool, _ error) {
+		allowed = append(allowed, ok)
+	}
+
+	authorizer := s.TLSAuthorizer()
+	assert.NoError(t, authorizer(spiffeid.RequireFromString("spiffe://example.org/allowed"), nil))
+	assert.Error(t, authorizer(spiffeid.RequireFromString("spiffe://example.org/denied"), nil))
+	assert.Equal(t, []bool{true, false}, allowed)
+}
+
+func TestSPIREHelper_OnWatchError(t *testing.T) {
+	s := NewSPIREHelper(context.Background())
+
+	var got []error
+	s.OnWatchError(func(err error) {
+		got = append(got, err)
+	})
+
+	logger := watchErrorLogger{s: s}
+	cause := status.Error(codes.Unavailable, "connection refused")
+
+	// Errors are not reported until SPIRE is ready.
+	logger.Errorf("Failed to watch the Workload API: %v", cause)
+	assert.Empty(t, got)
+
+	s.connectedAddr = "unix:///tmp/spire.sock"
+	logger.Errorf("Failed to watch the Workload API: %v", cause)
+	require.Len(t, got, 1)
+	assert.Equal(t, cause, got[0])
+
+	// Cancellation of the watch is not reported.
+	logger.Errorf("Failed to watch the Workload API: %v", status.Error(codes.Canceled, "context canceled"))
+	assert.Len(t, got, 1)
+}
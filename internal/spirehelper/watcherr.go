@@ -0,0 +1,73 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spirehelper
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OnWatchError registers a callback that is invoked with the errors of the
+// watch of the SPIRE workload API by an X509Source created by the helper once
+// SPIRE is ready, e.g. when the SPIRE agent restarts or the stream breaks. The
+// source retries its watch, and keeps serving the last SVID and bundles until
+// it recovers. Errors are not reported for an X509Source provided up front.
+// Callbacks are invoked sequentially and should not block.
+func (s *SPIREHelper) OnWatchError(f func(error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchErrorCallbacks = append(s.watchErrorCallbacks, f)
+}
+
+// watchError reports an error of the watch of the workload API.
+func (s *SPIREHelper) watchError(err error) {
+	s.Logger.Warn("SPIRE workload API watch failed", "error", err)
+
+	s.mu.Lock()
+	callbacks := append([]func(error){}, s.watchErrorCallbacks...)
+	s.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(err)
+	}
+}
+
+// watchErrorLogger is the logger of the workload API client of an X509Source
+// created by the helper, which reports the errors of the source's watch once
+// SPIRE is ready. The source does not otherwise expose them, and the client
+// only logs other messages at debug level.
+type watchErrorLogger struct {
+	s *SPIREHelper
+}
+
+func (l watchErrorLogger) Debugf(string, ...any) {}
+func (l watchErrorLogger) Infof(string, ...any)  {}
+func (l watchErrorLogger) Warnf(string, ...any)  {}
+
+func (l watchErrorLogger) Errorf(format string, args ...any) {
+	// Errors during bootstrap are reported by WaitReadyContext, and the watch
+	// is cancelled when the helper is closed.
+	if l.s.ConnectedAddr() == "" || l.s.Ctx.Err() != nil {
+		return
+	}
+
+	// The client logs the error of the watch as an argument, so keep it for
+	// callbacks to inspect, e.g. using status.Code.
+	var err error
+	for _, arg := range args {
+		if argErr, ok := arg.(error); ok {
+			err = argErr
+			break
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf(format, args...)
+	}
+	if status.Code(err) == codes.Canceled {
+		return
+	}
+	l.s.watchError(err)
+}
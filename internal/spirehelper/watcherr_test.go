@@ -0,0 +1,50 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spirehelper_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSPIREHelper_OnWatchError_agentStopped(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/workload")
+
+	s := spirehelper.NewSPIREHelper(context.Background())
+	s.SPIREAddr = api.Addr()
+	t.Cleanup(func() { _ = s.Close() })
+
+	watchErrs := make(chan error, 10)
+	s.OnWatchError(func(err error) {
+		select {
+		case watchErrs <- err:
+		default:
+		}
+	})
+
+	s.EnsureSPIRE()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.WaitReadyContext(ctx))
+
+	// Stopping the agent breaks the watches of the sources.
+	api.Stop()
+
+	select {
+	case err := <-watchErrs:
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	case <-ctx.Done():
+		t.Fatal("watch error not reported")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+)
+
+// Dialer dials addresses whose host is resolved using endpoints discovered via
+// xDS. If no endpoints are known for a host, it falls back to standard dialing.
+type Dialer struct {
+	client  *xds.XDSClient
+	logger  *slog.Logger
+	metrics metrics.Recorder
+
+	// discoveryTimeout is how long to wait for the endpoints of a service to
+	// be discovered before falling back to standard dialing.
+	discoveryTimeout time.Duration
+
+	// baseDialContext dials network addresses, both for endpoints discovered
+	// via xDS and for standard dialing.
+	baseDialContext DialContextFunc
+
+	// selector selects the endpoint of a service to dial.
+	selector Selector
+
+	// weightOverride optionally overrides the weights of endpoints for
+	// selection.
+	weightOverride WeightOverrideFunc
+
+	// inFlight counts the connections, or requests if dialing for a
+	// CofideTransport, in flight to each endpoint.
+	inFlight *inFlightCounts
+}
+
+// WeightOverrideFunc returns the weight of an endpoint of a service to use
+// when selecting an endpoint, or a negative value to use its xDS weight.
+type WeightOverrideFunc func(service string, endpoint xds.Endpoint) int
+
+// DialContextFunc dials a network address.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type DialerOption func(*Dialer)
+
+// WithLogger sets the logger for dialing. By default slog.Default() is used.
+func WithLogger(logger *slog.Logger) DialerOption {
+	return func(d *Dialer) {
+		if logger != nil {
+			d.logger = logger
+		}
+	}
+}
+
+// WithMetrics sets a recorder for dial metrics.
+func WithMetrics(recorder metrics.Recorder) DialerOption {
+	return func(d *Dialer) {
+		if recorder != nil {
+			d.metrics = recorder
+		}
+	}
+}
+
+// WithBaseDialContext sets the function used to dial network addresses, both
+// for endpoints discovered via xDS and for standard dialing. By default a
+// zero net.Dialer is used.
+func WithBaseDialContext(dialContext DialContextFunc) DialerOption {
+	return func(d *Dialer) {
+		if dialContext != nil {
+			d.baseDialContext = dialContext
+		}
+	}
+}
+
+// WithDiscoveryTimeout sets how long to wait for the endpoints of a service to
+// be discovered via xDS when it is first dialed, before falling back to
+// standard dialing. By default the dialer does not wait.
+func WithDiscoveryTimeout(timeout time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.discoveryTimeout = timeout
+	}
+}
+
+// WithWeightOverride sets a function that overrides the weights of endpoints
+// when selecting one, e.g. to send a fixed share of requests to a canary. An
+// endpoint whose weight is overridden to zero is never selected, and if no
+// endpoints remain the host is dialed directly.
+func WithWeightOverride(override WeightOverrideFunc) DialerOption {
+	return func(d *Dialer) {
+		d.weightOverride = override
+	}
+}
+
+func NewDialer(client *xds.XDSClient, opts ...DialerOption) *Dialer {
+	d := &Dialer{
+		client:  client,
+		logger:  slog.Default(),
+		metrics: metrics.NoopRecorder{},
+
+		baseDialContext: (&net.Dialer{}).DialContext,
+		selector:        WeightedSelector{},
+		inFlight:        newInFlightCounts(),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.watchEvictions()
+
+	return d
+}
+
+// watchEvictions drops the state kept by the selector for services whose xDS
+// subscriptions are evicted, if it is an EvictingSelector.
+func (d *Dialer) watchEvictions() {
+	if selector, ok := d.selector.(EvictingSelector); ok && d.client != nil {
+		d.client.OnEvict(selector.Evict)
+	}
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, _, err := d.dialEndpoint(ctx, network, addr)
+	return conn, err
+}
+
+// dialEndpoint dials addr, resolving its host via xDS if possible. The xDS
+// endpoint that was dialed is returned, or nil if addr was dialed directly.
+func (d *Dialer) dialEndpoint(ctx context.Context, network, addr string) (net.Conn, *xds.Endpoint, error) {
+	// Extract host and port
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		d.logger.Debug("Failed to split address", "addr", addr, "error", err)
+		// Fall back to standard dialing
+		conn, err := d.baseDialContext(ctx, network, addr)
+		return conn, nil, err
+	}
+
+	endpoint := d.resolve(ctx, host, nil)
+	if err := ctx.Err(); err != nil {
+		// The dial was cancelled, e.g. while waiting for endpoints.
+		return nil, nil, err
+	}
+	if endpoint == nil {
+		// Fall back to standard dialing
+		conn, err := d.baseDialContext(ctx, network, addr)
+		return conn, nil, err
+	}
+
+	// Dial using resolved endpoint
+	d.logger.Debug("Dialing endpoint discovered via xDS", "endpoint", endpoint)
+	done := d.inFlight.start(*endpoint)
+	conn, err := d.baseDialContext(ctx, network, endpointAddr(*endpoint))
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return &trackedConn{Conn: conn, done: done}, endpoint, nil
+}
+
+// resolve returns the endpoint to dial for host, or nil if host should be
+// dialed directly. req is the request being sent, if any.
+func (d *Dialer) resolve(ctx context.Context, host string, req *http.Request) *xds.Endpoint {
+	// IP addresses, e.g. those already resolved via xDS, are dialed directly.
+	if net.ParseIP(host) != nil {
+		d.metrics.Dial(host, false)
+		return nil
+	}
+
+	// Try to resolve endpoint
+	endpoints, err := d.getEndpoints(ctx, host)
+	if err == nil {
+		endpoints = d.overrideWeights(host, endpoints)
+	}
+	if err != nil || len(endpoints) == 0 {
+		d.logger.Debug("Failed to get endpoints, falling back to standard dialing", "host", host, "endpoints", endpoints, "error", err)
+		d.metrics.Dial(host, false)
+		return nil
+	}
+
+	// Select endpoint
+	endpoint := d.selectEndpoint(endpoints, req)
+	d.logger.Debug("Selected endpoint discovered via xDS", "host", host, "endpoint", endpoint)
+	d.metrics.Dial(host, true)
+	return &endpoint
+}
+
+// selectEndpoint selects one of endpoints using the selector, passing it the
+// in-flight counts if it is a LoadAwareSelector.
+func (d *Dialer) selectEndpoint(endpoints []xds.Endpoint, req *http.Request) xds.Endpoint {
+	if selector, ok := d.selector.(LoadAwareSelector); ok {
+		return selector.SelectWithLoad(endpoints, req, d.inFlight.load)
+	}
+	return d.selector.Select(endpoints, req)
+}
+
+// overrideWeights returns the endpoints of a service with their weights
+// overridden, omitting those whose weight is overridden to zero.
+func (d *Dialer) overrideWeights(service string, endpoints []xds.Endpoint) []xds.Endpoint {
+	if d.weightOverride == nil {
+		return endpoints
+	}
+
+	overridden := make([]xds.Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if weight := d.weightOverride(service, endpoint); weight >= 0 {
+			if weight == 0 {
+				continue
+			}
+			endpoint.Weight = weight
+		}
+		overridden = append(overridden, endpoint)
+	}
+	return overridden
+}
+
+// endpointAddr returns the network address of an endpoint.
+func endpointAddr(endpoint xds.Endpoint) string {
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
+}
+
+// getEndpoints returns the endpoints of a service, waiting up to the discovery
+// timeout for them to be discovered.
+func (d *Dialer) getEndpoints(ctx context.Context, service string) ([]xds.Endpoint, error) {
+	if d.discoveryTimeout <= 0 {
+		return d.client.GetEndpoints(service)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.discoveryTimeout)
+	defer cancel()
+	return d.client.WaitForEndpoints(ctx, service)
+}
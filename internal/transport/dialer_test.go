@@ -0,0 +1,77 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialer_DialContext_cancelledDuringDiscovery(t *testing.T) {
+	// The xDS server is unreachable, so endpoints are never discovered.
+	client, err := xds.NewXDSClient(xds.XDSClientConfig{ServerURI: "passthrough:///127.0.0.1:1"})
+	require.NoError(t, err)
+
+	var dialed bool
+	d := NewDialer(client,
+		WithDiscoveryTimeout(time.Minute),
+		WithBaseDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, ctx.Err()
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", "service:443")
+	assert.Nil(t, conn)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.False(t, dialed)
+}
+
+func TestDialer_overrideWeights(t *testing.T) {
+	stable := xds.Endpoint{Host: "1.2.3.4", Port: 443, Weight: 1}
+	canary := xds.Endpoint{Host: "1.2.3.5", Port: 443, Weight: 1}
+	drained := xds.Endpoint{Host: "1.2.3.6", Port: 443, Weight: 1}
+
+	d := NewDialer(nil, WithWeightOverride(func(service string, e xds.Endpoint) int {
+		switch e {
+		case stable:
+			return 95
+		case canary:
+			return 5
+		case drained:
+			return 0
+		}
+		return -1
+	}))
+
+	other := xds.Endpoint{Host: "5.6.7.8", Port: 443, Weight: 7}
+	endpoints := d.overrideWeights("service", []xds.Endpoint{stable, canary, drained, other})
+	require.Len(t, endpoints, 3)
+	assert.Equal(t, 95, endpoints[0].Weight)
+	assert.Equal(t, 5, endpoints[1].Weight)
+	// A negative override keeps the xDS weight.
+	assert.Equal(t, other, endpoints[2])
+
+	// The overridden weights change the distribution of selected endpoints.
+	const n = 10000
+	counts := make(map[string]int)
+	for range n {
+		endpoint := d.selector.Select(d.overrideWeights("service", []xds.Endpoint{stable, canary, drained}), nil)
+		counts[endpoint.Host]++
+	}
+	assert.InDelta(t, 0.05, float64(counts[canary.Host])/n, 0.02)
+	assert.InDelta(t, 0.95, float64(counts[stable.Host])/n, 0.02)
+	assert.Zero(t, counts[drained.Host])
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+)
+
+// LoadAwareSelector is a Selector that can also take into account the number
+// of requests in flight to each endpoint. CofideTransport and Dialer count the
+// requests and connections in flight, and call SelectWithLoad in place of
+// Select.
+type LoadAwareSelector interface {
+	Selector
+	// SelectWithLoad returns one of endpoints, which is non-empty. inFlight
+	// returns the number of requests in flight to an endpoint.
+	SelectWithLoad(endpoints []xds.Endpoint, req *http.Request, inFlight func(xds.Endpoint) int64) xds.Endpoint
+}
+
+// LeastRequestSelector selects the endpoint with the fewest requests in
+// flight relative to its weight, preferring healthy endpoints. Ties are broken
+// at random. Without in-flight counts, endpoints are selected like
+// WeightedSelector.
+type LeastRequestSelector struct{}
+
+func (LeastRequestSelector) Select(endpoints []xds.Endpoint, req *http.Request) xds.Endpoint {
+	return WeightedSelector{}.Select(endpoints, req)
+}
+
+func (LeastRequestSelector) SelectWithLoad(endpoints []xds.Endpoint, _ *http.Request, inFlight func(xds.Endpoint) int64) xds.Endpoint {
+	endpoints = xds.PreferHealthy(endpoints)
+
+	var (
+		best                 xds.Endpoint
+		bestLoad, bestWeight int64
+		ties                 int
+	)
+	for _, endpoint := range endpoints {
+		// Compare (inFlight+1)/weight without dividing, so that heavier
+		// endpoints are preferred when idle.
+		load := inFlight(endpoint) + 1
+		weight := int64(endpointWeight(endpoint))
+		cmp := load*bestWeight - bestLoad*weight
+		switch {
+		case ties == 0 || cmp < 0:
+			ties = 1
+		case cmp == 0:
+			// Reservoir sampling selects each tied endpoint with equal
+			// probability.
+			ties++
+			if rand.IntN(ties) != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		best, bestLoad, bestWeight = endpoint, load, weight
+	}
+	return best
+}
+
+// inFlightCounts counts the requests, or connections, in flight to each
+// endpoint address. Addresses are forgotten when nothing is in flight.
+type inFlightCounts struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newInFlightCounts() *inFlightCounts {
+	return &inFlightCounts{counts: make(map[string]int64)}
+}
+
+// start counts a request to endpoint as in flight until done is called. done
+// may be called more than once.
+func (c *inFlightCounts) start(endpoint xds.Endpoint) (done func()) {
+	addr := endpointAddr(endpoint)
+	c.mu.Lock()
+	c.counts[addr]++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.counts[addr]--; c.counts[addr] <= 0 {
+				delete(c.counts, addr)
+			}
+		})
+	}
+}
+
+// load returns the number of requests in flight to endpoint.
+func (c *inFlightCounts) load(endpoint xds.Endpoint) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[endpointAddr(endpoint)]
+}
+
+// trackResponse calls done when the body of resp is closed or read to the
+// end, or immediately if the request failed.
+func trackResponse(resp *http.Response, err error, done func()) (*http.Response, error) {
+	// The bodies of protocol upgrades are writable, so are not wrapped.
+	if err != nil || resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		done()
+		return resp, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// trackedBody is a response body that calls done when it is closed or read to
+// the end.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+// trackedConn is a connection that calls done when it is closed.
+type trackedConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.done()
+	return err
+}
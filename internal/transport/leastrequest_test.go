@@ -0,0 +1,157 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeastRequestSelector(t *testing.T) {
+	endpoints := []xds.Endpoint{
+		{Host: "1.2.3.4", Port: 443, Weight: 1},
+		{Host: "1.2.3.5", Port: 443, Weight: 1},
+		{Host: "1.2.3.6", Port: 443, Weight: 2},
+		{Host: "1.2.3.7", Port: 443, Weight: 100, HealthStatus: core.HealthStatus_UNHEALTHY},
+	}
+	inFlight := map[string]int64{
+		"1.2.3.4:443": 2,
+		"1.2.3.5:443": 1,
+		"1.2.3.6:443": 5,
+	}
+	load := func(endpoint xds.Endpoint) int64 { return inFlight[endpointAddr(endpoint)] }
+
+	// (1+1)/1 is less than (2+1)/1 and (5+1)/2, and unhealthy endpoints are
+	// avoided.
+	assert.Equal(t, "1.2.3.5", LeastRequestSelector{}.SelectWithLoad(endpoints, nil, load).Host)
+
+	// Heavier endpoints are preferred when idle.
+	clear(inFlight)
+	assert.Equal(t, "1.2.3.6", LeastRequestSelector{}.SelectWithLoad(endpoints, nil, load).Host)
+
+	// Ties are broken at random.
+	inFlight["1.2.3.6:443"] = 1
+	counts := make(map[string]int)
+	for range 2000 {
+		counts[LeastRequestSelector{}.SelectWithLoad(endpoints, nil, load).Host]++
+	}
+	assert.InDelta(t, 667, counts["1.2.3.4"], 150)
+	assert.InDelta(t, 667, counts["1.2.3.5"], 150)
+	assert.InDelta(t, 667, counts["1.2.3.6"], 150)
+}
+
+func TestInFlightCounts(t *testing.T) {
+	ep := xds.Endpoint{Host: "1.2.3.4", Port: 443}
+	counts := newInFlightCounts()
+
+	done1 := counts.start(ep)
+	done2 := counts.start(ep)
+	assert.EqualValues(t, 2, counts.load(ep))
+
+	// done may be called more than once.
+	done1()
+	done1()
+	assert.EqualValues(t, 1, counts.load(ep))
+
+	done2()
+	assert.EqualValues(t, 0, counts.load(ep))
+	assert.Empty(t, counts.counts)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCofideTransport_roundTripEndpoint_inFlight(t *testing.T) {
+	ep := xds.Endpoint{Host: "1.2.3.4", Port: 443}
+	tr := &CofideTransport{dialer: NewDialer(nil)}
+	req, err := http.NewRequest(http.MethodGet, "https://service/", nil)
+	require.NoError(t, err)
+
+	ok := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+	failed := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("failed")
+	})
+
+	// A request is in flight until its body is closed.
+	resp, err := tr.roundTripEndpoint(ok, req, ep)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, tr.dialer.inFlight.load(ep))
+	require.NoError(t, resp.Body.Close())
+	assert.EqualValues(t, 0, tr.dialer.inFlight.load(ep))
+
+	// Or read to the end.
+	resp, err = tr.roundTripEndpoint(ok, req, ep)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, tr.dialer.inFlight.load(ep))
+	require.NoError(t, resp.Body.Close())
+	assert.EqualValues(t, 0, tr.dialer.inFlight.load(ep))
+
+	// A failed request is not in flight.
+	_, err = tr.roundTripEndpoint(failed, req, ep)
+	require.Error(t, err)
+	assert.EqualValues(t, 0, tr.dialer.inFlight.load(ep))
+}
+
+func TestCofideTransport_roundTripEndpoint_concurrent(t *testing.T) {
+	endpoints := []xds.Endpoint{
+		{Host: "1.2.3.4", Port: 443},
+		{Host: "1.2.3.5", Port: 443},
+	}
+	tr := &CofideTransport{dialer: NewDialer(nil)}
+	req, err := http.NewRequest(http.MethodGet, "https://service/", nil)
+	require.NoError(t, err)
+	rt := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+
+	// Hold half of the requests open, so that they remain in flight.
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		bodies []io.Closer
+	)
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ep := LeastRequestSelector{}.SelectWithLoad(endpoints, req, tr.dialer.inFlight.load)
+			resp, err := tr.roundTripEndpoint(rt, req, ep)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if i%2 == 0 {
+				_ = resp.Body.Close()
+				return
+			}
+			mu.Lock()
+			bodies = append(bodies, resp.Body)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	total := tr.dialer.inFlight.load(endpoints[0]) + tr.dialer.inFlight.load(endpoints[1])
+	assert.EqualValues(t, 50, total)
+
+	for _, body := range bodies {
+		require.NoError(t, body.Close())
+	}
+	assert.Empty(t, tr.dialer.inFlight.counts)
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+)
+
+const (
+	// pointsPerWeight is the number of points on the ring per unit of weight
+	// of an endpoint. It does not depend on the other endpoints, so that the
+	// points of an endpoint are stable as others are added or removed.
+	pointsPerWeight = 100
+	// maxRingSize bounds the number of points on the ring, which are scaled
+	// down for endpoints with large weights.
+	maxRingSize = 100_000
+)
+
+// HashKeyFunc returns the key of a request used to select its endpoint, and
+// false if the request has no key.
+type HashKeyFunc func(req *http.Request) (string, bool)
+
+// HeaderHashKey returns a HashKeyFunc that keys requests by the value of a
+// header.
+func HeaderHashKey(name string) HashKeyFunc {
+	return func(req *http.Request) (string, bool) {
+		value := req.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// CookieHashKey returns a HashKeyFunc that keys requests by the value of a
+// cookie.
+func CookieHashKey(name string) HashKeyFunc {
+	return func(req *http.Request) (string, bool) {
+		cookie, err := req.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+}
+
+// RingHashSelector selects endpoints by consistent hashing of a key of the
+// request, so that requests with the same key are sent to the same endpoint
+// while the endpoints are unchanged, and few keys move when they change.
+// Endpoints occupy points on the ring in proportion to their weights, and
+// healthy endpoints are preferred. Requests without a key, and dials, use a
+// WeightedSelector.
+type RingHashSelector struct {
+	key      HashKeyFunc
+	fallback WeightedSelector
+
+	mu sync.Mutex
+	// rings are the rings of each service, keyed by the host of requests.
+	rings map[string]*hashRing
+}
+
+// hashRing is the ring of a service.
+type hashRing struct {
+	// endpoints are the endpoints that the ring was built from.
+	endpoints []xds.Endpoint
+	points    []ringPoint
+}
+
+// ringPoint is a point on the ring owned by an endpoint.
+type ringPoint struct {
+	hash     uint64
+	endpoint xds.Endpoint
+}
+
+func NewRingHashSelector(key HashKeyFunc) *RingHashSelector {
+	return &RingHashSelector{key: key, rings: make(map[string]*hashRing)}
+}
+
+func (s *RingHashSelector) Select(endpoints []xds.Endpoint, req *http.Request) xds.Endpoint {
+	if req == nil {
+		return s.fallback.Select(endpoints, req)
+	}
+	key, ok := s.key(req)
+	if !ok {
+		return s.fallback.Select(endpoints, req)
+	}
+
+	ring := s.getRing(req.URL.Hostname(), endpoints)
+	hash := hashString(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].endpoint
+}
+
+// Evict drops the ring of a service, e.g. once its xDS subscription is evicted,
+// so that rings are not kept for services that are no longer requested.
+func (s *RingHashSelector) Evict(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rings, service)
+}
+
+// getRing returns the ring for the endpoints of a service, rebuilding it if
+// they have changed. Each service has its own ring, so that requests to
+// different services do not rebuild each other's rings.
+func (s *RingHashSelector) getRing(service string, endpoints []xds.Endpoint) []ringPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rings[service]
+	if !ok || !slices.Equal(ring.endpoints, endpoints) {
+		ring = &hashRing{
+			endpoints: slices.Clone(endpoints),
+			points:    buildRing(xds.PreferHealthy(endpoints)),
+		}
+		s.rings[service] = ring
+	}
+	return ring.points
+}
+
+// buildRing returns a ring with points for each endpoint in proportion to its
+// weight.
+func buildRing(endpoints []xds.Endpoint) []ringPoint {
+	total := 0
+	for _, endpoint := range endpoints {
+		total += endpointWeight(endpoint)
+	}
+	scale := min(float64(maxRingSize)/float64(total*pointsPerWeight), 1) * pointsPerWeight
+
+	var ring []ringPoint
+	for _, endpoint := range endpoints {
+		addr := endpointAddr(endpoint)
+		points := int(math.Ceil(float64(endpointWeight(endpoint)) * scale))
+		for i := range points {
+			ring = append(ring, ringPoint{
+				hash:     hashString(addr + "_" + strconv.Itoa(i)),
+				endpoint: endpoint,
+			})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return ring
+}
+
+// hashString returns a 64-bit hash of s.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	// Mix the bits, as FNV hashes of similar strings are poorly distributed.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
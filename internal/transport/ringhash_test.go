@@ -0,0 +1,126 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func requestWithHeader(value string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://service/", nil)
+	req.Header.Set("X-Session", value)
+	return req
+}
+
+func TestRingHashSelector(t *testing.T) {
+	endpoints := []xds.Endpoint{
+		{Host: "1.2.3.4", Port: 443, Weight: 1},
+		{Host: "1.2.3.5", Port: 443, Weight: 1},
+		{Host: "1.2.3.6", Port: 443, Weight: 2},
+	}
+	s := NewRingHashSelector(HeaderHashKey("X-Session"))
+
+	counts := make(map[string]int)
+	selected := make(map[string]string)
+	for i := range 4000 {
+		key := fmt.Sprintf("session-%d", i)
+		endpoint := s.Select(endpoints, requestWithHeader(key))
+		counts[endpoint.Host]++
+		selected[key] = endpoint.Host
+
+		// Requests with the same key are sent to the same endpoint.
+		assert.Equal(t, endpoint, s.Select(endpoints, requestWithHeader(key)))
+	}
+
+	// Keys are spread in proportion to the weights of endpoints.
+	assert.InDelta(t, 1000, counts["1.2.3.4"], 250)
+	assert.InDelta(t, 1000, counts["1.2.3.5"], 250)
+	assert.InDelta(t, 2000, counts["1.2.3.6"], 250)
+
+	// Removing an endpoint only moves the keys that were sent to it.
+	for key, host := range selected {
+		endpoint := s.Select(endpoints[1:], requestWithHeader(key))
+		if host != "1.2.3.4" {
+			assert.Equal(t, host, endpoint.Host)
+		} else {
+			assert.NotEqual(t, host, endpoint.Host)
+		}
+	}
+}
+
+func TestRingHashSelector_noKey(t *testing.T) {
+	endpoints := []xds.Endpoint{{Host: "1.2.3.4", Port: 443}}
+	s := NewRingHashSelector(CookieHashKey("session"))
+
+	assert.Equal(t, endpoints[0], s.Select(endpoints, nil))
+	assert.Equal(t, endpoints[0], s.Select(endpoints, httptest.NewRequest(http.MethodGet, "https://service/", nil)))
+
+	req := httptest.NewRequest(http.MethodGet, "https://service/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	assert.Equal(t, endpoints[0], s.Select(endpoints, req))
+}
+
+func TestRingHashSelector_servicesHaveOwnRings(t *testing.T) {
+	endpoints1 := []xds.Endpoint{{Host: "1.2.3.4", Port: 443, Weight: 1}, {Host: "1.2.3.5", Port: 443, Weight: 1}}
+	endpoints2 := []xds.Endpoint{{Host: "5.6.7.8", Port: 443, Weight: 1}}
+	s := NewRingHashSelector(HeaderHashKey("X-Session"))
+
+	ring1 := s.getRing("service1", endpoints1)
+	ring2 := s.getRing("service2", endpoints2)
+
+	// Alternating between services reuses their rings.
+	assert.Same(t, &ring1[0], &s.getRing("service1", endpoints1)[0])
+	assert.Same(t, &ring2[0], &s.getRing("service2", endpoints2)[0])
+
+	// A ring is rebuilt when the endpoints of its service change.
+	assert.NotSame(t, &ring1[0], &s.getRing("service1", endpoints1[:1])[0])
+	assert.Same(t, &ring2[0], &s.getRing("service2", endpoints2)[0])
+}
+
+func TestRingHashSelector_Evict(t *testing.T) {
+	endpoints := []xds.Endpoint{{Host: "1.2.3.4", Port: 443, Weight: 1}}
+	s := NewRingHashSelector(HeaderHashKey("X-Session"))
+
+	s.getRing("service1", endpoints)
+	s.getRing("service2", endpoints)
+	s.Evict("service1")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.NotContains(t, s.rings, "service1")
+	assert.Contains(t, s.rings, "service2")
+}
+
+func TestRingHashSelector_evictedWithSubscription(t *testing.T) {
+	// The xDS server is unreachable, so the subscription stays idle.
+	client, err := xds.NewXDSClient(xds.XDSClientConfig{
+		ServerURI:       "passthrough:///127.0.0.1:1",
+		SubscriptionTTL: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	s := NewRingHashSelector(HeaderHashKey("X-Session"))
+	NewCofideTransport(client, nil, WithSelector(s))
+
+	_, err = client.GetEndpoints("service")
+	assert.ErrorIs(t, err, xds.ErrNotYetDiscovered)
+	s.getRing("service", []xds.Endpoint{{Host: "1.2.3.4", Port: 443, Weight: 1}})
+
+	// The ring is dropped once the subscription is evicted.
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.rings["service"]
+		return !ok
+	}, 10*time.Second, 10*time.Millisecond)
+}
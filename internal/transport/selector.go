@@ -0,0 +1,54 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+)
+
+// Selector selects the endpoint of a service to send a request to.
+type Selector interface {
+	// Select returns one of endpoints, which is non-empty. req is the request
+	// being sent, or nil if the endpoint is selected when dialing.
+	Select(endpoints []xds.Endpoint, req *http.Request) xds.Endpoint
+}
+
+// EvictingSelector is a Selector that keeps state for each service. Dialer
+// calls Evict with each service whose xDS subscription is evicted, so that the
+// state of services that are no longer requested is dropped.
+type EvictingSelector interface {
+	Selector
+	Evict(service string)
+}
+
+// WeightedSelector selects endpoints at random in proportion to their
+// weights, preferring healthy endpoints. Endpoints without a weight have a
+// weight of 1.
+type WeightedSelector struct{}
+
+func (WeightedSelector) Select(endpoints []xds.Endpoint, _ *http.Request) xds.Endpoint {
+	endpoints = xds.PreferHealthy(endpoints)
+
+	total := 0
+	for _, endpoint := range endpoints {
+		total += endpointWeight(endpoint)
+	}
+
+	n := rand.IntN(total)
+	for _, endpoint := range endpoints {
+		n -= endpointWeight(endpoint)
+		if n < 0 {
+			return endpoint
+		}
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+// endpointWeight returns the weight of an endpoint, which is 1 if not set.
+func endpointWeight(endpoint xds.Endpoint) int {
+	return max(endpoint.Weight, 1)
+}
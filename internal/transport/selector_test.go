@@ -0,0 +1,41 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedSelector(t *testing.T) {
+	endpoints := []xds.Endpoint{
+		{Host: "1.2.3.4", Weight: 3},
+		{Host: "1.2.3.5", Weight: 1},
+		{Host: "1.2.3.6", Weight: 0},
+	}
+
+	counts := make(map[string]int)
+	for range 5000 {
+		counts[WeightedSelector{}.Select(endpoints, nil).Host]++
+	}
+
+	// Endpoints without a weight have a weight of 1.
+	assert.InDelta(t, 3000, counts["1.2.3.4"], 300)
+	assert.InDelta(t, 1000, counts["1.2.3.5"], 300)
+	assert.InDelta(t, 1000, counts["1.2.3.6"], 300)
+}
+
+func TestWeightedSelector_preferHealthy(t *testing.T) {
+	endpoints := []xds.Endpoint{
+		{Host: "1.2.3.4", Weight: 100, HealthStatus: core.HealthStatus_DRAINING},
+		{Host: "1.2.3.5", Weight: 1, HealthStatus: core.HealthStatus_HEALTHY},
+	}
+
+	for range 100 {
+		assert.Equal(t, "1.2.3.5", WeightedSelector{}.Select(endpoints, nil).Host)
+	}
+}
@@ -6,65 +6,400 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 )
 
+// defaultIdleConnTimeout bounds how long idle connections to an endpoint
+// that has been evicted may linger, if the template does not set a timeout.
+const defaultIdleConnTimeout = 90 * time.Second
+
+// CofideTransport is an http.RoundTripper that routes requests to endpoints
+// discovered via xDS, falling back to standard dialing for hosts without
+// endpoints. Connections are pooled per resolved endpoint, and pooled
+// connections to endpoints that are removed from the xDS set are closed.
 type CofideTransport struct {
-	baseTransport http.RoundTripper
-}
-
-func NewCofideTransport(client *xds.XDSClient, tlsConfig *tls.Config) *CofideTransport {
-	// Create a transport with a custom dialer
-	baseTransport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-		// Create a custom dialer that handles hostname resolution
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			// Extract host and port
-			host, _, err := net.SplitHostPort(addr)
-			if err != nil {
-				slog.Debug("Failed to split address", "addr", addr, "error", err)
-				// Fall back to standard dialing
-				dialer := &net.Dialer{}
-				return dialer.DialContext(ctx, network, addr)
-			}
+	// baseTransport is used for hosts that are not resolved via xDS.
+	baseTransport *http.Transport
+	tlsConfig     *tls.Config
+	dialer        *Dialer
 
-			// Try to resolve endpoint
-			endpoints, err := client.GetEndpoints(host)
-			if err != nil || len(endpoints) == 0 {
-				slog.Debug("Failed to get endpoints", "host", host, "endpoints", endpoints, "error", err)
-				// Fall back to standard dialing
-				dialer := &net.Dialer{}
-				return dialer.DialContext(ctx, network, addr)
-			}
+	// template is an optional transport whose non-TLS settings are copied
+	// into the base transport.
+	template *http.Transport
+
+	// dialerOpts are options for the dialer that resolves endpoints via xDS.
+	dialerOpts []DialerOption
+
+	// proxy optionally overrides the proxy of the base transport.
+	proxy func(*http.Request) (*url.URL, error)
+
+	// selector optionally overrides the selector of the dialer.
+	selector Selector
+
+	mu sync.Mutex
+	// endpointTransports pool connections to each resolved endpoint.
+	endpointTransports map[endpointKey]*http.Transport
+	// watches cancel the watches of services with endpoint transports.
+	watches map[string]func()
+}
+
+// endpointKey identifies the transport for an endpoint of a service. The
+// weight of the endpoint does not affect its connections, so is omitted.
+type endpointKey struct {
+	service    string
+	host       string
+	port       int
+	serverName string
+	spiffeID   string
+}
+
+func newEndpointKey(service string, endpoint xds.Endpoint) endpointKey {
+	return endpointKey{
+		service:    service,
+		host:       endpoint.Host,
+		port:       endpoint.Port,
+		serverName: endpoint.ServerName,
+		spiffeID:   endpoint.SPIFFEID,
+	}
+}
 
-			// Select endpoint
-			endpoint := selectEndpoint(endpoints)
+type TransportOption func(*CofideTransport)
 
-			// Dial using resolved endpoint
-			dialer := &net.Dialer{}
-			slog.Debug("Dialing endpoint discovered via xDS", "endpoint", endpoint)
-			return dialer.DialContext(ctx, network, fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port))
-		},
+// WithTransportTemplate sets a transport whose non-TLS settings (connection
+// pooling, timeouts, etc.) are copied into the base transport.
+func WithTransportTemplate(template *http.Transport) TransportOption {
+	return func(t *CofideTransport) {
+		t.template = template
 	}
+}
+
+// WithDialerOptions sets options for the dialer that resolves endpoints via xDS.
+func WithDialerOptions(opts ...DialerOption) TransportOption {
+	return func(t *CofideTransport) {
+		t.dialerOpts = append(t.dialerOpts, opts...)
+	}
+}
+
+// WithProxy sets the proxy used for hosts that are not resolved via xDS.
+// Endpoints discovered via xDS are always dialed directly.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) TransportOption {
+	return func(t *CofideTransport) {
+		t.proxy = proxy
+	}
+}
 
-	return &CofideTransport{
-		baseTransport: baseTransport,
+// WithSelector sets the selector of the endpoint of a service that a request is
+// sent to. By default a WeightedSelector is used. A LoadAwareSelector, such as
+// LeastRequestSelector, is passed the number of requests in flight to each
+// endpoint, counted until their response bodies are closed.
+func WithSelector(selector Selector) TransportOption {
+	return func(t *CofideTransport) {
+		t.selector = selector
 	}
 }
 
+// NewHTTPTransport returns an http.Transport that uses tlsConfig. If template
+// is non-nil its settings are copied, but tlsConfig always takes precedence
+// and any custom TLS dialers on the template are dropped. Otherwise, proxies
+// are configured from the environment.
+func NewHTTPTransport(template *http.Transport, tlsConfig *tls.Config) *http.Transport {
+	// Like http.DefaultTransport, honour HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if template != nil {
+		t = template.Clone()
+	}
+
+	t.TLSClientConfig = tlsConfig
+	t.DialTLSContext = nil
+	t.DialTLS = nil //nolint:staticcheck // cleared so that it cannot bypass tlsConfig
+
+	return t
+}
+
+func NewCofideTransport(client *xds.XDSClient, tlsConfig *tls.Config, opts ...TransportOption) *CofideTransport {
+	t := &CofideTransport{
+		tlsConfig:          tlsConfig,
+		endpointTransports: make(map[endpointKey]*http.Transport),
+		watches:            make(map[string]func()),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.dialer = NewDialer(client, t.dialerOpts...)
+	if t.selector != nil {
+		t.dialer.selector = t.selector
+		t.dialer.watchEvictions()
+	}
+
+	t.baseTransport = NewHTTPTransport(t.template, tlsConfig)
+	t.baseTransport.DialContext = t.dialer.baseDialContext
+	if t.proxy != nil {
+		t.baseTransport.Proxy = t.proxy
+	}
+
+	return t
+}
+
 func (t *CofideTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// The ServerName in TLS config will be automatically set to req.URL.Hostname()
-	// by the http.Transport implementation
-	return t.baseTransport.RoundTrip(req)
+	// The ServerName in TLS config defaults to req.URL.Hostname(), unless
+	// overridden by the xDS endpoint
+	service := req.URL.Hostname()
+	endpoint := t.dialer.resolve(req.Context(), service, req)
+	if endpoint == nil {
+		return t.baseTransport.RoundTrip(req)
+	}
+
+	rt, err := t.endpointTransport(service, *endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the endpoint in the context of the request, which is available
+	// to the caller as the Request of the response.
+	req = req.WithContext(ContextWithEndpoint(req.Context(), *endpoint))
+	return t.roundTripEndpoint(rt, req, *endpoint)
+}
+
+// roundTripEndpoint sends req to endpoint using rt, counting it as in flight
+// to the endpoint until its response body is closed.
+func (t *CofideTransport) roundTripEndpoint(rt http.RoundTripper, req *http.Request, endpoint xds.Endpoint) (*http.Response, error) {
+	done := t.dialer.inFlight.start(endpoint)
+	resp, err := rt.RoundTrip(req)
+	return trackResponse(resp, err, done)
+}
+
+type endpointContextKey struct{}
+
+// ContextWithEndpoint returns a copy of ctx that records the xDS endpoint
+// that a request was sent to.
+func ContextWithEndpoint(ctx context.Context, endpoint xds.Endpoint) context.Context {
+	return context.WithValue(ctx, endpointContextKey{}, endpoint)
+}
+
+// EndpointFromContext returns the xDS endpoint recorded in ctx, if any.
+func EndpointFromContext(ctx context.Context) (xds.Endpoint, bool) {
+	endpoint, ok := ctx.Value(endpointContextKey{}).(xds.Endpoint)
+	return endpoint, ok
+}
+
+// CloseIdleConnections closes idle connections to all hosts and endpoints.
+func (t *CofideTransport) CloseIdleConnections() {
+	t.baseTransport.CloseIdleConnections()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, rt := range t.endpointTransports {
+		rt.CloseIdleConnections()
+	}
+}
+
+// endpointTransport returns the transport that pools connections to an
+// endpoint of a service, creating it if necessary.
+func (t *CofideTransport) endpointTransport(service string, endpoint xds.Endpoint) (*http.Transport, error) {
+	key := newEndpointKey(service, endpoint)
+
+	t.mu.Lock()
+	rt, ok := t.endpointTransports[key]
+	t.mu.Unlock()
+	if ok {
+		return rt, nil
+	}
+
+	rt, err := t.newEndpointTransport(service, endpoint, t.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if existing, ok := t.endpointTransports[key]; ok {
+		// Another request created the transport concurrently.
+		rt = existing
+	} else {
+		t.endpointTransports[key] = rt
+	}
+	t.mu.Unlock()
+
+	t.watch(service)
+	return rt, nil
+}
+
+// newEndpointTransport returns a new transport that dials an endpoint of a
+// service, using tlsConfig for its connections.
+func (t *CofideTransport) newEndpointTransport(service string, endpoint xds.Endpoint, tlsConfig *tls.Config) (*http.Transport, error) {
+	tlsConfig, err := endpointTLSConfig(tlsConfig, &endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := NewHTTPTransport(t.template, tlsConfig)
+	if rt.IdleConnTimeout == 0 {
+		rt.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	// Connections are dialed directly to the endpoint, so cannot be proxied.
+	rt.Proxy = nil
+	addr := endpointAddr(endpoint)
+	rt.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		t.dialer.logger.Debug("Dialing endpoint discovered via xDS", "service", service, "endpoint", endpoint)
+		return t.dialer.baseDialContext(ctx, network, addr)
+	}
+	return rt, nil
+}
+
+// RoundTripWithTLSConfig is like RoundTrip, but uses tlsConfig rather than the
+// transport's TLS config. The request is sent on a dedicated connection that
+// is closed after the response, so that connections are never shared between
+// TLS configs.
+func (t *CofideTransport) RoundTripWithTLSConfig(req *http.Request, tlsConfig *tls.Config) (*http.Response, error) {
+	service := req.URL.Hostname()
+	endpoint := t.dialer.resolve(req.Context(), service, req)
+	if endpoint == nil {
+		return RoundTripWithTLSConfig(t.baseTransport, req, tlsConfig)
+	}
+
+	rt, err := t.newEndpointTransport(service, *endpoint, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	rt.DisableKeepAlives = true
+
+	req = req.WithContext(ContextWithEndpoint(req.Context(), *endpoint))
+	return t.roundTripEndpoint(rt, req, *endpoint)
+}
+
+// RoundTripWithTLSConfig sends req using a copy of base that uses tlsConfig.
+// The request is sent on a dedicated connection that is closed after the
+// response, so that connections are never shared between TLS configs.
+func RoundTripWithTLSConfig(base *http.Transport, req *http.Request, tlsConfig *tls.Config) (*http.Response, error) {
+	rt := base.Clone()
+	rt.TLSClientConfig = tlsConfig
+	rt.DisableKeepAlives = true
+	return rt.RoundTrip(req)
+}
+
+// watch watches the endpoints of a service, if not already watched, to evict
+// the transports of endpoints that are removed.
+func (t *CofideTransport) watch(service string) {
+	t.mu.Lock()
+	_, ok := t.watches[service]
+	if !ok {
+		t.watches[service] = func() {}
+	}
+	t.mu.Unlock()
+	if ok {
+		return
+	}
+
+	// Watch is called without holding the lock, as it may call evict.
+	cancel := t.dialer.client.Watch(service, func(endpoints []xds.Endpoint) {
+		t.evict(service, endpoints)
+	})
+
+	t.mu.Lock()
+	t.watches[service] = cancel
+	t.mu.Unlock()
 }
 
-func selectEndpoint(endpoints []xds.Endpoint) xds.Endpoint {
-	// Simple round-robin for now
-	// TODO: could be enhanced with weighted selection
-	return endpoints[0]
+// evict removes the transports of endpoints of a service that are not in
+// endpoints, closing their idle connections. Connections that are in use are
+// closed once idle, after the idle connection timeout. If no transports remain
+// for the service, its watch is cancelled, so that the xDS client may evict
+// its subscription once idle.
+func (t *CofideTransport) evict(service string, endpoints []xds.Endpoint) {
+	current := make(map[endpointKey]struct{}, len(endpoints))
+	for _, endpoint := range endpoints {
+		current[newEndpointKey(service, endpoint)] = struct{}{}
+	}
+
+	var evicted []*http.Transport
+	var remaining int
+	var cancel func()
+	t.mu.Lock()
+	for key, rt := range t.endpointTransports {
+		if key.service != service {
+			continue
+		}
+		if _, ok := current[key]; !ok {
+			delete(t.endpointTransports, key)
+			evicted = append(evicted, rt)
+		} else {
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		cancel = t.watches[service]
+		delete(t.watches, service)
+	}
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	for _, rt := range evicted {
+		t.dialer.logger.Debug("Closing connections to endpoint removed from xDS", "service", service)
+		rt.CloseIdleConnections()
+	}
+}
+
+// endpointTLSConfig returns a copy of base for connections to endpoint. The
+// endpoint may override the TLS server name, and pin the SPIFFE ID that the
+// server must present in addition to any authorization in base.
+func endpointTLSConfig(base *tls.Config, endpoint *xds.Endpoint) (*tls.Config, error) {
+	tlsConfig := base.Clone()
+
+	if endpoint.ServerName != "" {
+		tlsConfig.ServerName = endpoint.ServerName
+	}
+	if endpoint.SPIFFEID != "" {
+		expected, err := spiffeid.FromString(endpoint.SPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID for endpoint %s:%d: %w", endpoint.Host, endpoint.Port, err)
+		}
+
+		verify := tlsConfig.VerifyPeerCertificate
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, verifiedChains); err != nil {
+					return err
+				}
+			}
+			return verifyPeerID(rawCerts, expected)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPeerID verifies that the leaf certificate in rawCerts is an X509-SVID
+// for the expected SPIFFE ID.
+func verifyPeerID(rawCerts [][]byte, expected spiffeid.ID) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificates")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse peer certificate: %w", err)
+	}
+
+	actual, err := x509svid.IDFromCert(cert)
+	if err != nil {
+		return fmt.Errorf("failed to get peer SPIFFE ID: %w", err)
+	}
+
+	if actual != expected {
+		return fmt.Errorf("unexpected peer SPIFFE ID %q for endpoint, expected %q", actual, expected)
+	}
+	return nil
 }
@@ -0,0 +1,165 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPTransport_template(t *testing.T) {
+	template := &http.Transport{
+		MaxIdleConns:        42,
+		MaxIdleConnsPerHost: 7,
+		IdleConnTimeout:     time.Minute,
+		TLSClientConfig:     &tls.Config{ServerName: "template"},
+		DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			return nil, nil
+		},
+	}
+	tlsConfig := &tls.Config{ServerName: "spire"}
+
+	got := NewHTTPTransport(template, tlsConfig)
+
+	assert.Equal(t, 42, got.MaxIdleConns)
+	assert.Equal(t, 7, got.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, got.IdleConnTimeout)
+	assert.Same(t, tlsConfig, got.TLSClientConfig)
+	assert.Nil(t, got.DialTLSContext)
+	// The template must not be modified.
+	assert.Equal(t, "template", template.TLSClientConfig.ServerName)
+}
+
+func TestNewHTTPTransport_noTemplate(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	got := NewHTTPTransport(nil, tlsConfig)
+	assert.Same(t, tlsConfig, got.TLSClientConfig)
+	assert.NotNil(t, got.Proxy)
+}
+
+func TestEndpointTLSConfig(t *testing.T) {
+	base := &tls.Config{MinVersion: tls.VersionTLS13}
+
+	tests := []struct {
+		name           string
+		endpoint       *xds.Endpoint
+		wantServerName string
+	}{
+		{
+			name:     "endpoint without server name",
+			endpoint: &xds.Endpoint{Host: "1.2.3.4", Port: 443},
+		},
+		{
+			name:           "endpoint with server name",
+			endpoint:       &xds.Endpoint{Host: "1.2.3.4", Port: 443, ServerName: "pod-1.service.internal"},
+			wantServerName: "pod-1.service.internal",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := endpointTLSConfig(base, tt.endpoint)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantServerName, got.ServerName)
+			assert.Equal(t, uint16(tls.VersionTLS13), got.MinVersion)
+			assert.Nil(t, got.VerifyPeerCertificate)
+		})
+	}
+
+	// The base config is not modified.
+	assert.Empty(t, base.ServerName)
+}
+
+func TestEndpointTLSConfig_spiffeID(t *testing.T) {
+	rawCert := makeSVID(t, "spiffe://example.org/service")
+
+	var baseCalled bool
+	base := &tls.Config{
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			baseCalled = true
+			return nil
+		},
+	}
+
+	got, err := endpointTLSConfig(base, &xds.Endpoint{SPIFFEID: "spiffe://example.org/service"})
+	require.NoError(t, err)
+	require.NoError(t, got.VerifyPeerCertificate([][]byte{rawCert}, nil))
+	assert.True(t, baseCalled)
+
+	got, err = endpointTLSConfig(base, &xds.Endpoint{SPIFFEID: "spiffe://example.org/other"})
+	require.NoError(t, err)
+	assert.ErrorContains(t, got.VerifyPeerCertificate([][]byte{rawCert}, nil), "unexpected peer SPIFFE ID")
+
+	_, err = endpointTLSConfig(base, &xds.Endpoint{SPIFFEID: "not-a-spiffe-id"})
+	assert.ErrorContains(t, err, "invalid SPIFFE ID for endpoint")
+}
+
+// makeSVID returns a DER-encoded self-signed certificate with a SPIFFE ID URI SAN.
+func makeSVID(t *testing.T, spiffeID string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	uri, err := url.Parse(spiffeID)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return raw
+}
+
+func TestCofideTransport_evict(t *testing.T) {
+	ep1 := xds.Endpoint{Host: "1.2.3.4", Port: 443, Weight: 1}
+	ep2 := xds.Endpoint{Host: "1.2.3.5", Port: 443, Weight: 1}
+	other := xds.Endpoint{Host: "5.6.7.8", Port: 443, Weight: 1}
+
+	var cancelled bool
+	tr := &CofideTransport{
+		dialer: NewDialer(nil),
+		endpointTransports: map[endpointKey]*http.Transport{
+			newEndpointKey("service", ep1): {},
+			newEndpointKey("service", ep2): {},
+			newEndpointKey("other", other): {},
+		},
+		watches: map[string]func(){
+			"service": func() { cancelled = true },
+			"other":   func() {},
+		},
+	}
+
+	// A change of weight does not evict the endpoint.
+	ep1.Weight = 2
+	tr.evict("service", []xds.Endpoint{ep1})
+
+	assert.Len(t, tr.endpointTransports, 2)
+	assert.Contains(t, tr.endpointTransports, newEndpointKey("service", ep1))
+	assert.Contains(t, tr.endpointTransports, newEndpointKey("other", other))
+	assert.False(t, cancelled)
+
+	// The watch is cancelled once no endpoints remain.
+	tr.evict("service", []xds.Endpoint{})
+
+	assert.Len(t, tr.endpointTransports, 1)
+	assert.True(t, cancelled)
+	assert.NotContains(t, tr.watches, "service")
+	assert.Contains(t, tr.watches, "other")
+}
@@ -9,87 +9,479 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
+var (
+	// ErrNotYetDiscovered is returned by GetEndpoints while the endpoints of a
+	// service have not yet been received from the xDS server. It is transient.
+	ErrNotYetDiscovered = errors.New("endpoints not yet discovered")
+
+	// ErrNoEndpoints is returned by GetEndpoints once the xDS server has
+	// reported that a service has no endpoints, or does not exist, or if the
+	// endpoints were not received within the initial fetch timeout.
+	ErrNoEndpoints = errors.New("no endpoints discovered")
+
+	// ErrStaleEndpoints is returned by GetEndpoints if the endpoints of a
+	// service have not been refreshed within the endpoint TTL, because the
+	// ADS stream is down.
+	ErrStaleEndpoints = errors.New("endpoints are stale")
+
+	// ErrInvalidServiceName is returned by GetEndpoints for a service name
+	// that cannot be subscribed to, e.g. because it contains whitespace.
+	ErrInvalidServiceName = errors.New("invalid service name")
+)
+
+// DecodeError is the error from decoding the last response of the xDS server
+// for a service. It is wrapped by the errors returned by GetEndpoints while
+// the service has no usable endpoints, to distinguish a malformed response
+// from endpoints that are yet to be discovered.
+type DecodeError struct {
+	Service string
+	Version string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode xDS response for %s at version %q: %v", e.Service, e.Version, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 type XDSClient struct {
 	logger    *slog.Logger
 	conn      *grpc.ClientConn
 	client    discovery.AggregatedDiscoveryServiceClient
-	nodeID    string
+	node      *core.Node
+	delta     bool
+	metrics   metrics.Recorder
 	endpoints sync.Map // service -> []Endpoint
-	watching  sync.Map // service -> *sync.Once
+
+	// decodeErrs holds the last decode error of each service, until its
+	// endpoints are next updated.
+	decodeErrs sync.Map // service -> *DecodeError
+
+	// subscriptions is the set of services whose endpoints are watched, with
+	// the time each was last requested. All subscriptions share a single ADS
+	// stream.
+	subscriptions map[string]time.Time
+	subsMu        sync.Mutex
+	// fetchTimers are the initial fetch timers of subscriptions whose
+	// endpoints have yet to time out, which are stopped if the subscription
+	// is evicted or the client is closed.
+	fetchTimers map[string]*fetchTimer
+	// subsCh is signalled when the set of subscriptions changes.
+	subsCh    chan struct{}
+	watchOnce sync.Once
+
+	// ctx is the context of the watch, which is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// watchClusters is set once ListServices is first called, after which
+	// all clusters are watched to learn the service catalog.
+	watchClusters atomic.Bool
+	// services is the set of services whose clusters have been discovered.
+	services   map[string]struct{}
+	servicesMu sync.Mutex
+
+	// watchers are notified when the endpoints of a service are updated.
+	watchers   map[string]map[*watcher]struct{}
+	watchersMu sync.Mutex
+
+	// initialFetchTimeout is how long to wait for the endpoints of a newly
+	// subscribed service before treating it as not found.
+	initialFetchTimeout time.Duration
+
+	// minReconnectInterval is the minimum time between the starts of
+	// successive ADS streams.
+	minReconnectInterval time.Duration
+
+	// dropUnhealthy removes endpoints that are not healthy from the cache.
+	dropUnhealthy bool
+
+	// typeURL is the type URL of the resources watched for endpoints, which
+	// are decoded by decode.
+	typeURL string
+	decode  DecodeFunc
+
+	// backoffInitialDelay and backoffMaxDelay optionally override the
+	// backoff between ADS stream retries.
+	backoffInitialDelay time.Duration
+	backoffMaxDelay     time.Duration
+	backoffStrategy     backoff.Strategy
+
+	// maxEndpoints optionally caps the number of endpoints accepted for a
+	// service.
+	maxEndpoints int
+
+	// subscriptionTTL is how long an unwatched service may go unrequested
+	// before it is unsubscribed. Zero disables eviction.
+	subscriptionTTL time.Duration
+
+	// endpointTTL optionally bounds how long cached endpoints are used while
+	// the ADS stream is down. updatedAt holds the time the endpoints of each
+	// service were last updated.
+	endpointTTL time.Duration
+	updatedAt   sync.Map // service -> time.Time
+
+	// onEvict are called with each service whose subscription is evicted.
+	onEvict   []func(service string)
+	onEvictMu sync.Mutex
+
+	// connected is whether a response has been received on the current ADS
+	// stream, and disconnectedAt is when the last stream ended.
+	connected      bool
+	disconnectedAt time.Time
+	connMu         sync.Mutex
+
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
 }
 
 type XDSClientConfig struct {
-	Logger    *slog.Logger
+	Logger *slog.Logger
+
+	// ServerURI is the gRPC target of the xDS server, e.g.:
+	//   - host:port, or dns:///host:port, resolved using DNS
+	//   - unix:///path/to/socket, or a bare absolute socket path
+	//   - unix-abstract:name, for an abstract unix socket
+	//   - passthrough:///addr, dialed without resolution
 	ServerURI string
 	NodeID    string
+
+	// Node is an optional template for the node sent in discovery requests,
+	// e.g. to set its cluster, locality and metadata. NodeID, if set, takes
+	// precedence over the template's ID.
+	Node *core.Node
+
+	// Delta enables the delta (incremental) ADS protocol. By default the State
+	// of the World protocol is used.
+	Delta bool
+
+	// Metrics is an optional recorder for xDS metrics.
+	Metrics metrics.Recorder
+
+	// SubscriptionTTL bounds the number of subscriptions when many distinct
+	// services are requested. A service whose endpoints have not been
+	// requested for SubscriptionTTL, and that has no watchers, is unsubscribed
+	// and its endpoints are removed from the cache. By default subscriptions
+	// are never evicted.
+	SubscriptionTTL time.Duration
+
+	// DropUnhealthy drops endpoints whose health status is neither HEALTHY nor
+	// UNKNOWN, e.g. DRAINING or UNHEALTHY endpoints. By default they are
+	// retained, but healthy endpoints are preferred when selecting one.
+	DropUnhealthy bool
+
+	// DuplicateWeight determines the weight of an endpoint whose address is
+	// listed more than once for a service, e.g. in different localities.
+	// Duplicates with the same health status are merged into a single
+	// endpoint, whose weight is by default the sum of their weights. If their
+	// health differs, the healthy copy is kept and the others are dropped.
+	DuplicateWeight DuplicateWeight
+
+	// MinReconnectInterval is the minimum time between the starts of
+	// successive ADS streams. The backoff between streams is reset once a
+	// response is received, so this protects the client and server from
+	// reconnection storms if the server repeatedly responds and then closes
+	// the stream. By default only the backoff applies.
+	MinReconnectInterval time.Duration
+
+	// InitialFetchTimeout is how long to wait for the endpoints of a newly
+	// subscribed service. If they are not received in time, a warning is
+	// logged and the service is treated as having no endpoints until they
+	// are received, so that GetEndpoints returns an error wrapping
+	// ErrNoEndpoints rather than ErrNotYetDiscovered. By default there is no
+	// timeout.
+	InitialFetchTimeout time.Duration
+
+	// BackoffInitialDelay and BackoffMaxDelay bound the exponential backoff
+	// between retries of the ADS stream. By default the backoff starts at
+	// 200ms and is capped at 10s.
+	BackoffInitialDelay time.Duration
+	BackoffMaxDelay     time.Duration
+	// BackoffStrategy determines how the backoff grows. By default the delay
+	// doubles after each retry.
+	BackoffStrategy backoff.Strategy
+
+	// EndpointTTL bounds how long the cached endpoints of a service are used
+	// while the ADS stream is down, e.g. because reconnection keeps failing.
+	// Endpoints are refreshed while the stream is connected; once it is down,
+	// GetEndpoints returns an error wrapping ErrStaleEndpoints for a service
+	// whose endpoints were last updated, or last known to be current, more
+	// than EndpointTTL ago, so that callers fall back to DNS. By default
+	// cached endpoints are used indefinitely.
+	EndpointTTL time.Duration
+
+	// MaxEndpoints caps the number of endpoints accepted for a service. A
+	// response with more endpoints for a service is rejected (NACKed), and
+	// the service's previous endpoints are retained. By default the number of
+	// endpoints is not limited.
+	MaxEndpoints int
+
+	// MaxRecvMsgSize caps the size in bytes of the xDS responses received
+	// from the server. By default the gRPC default of 4MB applies.
+	MaxRecvMsgSize int
+
+	// TypeURL is the type URL of the resources watched for endpoints. By
+	// default ClusterLoadAssignment resources of the v3 API are watched.
+	TypeURL string
+
+	// Decode optionally decodes the resources of TypeURL into endpoints, e.g.
+	// to watch a resource type other than ClusterLoadAssignment. By default
+	// resources are decoded as ClusterLoadAssignments, which allows other
+	// versions of the API to be watched by setting only TypeURL.
+	Decode DecodeFunc
+
+	// Keepalive configures gRPC keepalive pings on the connection to the xDS
+	// server, so that a stream silently dropped, e.g. by a load balancer, is
+	// detected and re-established. By default a ping is sent after 5m of
+	// inactivity while the ADS stream is open, and the connection is closed
+	// if it is not acknowledged within 20s. This is the shortest interval
+	// permitted by the default keepalive enforcement policy of gRPC servers,
+	// which close connections that ping more often with a GOAWAY, so shorter
+	// intervals require the server's policy to permit them.
+	Keepalive *keepalive.ClientParameters
+}
+
+// defaultKeepalive is the default keepalive configuration of the connection to
+// the xDS server. It complies with the default enforcement policy of gRPC
+// servers, which requires at least 5m between pings, and none without active
+// streams.
+var defaultKeepalive = keepalive.ClientParameters{
+	Time:    5 * time.Minute,
+	Timeout: 20 * time.Second,
 }
 
+// keepaliveParams returns the keepalive configuration of the connection to the
+// xDS server.
+func keepaliveParams(cfg XDSClientConfig) keepalive.ClientParameters {
+	if cfg.Keepalive != nil {
+		return *cfg.Keepalive
+	}
+	return defaultKeepalive
+}
+
+// DuplicateWeight determines the weight of an endpoint whose address is listed
+// more than once for a service.
+type DuplicateWeight int
+
+const (
+	// DuplicateWeightSum sums the weights of duplicate endpoints.
+	DuplicateWeightSum DuplicateWeight = iota
+	// DuplicateWeightMax takes the maximum weight of duplicate endpoints.
+	DuplicateWeightMax
+)
+
 type Endpoint struct {
 	Host   string
 	Port   int
 	Weight int
+
+	// ServerName is an optional TLS server name (SNI) to use when connecting
+	// to the endpoint, taken from the endpoint's hostname.
+	ServerName string
+
+	// SPIFFEID is an optional SPIFFE ID that the endpoint must present,
+	// taken from the spiffe_id key in the endpoint's cofide filter metadata.
+	SPIFFEID string
+
+	// HealthStatus is the health status of the endpoint reported by the xDS
+	// server, which is UNKNOWN if not reported.
+	HealthStatus core.HealthStatus
+}
+
+// Healthy returns whether the endpoint may be used, i.e. its health status is
+// HEALTHY or UNKNOWN.
+func (e Endpoint) Healthy() bool {
+	return e.HealthStatus == core.HealthStatus_HEALTHY || e.HealthStatus == core.HealthStatus_UNKNOWN
 }
 
+// PreferHealthy returns the healthy endpoints, or all of the endpoints if none
+// are healthy.
+func PreferHealthy(endpoints []Endpoint) []Endpoint {
+	healthy := filterHealthy(endpoints)
+	if len(healthy) == 0 {
+		return endpoints
+	}
+	return healthy
+}
+
+// filterHealthy returns the healthy endpoints.
+func filterHealthy(endpoints []Endpoint) []Endpoint {
+	healthy := make([]Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.Healthy() {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	return healthy
+}
+
+// Keys of the filter metadata of an endpoint that hold Cofide attributes.
+const (
+	metadataNamespace   = "cofide"
+	spiffeIDMetadataKey = "spiffe_id"
+)
+
+// NewXDSClient creates an XDSClient for the xDS server at cfg.ServerURI. The
+// connection is insecure unless opts set transport credentials, as opts are
+// applied after the defaults.
 func NewXDSClient(cfg XDSClientConfig, opts ...grpc.DialOption) (*XDSClient, error) {
-	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials())) // insecure connection
+	defaults := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()), // insecure connection
+		grpc.WithKeepaliveParams(keepaliveParams(cfg)),
+	}
+	if cfg.MaxRecvMsgSize > 0 {
+		defaults = append(defaults, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cfg.MaxRecvMsgSize)))
+	}
+	opts = append(defaults, opts...)
 	conn, err := grpc.NewClient(
-		cfg.ServerURI,
+		serverTarget(cfg.ServerURI),
 		opts...,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	node := &core.Node{}
+	if cfg.Node != nil {
+		node = proto.Clone(cfg.Node).(*core.Node)
+	}
+	if cfg.NodeID != "" {
+		node.Id = cfg.NodeID
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NoopRecorder{}
+	}
+
+	if cfg.TypeURL == "" {
+		cfg.TypeURL = resource.EndpointType
+	}
+	if cfg.Decode == nil {
+		cfg.Decode = claDecoder(cfg.TypeURL, cfg.DuplicateWeight)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &XDSClient{
-		logger: cfg.Logger.With(slog.String("node", cfg.NodeID)),
-		conn:   conn,
-		client: discovery.NewAggregatedDiscoveryServiceClient(conn),
-		nodeID: cfg.NodeID,
+		logger:  cfg.Logger.With(slog.String("node", node.Id)),
+		conn:    conn,
+		client:  discovery.NewAggregatedDiscoveryServiceClient(conn),
+		node:    node,
+		delta:   cfg.Delta,
+		metrics: cfg.Metrics,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		subscriptions: make(map[string]time.Time),
+		fetchTimers:   make(map[string]*fetchTimer),
+		subsCh:        make(chan struct{}, 1),
+		watchers:      make(map[string]map[*watcher]struct{}),
+
+		initialFetchTimeout:  cfg.InitialFetchTimeout,
+		minReconnectInterval: cfg.MinReconnectInterval,
+		dropUnhealthy:        cfg.DropUnhealthy,
+		typeURL:              cfg.TypeURL,
+		decode:               cfg.Decode,
+		maxEndpoints:         cfg.MaxEndpoints,
+		subscriptionTTL:      cfg.SubscriptionTTL,
+		endpointTTL:          cfg.EndpointTTL,
+		now:                  time.Now,
+		backoffInitialDelay:  cfg.BackoffInitialDelay,
+		backoffMaxDelay:      cfg.BackoffMaxDelay,
+		backoffStrategy:      cfg.BackoffStrategy,
 	}
 
 	return client, nil
 }
 
-func (c *XDSClient) watchEndpointsRetried(ctx context.Context, serviceName string) {
-	logger := c.logger.With(slog.String("service", serviceName))
-	backoff := backoff.NewBackoff()
+// newBackoff returns the backoff between retries of the ADS stream.
+func (c *XDSClient) newBackoff() *backoff.Backoff {
+	return backoff.NewBackoff(
+		backoff.WithDelays(c.backoffInitialDelay, c.backoffMaxDelay),
+		backoff.WithStrategy(c.backoffStrategy),
+	)
+}
+
+func (c *XDSClient) watchEndpointsRetried(ctx context.Context) {
+	logger := c.logger
+	backoff := c.newBackoff()
+	// versions holds the last applied version of each resource when using delta ADS.
+	versions := make(map[string]string)
 	for {
-		resetBackoff, err := c.watchEndpoints(ctx, logger, serviceName)
-		if err != nil {
+		start := time.Now()
+		var resetBackoff bool
+		var err error
+		if c.delta {
+			resetBackoff, err = c.watchEndpointsDelta(ctx, logger, versions)
+		} else {
+			resetBackoff, err = c.watchEndpoints(ctx, logger)
+		}
+		c.setConnected(false)
+		if err != nil && ctx.Err() == nil {
 			logger.Error("xDS watch failed, retrying", "error", err)
 		}
 		if resetBackoff {
 			backoff.Reset()
 		}
 
+		d := reconnectDelay(backoff.Duration(), c.minReconnectInterval, time.Since(start))
+		c.metrics.Retry(metrics.ComponentXDS, d)
+
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(backoff.Duration()):
+		case <-time.After(d):
 		}
 	}
 }
 
-// watchEndpoints watches endpoints for a service using an ADS stream.
+// reconnectDelay returns how long to wait before reconnecting, given the
+// backoff delay and the time elapsed since the last stream started. The
+// delay is extended so that streams start at most once per minInterval.
+func reconnectDelay(backoffDelay, minInterval, elapsed time.Duration) time.Duration {
+	return max(backoffDelay, minInterval-elapsed)
+}
+
+// watchEndpoints watches endpoints for all subscribed services using an ADS stream.
 // The endpoints map is updated with the current state of the endpoints.
+// The subscribed resources are updated as services are subscribed to.
 // watchEndpoints returns if the stream is closed or any send/receive request fails.
 // It returns a bool indicating whether the backoff in the caller should be reset, as well as an error.
-func (c *XDSClient) watchEndpoints(ctx context.Context, logger *slog.Logger, serviceName string) (bool, error) {
-	// Clusters in Cofide Agent xDS have a _cluster suffix
-	xdsResourceName := fmt.Sprintf("%v_cluster", serviceName)
+func (c *XDSClient) watchEndpoints(ctx context.Context, logger *slog.Logger) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	logger.Debug("Connecting to xDS server")
 	stream, err := c.client.StreamAggregatedResources(ctx)
@@ -103,30 +495,68 @@ func (c *XDSClient) watchEndpoints(ctx context.Context, logger *slog.Logger, ser
 		}
 	}()
 
+	recvCh := receive(ctx, stream.Recv)
+
 	req := &discovery.DiscoveryRequest{
-		Node: &core.Node{
-			Id: c.nodeID,
-		},
-		TypeUrl:       resource.EndpointType, // Type URL for endpoints
-		ResourceNames: []string{xdsResourceName},
+		Node:          c.node,
+		TypeUrl:       c.typeURL,
+		ResourceNames: c.resourceNames(),
 	}
 
+	// clustersReq is the CDS request, once the service catalog is watched.
+	var clustersReq *discovery.DiscoveryRequest
+
 	// resetBackoff tracks whether we have seen a valid endpoint, and should reset the backoff.
 	var resetBackoff bool
+	// send tracks whether req should be sent, and sendClusters whether clustersReq should be.
+	send := len(req.ResourceNames) > 0
+	var sendClusters bool
+	// outstanding holds the resource names of each request sent with a new
+	// set of resources that may not have been answered yet, oldest first; see
+	// answeredResources.
+	var outstanding [][]string
 	for {
-		// Send EDS request
-		if err := stream.Send(req); err != nil {
-			return resetBackoff, fmt.Errorf("failed to send xDS discovery request: %w", err)
+		if clustersReq == nil && c.watchClusters.Load() {
+			// Subscribe to all clusters.
+			clustersReq = &discovery.DiscoveryRequest{
+				Node:    c.node,
+				TypeUrl: resource.ClusterType,
+			}
+			sendClusters = true
 		}
 
-		logger.Debug("Sent xDS discovery request")
+		if send {
+			// Send EDS request
+			if err := stream.Send(req); err != nil {
+				return resetBackoff, fmt.Errorf("failed to send xDS discovery request: %w", err)
+			}
+
+			logger.Debug("Sent xDS discovery request", "resources", req.ResourceNames)
+			if len(outstanding) == 0 || !slices.Equal(outstanding[len(outstanding)-1], req.ResourceNames) {
+				outstanding = append(outstanding, req.ResourceNames)
+			}
+		}
+
+		if sendClusters {
+			if err := stream.Send(clustersReq); err != nil {
+				return resetBackoff, fmt.Errorf("failed to send xDS cluster discovery request: %w", err)
+			}
+
+			logger.Debug("Sent xDS cluster discovery request")
+			sendClusters = false
+		}
 
 		select {
 		case <-ctx.Done():
 			logger.Debug("xDS watch cancelled")
 			return resetBackoff, nil
-		default:
-			resp, err := stream.Recv()
+		case <-c.subsCh:
+			// Subscriptions have changed, so request the new set of resources.
+			names := c.resourceNames()
+			send = !slices.Equal(names, req.ResourceNames)
+			req.ResourceNames = names
+		case r := <-recvCh:
+			resp, err := r.resp, r.err
 			if err != nil {
 				if errors.Is(err, io.EOF) {
 					logger.Debug("xDS watch stream ended")
@@ -138,59 +568,652 @@ func (c *XDSClient) watchEndpoints(ctx context.Context, logger *slog.Logger, ser
 			}
 
 			resetBackoff = true
+			c.setConnected(true)
+			c.metrics.XDSResponseReceived()
 
-			// Update the last seen version and nonce in the request.
-			req.VersionInfo = resp.VersionInfo
+			if resp.TypeUrl == resource.ClusterType {
+				send = false
+				if clustersReq != nil {
+					sendClusters = true
+					c.applyClusters(logger, clustersReq, resp)
+				}
+				continue
+			}
+
+			send = true
+
+			// The nonce of the response is sent in the next request, which
+			// either ACKs or NACKs the response.
 			req.ResponseNonce = resp.Nonce
 
-			// Update endpoints directly in cache
-			endpoints := []Endpoint{}
-			if len(resp.Resources) > 0 {
-				var cla endpoint.ClusterLoadAssignment
-				if err := resp.Resources[0].UnmarshalTo(&cla); err != nil {
-					logger.Error("Failed to unmarshal ClusterLoadAssignment", "error", err)
+			// The response answers one of the outstanding requests.
+			answered := answeredResources(outstanding)
+
+			// Resources without a cluster name are attributed to the only
+			// requested service, if all of the outstanding requests are for
+			// the same one.
+			var defaultService string
+			if len(answered) == 1 && !slices.ContainsFunc(outstanding, func(names []string) bool { return len(names) != 1 }) {
+				defaultService = serviceForResource(answered[0])
+			}
+			// The oldest request has now been answered, either by the
+			// response or by an earlier one, and the latest request remains
+			// outstanding until another is sent.
+			if len(outstanding) > 1 {
+				outstanding = outstanding[1:]
+			}
+
+			updates, err := resourcesToEndpoints(resp.Resources, defaultService, c.decode)
+			if err == nil {
+				err = c.checkMaxEndpoints(updates)
+			}
+			if err != nil {
+				logger.Error("Failed to decode xDS discovery response", "version", resp.VersionInfo, "error", err)
+				c.metrics.XDSDecodeFailure()
+				for _, name := range req.ResourceNames {
+					c.decodeFailed(serviceForResource(name), resp.VersionInfo, err)
+				}
+				// NACK the response, retaining the last applied version.
+				req.ErrorDetail = nackStatus(err)
+				continue
+			}
+
+			// Update endpoints directly in cache. A resource that was
+			// requested by the request that the response answers, but is
+			// absent from it, has no endpoints.
+			for _, name := range answered {
+				service := serviceForResource(name)
+				if _, ok := updates[service]; ok {
+					continue
+				}
+				logger.Debug("No endpoints in xDS response", "service", service)
+				updates[service] = []Endpoint{}
+			}
+			for service, endpoints := range updates {
+				if !c.isSubscribed(service) {
+					logger.Debug("Ignoring xDS endpoints for unwatched service", "service", service)
 					continue
-				} else {
-					endpoints = claToEndpoints(&cla)
-					logger.Debug("xDS endpoints updated", slog.Any("endpoints", endpoints))
 				}
-			} else {
-				logger.Debug("No endpoints in xDS response")
+				logger.Debug("xDS endpoints updated", "service", service, slog.Any("endpoints", endpoints))
+				c.storeEndpoints(service, endpoints)
 			}
-			c.endpoints.Store(serviceName, endpoints)
+
+			// ACK the response, now that it has been applied.
+			req.VersionInfo = resp.VersionInfo
+			req.ErrorDetail = nil
 		}
 	}
 }
 
+// answeredResources returns the resource names requested by all of the
+// outstanding requests, one of which a response answers. A server answers
+// requests in order, so the oldest request may be answered by a response that
+// arrives after newer requests with more resources have been sent, whose
+// absence from the response does not mean that they do not exist. Requests
+// that only ACK or NACK a response, without changing the resources, are not
+// outstanding, as servers do not answer them.
+func answeredResources(outstanding [][]string) []string {
+	if len(outstanding) == 0 {
+		return nil
+	}
+	var answered []string
+	for _, name := range outstanding[0] {
+		if !slices.ContainsFunc(outstanding[1:], func(names []string) bool { return !slices.Contains(names, name) }) {
+			answered = append(answered, name)
+		}
+	}
+	return answered
+}
+
+// serverTarget returns the gRPC target for an xDS server URI. Bare absolute
+// paths are treated as unix sockets, rather than being resolved using DNS.
+func serverTarget(serverURI string) string {
+	if strings.HasPrefix(serverURI, "/") {
+		return "unix://" + serverURI
+	}
+	return serverURI
+}
+
+// checkMaxEndpoints returns an error if any service in updates has more than
+// the maximum number of endpoints.
+func (c *XDSClient) checkMaxEndpoints(updates map[string][]Endpoint) error {
+	if c.maxEndpoints <= 0 {
+		return nil
+	}
+	for service, endpoints := range updates {
+		if len(endpoints) > c.maxEndpoints {
+			return fmt.Errorf("service %s has %d endpoints, exceeding the maximum of %d", service, len(endpoints), c.maxEndpoints)
+		}
+	}
+	return nil
+}
+
+// recvResult is the result of receiving a message from a stream.
+type recvResult[T any] struct {
+	resp T
+	err  error
+}
+
+// receive calls recv in a new goroutine, sending the results on the returned
+// channel until recv returns an error or ctx is done.
+func receive[T any](ctx context.Context, recv func() (T, error)) <-chan recvResult[T] {
+	ch := make(chan recvResult[T])
+	go func() {
+		for {
+			resp, err := recv()
+			select {
+			case ch <- recvResult[T]{resp: resp, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// GetEndpoints returns the endpoints of a service, subscribing to them if
+// necessary. An error wrapping ErrNotYetDiscovered is returned until the
+// endpoints have been received from the xDS server, after which an error
+// wrapping ErrNoEndpoints is returned if the service has no endpoints. Either
+// error also wraps a *DecodeError if the last response for the service could
+// not be decoded. Invalid service names are not subscribed to, and an error
+// wrapping ErrInvalidServiceName is returned; see ValidateServiceName.
 func (c *XDSClient) GetEndpoints(service string) ([]Endpoint, error) {
+	if err := ValidateServiceName(service); err != nil {
+		return nil, err
+	}
+
 	// First check if we already have endpoints
 	if eps, ok := c.endpoints.Load(service); ok {
-		return eps.([]Endpoint), nil
+		c.subscribe(service)
+
+		if age, stale := c.staleness(service); stale {
+			return nil, fmt.Errorf("%w for %s: last current %s ago", ErrStaleEndpoints, service, age.Round(time.Second))
+		}
+
+		endpoints := eps.([]Endpoint)
+		if len(endpoints) == 0 {
+			return endpoints, c.endpointsError(ErrNoEndpoints, service)
+		}
+		return endpoints, nil
 	}
 
-	// Check if we're already watching, using sync.Once per service
-	watchOnce, _ := c.watching.LoadOrStore(service, &sync.Once{})
-	watchOnce.(*sync.Once).Do(func() {
-		go c.watchEndpointsRetried(context.Background(), service)
-	})
+	c.subscribe(service)
+	c.startWatch()
 
 	// Return empty for now, next request will get the endpoints
-	return nil, fmt.Errorf("endpoints not yet discovered for %s", service)
+	return nil, c.endpointsError(ErrNotYetDiscovered, service)
+}
+
+// staleness returns how long ago the endpoints of a service were last known
+// to be current, and whether that exceeds the endpoint TTL. Endpoints are
+// current while the ADS stream is connected.
+func (c *XDSClient) staleness(service string) (time.Duration, bool) {
+	if c.endpointTTL <= 0 {
+		return 0, false
+	}
+
+	c.connMu.Lock()
+	connected, current := c.connected, c.disconnectedAt
+	c.connMu.Unlock()
+	if connected {
+		return 0, false
+	}
+
+	if updatedAt, ok := c.updatedAt.Load(service); ok && updatedAt.(time.Time).After(current) {
+		current = updatedAt.(time.Time)
+	}
+	age := c.now().Sub(current)
+	return age, age > c.endpointTTL
+}
+
+// setConnected records whether the ADS stream is connected.
+func (c *XDSClient) setConnected(connected bool) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.connected && !connected {
+		c.disconnectedAt = c.now()
+	}
+	c.connected = connected
+}
+
+// endpointsError returns an error wrapping sentinel for a service without
+// usable endpoints, which also wraps its last decode error if there is one.
+func (c *XDSClient) endpointsError(sentinel error, service string) error {
+	if decodeErr, ok := c.decodeErrs.Load(service); ok {
+		return fmt.Errorf("%w for %s: %w", sentinel, service, decodeErr.(*DecodeError))
+	}
+	return fmt.Errorf("%w for %s", sentinel, service)
+}
+
+// decodeFailed records that a response for a service could not be decoded.
+func (c *XDSClient) decodeFailed(service, version string, err error) {
+	c.decodeErrs.Store(service, &DecodeError{Service: service, Version: version, Err: err})
+}
+
+// WaitForEndpoints is like GetEndpoints, but if the endpoints of the service
+// have not yet been discovered it waits until they are, or ctx is done.
+func (c *XDSClient) WaitForEndpoints(ctx context.Context, service string) ([]Endpoint, error) {
+	if err := ValidateServiceName(service); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.endpoints.Load(service); !ok {
+		updated := make(chan struct{}, 1)
+		cancel := c.Watch(service, func([]Endpoint) {
+			select {
+			case updated <- struct{}{}:
+			default:
+			}
+		})
+		defer cancel()
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+		}
+	}
+
+	return c.GetEndpoints(service)
+}
+
+// Watch subscribes to the endpoints of a service. f is called with the
+// endpoints of the service once they are known, and again whenever they are
+// updated, until the returned cancel function is called. Calls to f for a
+// single watch are not concurrent, and should not block.
+func (c *XDSClient) Watch(service string, f func([]Endpoint)) (cancel func()) {
+	if err := ValidateServiceName(service); err != nil {
+		c.logger.Warn("Not watching endpoints of invalid service", "error", err)
+		return func() {}
+	}
+
+	w := &watcher{f: f}
+
+	c.watchersMu.Lock()
+	if c.watchers[service] == nil {
+		c.watchers[service] = make(map[*watcher]struct{})
+	}
+	c.watchers[service][w] = struct{}{}
+	c.watchersMu.Unlock()
+
+	c.subscribe(service)
+	c.startWatch()
+
+	// Deliver the endpoints if they have already been discovered.
+	c.notify(service, w)
+
+	return func() {
+		c.watchersMu.Lock()
+		defer c.watchersMu.Unlock()
+		delete(c.watchers[service], w)
+		if len(c.watchers[service]) == 0 {
+			delete(c.watchers, service)
+		}
+	}
+}
+
+// watcher is a callback registered using Watch.
+type watcher struct {
+	// mu serialises calls to f.
+	mu sync.Mutex
+	f  func([]Endpoint)
+}
+
+// startWatch starts watching endpoints, if not already started. Endpoints for
+// all services are watched using a single stream.
+func (c *XDSClient) startWatch() {
+	c.watchOnce.Do(func() {
+		go c.watchEndpointsRetried(c.ctx)
+		if c.subscriptionTTL > 0 {
+			go c.evictIdleLoop(c.ctx)
+		}
+	})
+}
+
+// Close stops watching endpoints and closes the connection to the xDS
+// server. Endpoints already discovered remain cached, but are no longer
+// updated.
+func (c *XDSClient) Close() error {
+	c.cancel()
+
+	c.subsMu.Lock()
+	for service, timer := range c.fetchTimers {
+		timer.Stop()
+		delete(c.fetchTimers, service)
+	}
+	c.subsMu.Unlock()
+
+	return c.conn.Close()
+}
+
+// evictIdleLoop periodically evicts idle subscriptions until ctx is done.
+func (c *XDSClient) evictIdleLoop(ctx context.Context) {
+	ticker := time.NewTicker(evictInterval(c.subscriptionTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.evictIdle(now)
+		}
+	}
+}
+
+// minEvictInterval is the minimum interval between evictions of idle
+// subscriptions, however short the subscription TTL.
+const minEvictInterval = 100 * time.Millisecond
+
+// evictInterval returns the interval between evictions of subscriptions that
+// have been idle for ttl, which is positive.
+func evictInterval(ttl time.Duration) time.Duration {
+	return max(ttl/2, minEvictInterval)
+}
+
+// evictIdle unsubscribes from services without watchers that have not been
+// requested since the subscription TTL before now, and removes their
+// endpoints from the cache.
+func (c *XDSClient) evictIdle(now time.Time) {
+	c.watchersMu.Lock()
+	watched := make(map[string]struct{}, len(c.watchers))
+	for service := range c.watchers {
+		watched[service] = struct{}{}
+	}
+	c.watchersMu.Unlock()
+
+	c.subsMu.Lock()
+	var evicted []string
+	for service, lastUsed := range c.subscriptions {
+		if _, ok := watched[service]; ok || now.Sub(lastUsed) < c.subscriptionTTL {
+			continue
+		}
+		c.logger.Debug("Evicting idle xDS subscription", "service", service)
+		delete(c.subscriptions, service)
+		if timer, ok := c.fetchTimers[service]; ok {
+			timer.Stop()
+			delete(c.fetchTimers, service)
+		}
+		c.endpoints.Delete(service)
+		c.decodeErrs.Delete(service)
+		c.updatedAt.Delete(service)
+		evicted = append(evicted, service)
+	}
+	if len(evicted) > 0 {
+		c.notifySubscriptions()
+	}
+	c.subsMu.Unlock()
+
+	c.onEvictMu.Lock()
+	onEvict := slices.Clone(c.onEvict)
+	c.onEvictMu.Unlock()
+	for _, service := range evicted {
+		for _, f := range onEvict {
+			f(service)
+		}
+	}
 }
 
-// claToEndpoints converts a ClusterLoadAssignment to a slice of Endpoint.
-func claToEndpoints(cla *endpoint.ClusterLoadAssignment) []Endpoint {
+// OnEvict registers f to be called with each service whose subscription is
+// evicted after being idle for the subscription TTL, e.g. to drop state kept
+// for the service.
+func (c *XDSClient) OnEvict(f func(service string)) {
+	c.onEvictMu.Lock()
+	defer c.onEvictMu.Unlock()
+	c.onEvict = append(c.onEvict, f)
+}
+
+// storeEndpoints updates the endpoints of a service and notifies its watchers.
+func (c *XDSClient) storeEndpoints(service string, endpoints []Endpoint) {
+	if c.dropUnhealthy {
+		endpoints = filterHealthy(endpoints)
+	}
+	c.endpoints.Store(service, endpoints)
+	c.updatedAt.Store(service, c.now())
+	c.decodeErrs.Delete(service)
+	c.endpointsUpdated(service, endpoints)
+}
+
+// endpointsUpdated records metrics for the updated endpoints of a service and
+// notifies its watchers.
+func (c *XDSClient) endpointsUpdated(service string, endpoints []Endpoint) {
+	c.metrics.XDSEndpoints(service, len(endpoints))
+
+	c.watchersMu.Lock()
+	watchers := make([]*watcher, 0, len(c.watchers[service]))
+	for w := range c.watchers[service] {
+		watchers = append(watchers, w)
+	}
+	c.watchersMu.Unlock()
+
+	for _, w := range watchers {
+		c.notify(service, w)
+	}
+}
+
+// notify calls a watcher with the current endpoints of a service, if known.
+// The endpoints are loaded while holding the watcher's lock, so that the last
+// call always receives the latest endpoints.
+func (c *XDSClient) notify(service string, w *watcher) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if eps, ok := c.endpoints.Load(service); ok {
+		w.f(eps.([]Endpoint))
+	}
+}
+
+// subscribe adds a service to the set of subscriptions, if not already
+// present, and records that it has been requested.
+func (c *XDSClient) subscribe(service string) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	_, ok := c.subscriptions[service]
+	c.subscriptions[service] = c.now()
+	if !ok {
+		c.notifySubscriptions()
+		if c.initialFetchTimeout > 0 {
+			timer := &fetchTimer{}
+			timer.Timer = time.AfterFunc(c.initialFetchTimeout, func() { c.initialFetchTimedOut(service, timer) })
+			c.fetchTimers[service] = timer
+		}
+	}
+}
+
+// fetchTimer is the initial fetch timer of a subscription. Its identity
+// distinguishes the timer of the current subscription to a service from those
+// of earlier, evicted subscriptions.
+type fetchTimer struct {
+	*time.Timer
+}
+
+// initialFetchTimedOut treats a service whose endpoints have not been received
+// as having no endpoints, unless timer is no longer the initial fetch timer of
+// its subscription or the client is closed.
+func (c *XDSClient) initialFetchTimedOut(service string, timer *fetchTimer) {
+	c.subsMu.Lock()
+	current := c.fetchTimers[service] == timer
+	if current {
+		delete(c.fetchTimers, service)
+	}
+	c.subsMu.Unlock()
+
+	if !current || c.ctx.Err() != nil {
+		return
+	}
+
+	endpoints := []Endpoint{}
+	if _, loaded := c.endpoints.LoadOrStore(service, endpoints); loaded {
+		return
+	}
+
+	c.logger.Warn("xDS endpoints not received within initial fetch timeout", "service", service, "timeout", c.initialFetchTimeout)
+	c.endpointsUpdated(service, endpoints)
+}
+
+// notifySubscriptions notifies the watch that the set of subscriptions has
+// changed, without blocking.
+func (c *XDSClient) notifySubscriptions() {
+	select {
+	case c.subsCh <- struct{}{}:
+	default:
+	}
+}
+
+// isSubscribed returns whether a service is in the set of subscriptions.
+func (c *XDSClient) isSubscribed(service string) bool {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	_, ok := c.subscriptions[service]
+	return ok
+}
+
+// resourceNames returns the sorted xDS resource names of the subscribed services.
+func (c *XDSClient) resourceNames() []string {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	names := make([]string, 0, len(c.subscriptions))
+	for service := range c.subscriptions {
+		names = append(names, resourceName(service))
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ValidateServiceName returns an error wrapping ErrInvalidServiceName if
+// service cannot be used in the name of an xDS resource, because it is empty,
+// is not valid UTF-8, or contains whitespace or control characters. The xDS
+// server would not match such a name, so the subscription would never be
+// satisfied.
+func ValidateServiceName(service string) error {
+	if service == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidServiceName)
+	}
+	if !utf8.ValidString(service) {
+		return fmt.Errorf("%w %q: not valid UTF-8", ErrInvalidServiceName, service)
+	}
+	if i := strings.IndexFunc(service, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}); i >= 0 {
+		return fmt.Errorf("%w %q: contains whitespace or control character at offset %d", ErrInvalidServiceName, service, i)
+	}
+	return nil
+}
+
+// resourceName returns the name of the xDS resource for a service, which must
+// be valid; see ValidateServiceName.
+func resourceName(service string) string {
+	// Clusters in Cofide Agent xDS have a _cluster suffix
+	return service + "_cluster"
+}
+
+// serviceForResource returns the name of the service for an xDS resource.
+func serviceForResource(resourceName string) string {
+	return strings.TrimSuffix(resourceName, "_cluster")
+}
+
+// DecodeFunc decodes an xDS resource, returning its endpoints and the name of
+// the resource if it includes one, e.g. the cluster name of a
+// ClusterLoadAssignment.
+type DecodeFunc func(res *anypb.Any) (name string, endpoints []Endpoint, err error)
+
+// claDecoder returns a DecodeFunc that decodes resources of typeURL as
+// ClusterLoadAssignments. The v3 message is compatible with earlier versions
+// of the API, so it is used to decode them.
+func claDecoder(typeURL string, duplicateWeight DuplicateWeight) DecodeFunc {
+	return func(res *anypb.Any) (string, []Endpoint, error) {
+		if res.GetTypeUrl() != typeURL {
+			return "", nil, fmt.Errorf("unexpected resource type %q, expected %q", res.GetTypeUrl(), typeURL)
+		}
+		var cla endpoint.ClusterLoadAssignment
+		if err := proto.Unmarshal(res.GetValue(), &cla); err != nil {
+			return "", nil, fmt.Errorf("failed to unmarshal ClusterLoadAssignment: %w", err)
+		}
+		return cla.ClusterName, claToEndpoints(&cla, duplicateWeight), nil
+	}
+}
+
+// resourcesToEndpoints decodes resources, returning their endpoints keyed by
+// service name. Resources without a name are attributed to defaultService. An
+// error is returned if any resource cannot be decoded.
+func resourcesToEndpoints(resources []*anypb.Any, defaultService string, decode DecodeFunc) (map[string][]Endpoint, error) {
+	updates := make(map[string][]Endpoint, len(resources))
+	for _, res := range resources {
+		name, endpoints, err := decode(res)
+		if err != nil {
+			return nil, err
+		}
+
+		service := defaultService
+		if name != "" {
+			service = serviceForResource(name)
+		}
+		updates[service] = endpoints
+	}
+	return updates, nil
+}
+
+// nackStatus returns the error detail used to NACK a discovery response that
+// could not be applied.
+func nackStatus(err error) *status.Status {
+	return &status.Status{
+		Code:    int32(codes.InvalidArgument),
+		Message: err.Error(),
+	}
+}
+
+// claToEndpoints converts a ClusterLoadAssignment to a slice of Endpoint,
+// merging endpoints with the same address.
+func claToEndpoints(cla *endpoint.ClusterLoadAssignment, duplicateWeight DuplicateWeight) []Endpoint {
 	endpoints := make([]Endpoint, 0)
+	indexes := make(map[string]int)
 
 	for _, locality := range cla.Endpoints {
 		for _, endpoint := range locality.LbEndpoints {
 			addr := endpoint.GetEndpoint().Address.GetSocketAddress()
-			endpoints = append(endpoints, Endpoint{
-				Host:   addr.GetAddress(),
-				Port:   int(addr.GetPortValue()),
-				Weight: int(endpoint.GetLoadBalancingWeight().GetValue()),
-			})
+			weight := int(endpoint.GetLoadBalancingWeight().GetValue())
+			key := net.JoinHostPort(addr.GetAddress(), strconv.Itoa(int(addr.GetPortValue())))
+			metadata := endpoint.GetMetadata().GetFilterMetadata()[metadataNamespace]
+			ep := Endpoint{
+				Host:       addr.GetAddress(),
+				Port:       int(addr.GetPortValue()),
+				Weight:     weight,
+				ServerName: endpoint.GetEndpoint().GetHostname(),
+				SPIFFEID:   metadata.GetFields()[spiffeIDMetadataKey].GetStringValue(),
+
+				HealthStatus: endpoint.GetHealthStatus(),
+			}
+
+			i, ok := indexes[key]
+			switch {
+			case !ok:
+				indexes[key] = len(endpoints)
+				endpoints = append(endpoints, ep)
+			case ep.HealthStatus == endpoints[i].HealthStatus:
+				endpoints[i].Weight = mergeWeights(endpoints[i].Weight, ep.Weight, duplicateWeight)
+			case ep.Healthy() && !endpoints[i].Healthy():
+				// The healthy copy replaces the unhealthy one, without its
+				// weight.
+				endpoints[i] = ep
+			}
+			// Otherwise the copy is less healthy, and is dropped.
 		}
 	}
 	return endpoints
 }
+
+// mergeWeights returns the weight of an endpoint with duplicates of weights a
+// and b.
+func mergeWeights(a, b int, duplicateWeight DuplicateWeight) int {
+	if duplicateWeight == DuplicateWeightMax {
+		return max(a, b)
+	}
+	return a + b
+}
@@ -9,9 +9,16 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/pkg/metrics"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
@@ -19,8 +26,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
@@ -34,11 +44,92 @@ func TestXDSClient_NewXDSClient(t *testing.T) {
 	client, err := NewXDSClient(cfg)
 	assert.NotNil(t, client)
 	assert.NoError(t, err)
-	assert.Equal(t, client.nodeID, cfg.NodeID)
+	assert.Equal(t, client.node.Id, cfg.NodeID)
 	assert.NotNil(t, client.client)
 	assert.Equal(t, "dns:///test-server:4321", client.conn.CanonicalTarget())
 }
 
+func TestXDSClient_NewXDSClient_backoff(t *testing.T) {
+	client, err := NewXDSClient(XDSClientConfig{
+		ServerURI:           "test-server:4321",
+		BackoffInitialDelay: time.Second,
+		BackoffStrategy:     backoff.StrategyDecorrelatedJitter,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	want := backoff.NewBackoff(
+		backoff.WithInitialDelay(time.Second),
+		backoff.WithStrategy(backoff.StrategyDecorrelatedJitter),
+	)
+	assert.Equal(t, want, client.newBackoff())
+}
+
+func TestXDSClient_NewXDSClient_target(t *testing.T) {
+	tests := []struct {
+		serverURI string
+		want      string
+	}{
+		{serverURI: "test-server:4321", want: "dns:///test-server:4321"},
+		{serverURI: "unix:///run/cofide/agent.sock", want: "unix:///run/cofide/agent.sock"},
+		{serverURI: "/run/cofide/agent.sock", want: "unix:///run/cofide/agent.sock"},
+		{serverURI: "unix-abstract:cofide-agent", want: "unix-abstract:///cofide-agent"},
+		{serverURI: "passthrough:///10.0.0.1:4321", want: "passthrough:///10.0.0.1:4321"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverURI, func(t *testing.T) {
+			client, err := NewXDSClient(XDSClientConfig{ServerURI: tt.serverURI})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, client.conn.CanonicalTarget())
+		})
+	}
+}
+
+func TestKeepaliveParams(t *testing.T) {
+	assert.Equal(t, defaultKeepalive, keepaliveParams(XDSClientConfig{}))
+
+	// The default complies with the default enforcement policy of gRPC
+	// servers.
+	enforcement := keepalive.EnforcementPolicy{MinTime: 5 * time.Minute}
+	assert.GreaterOrEqual(t, defaultKeepalive.Time, enforcement.MinTime)
+	assert.Equal(t, enforcement.PermitWithoutStream, defaultKeepalive.PermitWithoutStream)
+
+	params := keepalive.ClientParameters{Time: time.Minute, Timeout: 20 * time.Second}
+	assert.Equal(t, params, keepaliveParams(XDSClientConfig{Keepalive: &params}))
+
+	// The connection is created with the keepalive parameters applied.
+	_, err := NewXDSClient(XDSClientConfig{ServerURI: "test-server:4321", Keepalive: &params})
+	require.NoError(t, err)
+}
+
+func TestXDSClient_NewXDSClient_node(t *testing.T) {
+	metadata, err := structpb.NewStruct(map[string]any{"team": "payments"})
+	require.NoError(t, err)
+
+	node := &core.Node{
+		Id:       "template-id",
+		Cluster:  "test-cluster",
+		Locality: &core.Locality{Region: "eu-west-2", Zone: "eu-west-2a"},
+		Metadata: metadata,
+	}
+	cfg := XDSClientConfig{
+		Logger:    slog.Default(),
+		ServerURI: "test-server:4321",
+		NodeID:    "test-client",
+		Node:      node,
+	}
+
+	client, err := NewXDSClient(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "test-client", client.node.Id)
+	assert.Equal(t, "test-cluster", client.node.Cluster)
+	assert.Equal(t, "eu-west-2a", client.node.Locality.Zone)
+	assert.Equal(t, "payments", client.node.Metadata.Fields["team"].GetStringValue())
+
+	// The template is not modified.
+	assert.Equal(t, "template-id", node.Id)
+}
+
 func TestXDSClient_GetEndpoints(t *testing.T) {
 	client, lis, mocked := setupBufconn(t)
 	defer lis.Close()
@@ -57,10 +148,11 @@ func TestXDSClient_GetEndpoints(t *testing.T) {
 
 	assertEndpoints(t, client, endpoints)
 
-	require.NotEmpty(t, mocked.reqs)
-	assert.EqualExportedValues(t, &core.Node{Id: "test-client"}, mocked.reqs[0].Node)
-	assert.EqualExportedValues(t, resource.EndpointType, mocked.reqs[0].TypeUrl)
-	assert.EqualExportedValues(t, []string{"test-service_cluster"}, mocked.reqs[0].ResourceNames)
+	reqs := mocked.requests()
+	require.NotEmpty(t, reqs)
+	assert.EqualExportedValues(t, &core.Node{Id: "test-client"}, reqs[0].Node)
+	assert.EqualExportedValues(t, resource.EndpointType, reqs[0].TypeUrl)
+	assert.EqualExportedValues(t, []string{"test-service_cluster"}, reqs[0].ResourceNames)
 }
 
 func TestXDSClient_GetEndpoints_update(t *testing.T) {
@@ -102,6 +194,7 @@ func TestXDSClient_GetEndpoints_noEndpoints(t *testing.T) {
 	// First call to GetEndpoints starts watchEndpoints.
 	_, err := client.GetEndpoints("test-service")
 	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
 	assert.ErrorContains(t, err, "endpoints not yet discovered for test-service")
 
 	// Response has a single endpoint.
@@ -164,6 +257,159 @@ func TestXDSClient_GetEndpoints_noResources(t *testing.T) {
 	assertEndpoints(t, client, endpoints)
 }
 
+func TestXDSClient_GetEndpoints_subscriptionAddedInFlight(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	_, err := client.GetEndpoints("service1")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+	require.Eventually(t, func() bool { return len(mocked.requests()) > 0 }, 10*time.Second, 10*time.Millisecond)
+
+	endpoints1 := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla1, err := makeNamedCLA("service1_cluster", endpoints1)
+	require.NoError(t, err)
+	endpoints2 := []Endpoint{{Host: "5.6.7.8", Port: 1234, Weight: 1}}
+	cla2, err := makeNamedCLA("service2_cluster", endpoints2)
+	require.NoError(t, err)
+
+	// Subscribe to service2, then answer the request for service1 alone,
+	// which the mock server received before the request for both.
+	_, err = client.GetEndpoints("service2")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla1}})
+
+	// The late response does not report that service2 has no endpoints.
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		got, err := client.GetEndpoints("service1")
+		require.NoError(collect, err)
+		assert.Equal(collect, endpoints1, got)
+	}, 10*time.Second, 100*time.Millisecond)
+	_, err = client.GetEndpoints("service2")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	// The response to the new subscription delivers its endpoints.
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla1, cla2}})
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		got, err := client.GetEndpoints("service2")
+		require.NoError(collect, err)
+		assert.Equal(collect, endpoints2, got)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Once the subscription has been answered, a resource absent from a
+	// response has no endpoints.
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla1}})
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		_, err := client.GetEndpoints("service2")
+		assert.ErrorIs(collect, err, ErrNoEndpoints)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestXDSClient_GetEndpoints_subscriptionsAddedInFlight(t *testing.T) {
+	// The mock server only receives a request once it has answered the
+	// previous one, so record the requests as they are sent.
+	sent := &sentRequests{}
+	client, lis, mocked := setupBufconn(t, grpc.WithStreamInterceptor(sent.intercept))
+	defer lis.Close()
+
+	endpoints := make(map[string][]Endpoint)
+	clas := make(map[string]*anypb.Any)
+	for i, service := range []string{"service1", "service2", "service3"} {
+		endpoints[service] = []Endpoint{{Host: "1.2.3." + strconv.Itoa(i), Port: 4321, Weight: 1}}
+		cla, err := makeNamedCLA(service+"_cluster", endpoints[service])
+		require.NoError(t, err)
+		clas[service] = cla
+	}
+
+	// Subscribe to each service in turn, waiting for each request to be
+	// sent, so that two subscription changes are outstanding.
+	subscribe := func(service string, resourceNames ...string) {
+		_, err := client.GetEndpoints(service)
+		require.ErrorIs(t, err, ErrNotYetDiscovered)
+		require.Eventually(t, func() bool {
+			return slices.Equal(resourceNames, sent.lastResourceNames())
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	subscribe("service1", "service1_cluster")
+	subscribe("service2", "service1_cluster", "service2_cluster")
+	subscribe("service3", "service1_cluster", "service2_cluster", "service3_cluster")
+
+	assertDiscovered := func(service string) {
+		assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+			got, err := client.GetEndpoints(service)
+			require.NoError(collect, err)
+			assert.Equal(collect, endpoints[service], got)
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+
+	// Answer the request for service1 alone.
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{clas["service1"]}})
+	assertDiscovered("service1")
+	_, err := client.GetEndpoints("service2")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+	_, err = client.GetEndpoints("service3")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	// The response to the request for service1 and service2 does not report
+	// that service3 has no endpoints.
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{clas["service1"], clas["service2"]}})
+	assertDiscovered("service2")
+	_, err = client.GetEndpoints("service3")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	// The response to the latest request delivers the endpoints of service3,
+	// after which its absence from a response means it has no endpoints.
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{clas["service1"], clas["service2"], clas["service3"]}})
+	assertDiscovered("service3")
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{clas["service1"], clas["service2"]}})
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		_, err := client.GetEndpoints("service3")
+		assert.ErrorIs(collect, err, ErrNoEndpoints)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// sentRequests records the resource names of the discovery requests sent by a
+// client.
+type sentRequests struct {
+	mu            sync.Mutex
+	resourceNames []string
+}
+
+func (s *sentRequests) intercept(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &sentRequestsStream{ClientStream: stream, sent: s}, nil
+}
+
+func (s *sentRequests) lastResourceNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resourceNames
+}
+
+type sentRequestsStream struct {
+	grpc.ClientStream
+	sent *sentRequests
+}
+
+func (s *sentRequestsStream) SendMsg(m any) error {
+	err := s.ClientStream.SendMsg(m)
+	if req, ok := m.(*discovery.DiscoveryRequest); ok && err == nil {
+		s.sent.mu.Lock()
+		s.sent.resourceNames = req.ResourceNames
+		s.sent.mu.Unlock()
+	}
+	return err
+}
+
+func TestAnsweredResources(t *testing.T) {
+	assert.Empty(t, answeredResources(nil))
+	assert.Equal(t, []string{"a", "b"}, answeredResources([][]string{{"a", "b"}}))
+	assert.Equal(t, []string{"a"}, answeredResources([][]string{{"a"}, {"a", "b"}, {"a", "b", "c"}}))
+	assert.Equal(t, []string{"b"}, answeredResources([][]string{{"a", "b"}, {"b", "c"}}))
+}
+
 func TestXDSClient_GetEndpoints_sendError(t *testing.T) {
 	client, lis, mocked := setupBufconn(t)
 	defer lis.Close()
@@ -218,15 +464,903 @@ func TestXDSClient_GetEndpoints_unmarshallError(t *testing.T) {
 	assertEndpoints(t, client, endpoints)
 }
 
+func TestXDSClient_GetEndpoints_decodeError(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	// First call to GetEndpoints starts watchEndpoints.
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	// First response is an unexpected type.
+	notCLA, err := anypb.New(&endpoint.LbEndpoint{})
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Resources: []*anypb.Any{notCLA}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		_, err := client.GetEndpoints("test-service")
+		assert.ErrorIs(collect, err, ErrNotYetDiscovered)
+
+		var decodeErr *DecodeError
+		if assert.ErrorAs(collect, err, &decodeErr) {
+			assert.Equal(collect, "test-service", decodeErr.Service)
+			assert.Equal(collect, "1", decodeErr.Version)
+		}
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// A valid response clears the decode error.
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Resources: []*anypb.Any{cla}})
+
+	assertEndpoints(t, client, endpoints)
+}
+
+func TestXDSClient_Close(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 1}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+	assertEndpoints(t, client, endpoints)
+
+	require.NoError(t, client.Close())
+	assert.Equal(t, connectivity.Shutdown, client.conn.GetState())
+
+	// Endpoints already discovered remain cached.
+	got, err := client.GetEndpoints("test-service")
+	require.NoError(t, err)
+	assert.Equal(t, endpoints, got)
+}
+
+func TestXDSClient_GetEndpoints_endpointTTL(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.endpointTTL = time.Minute
+
+	var mu sync.Mutex
+	now := time.Now()
+	client.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 1}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+	assertEndpoints(t, client, endpoints)
+
+	// Endpoints do not become stale while the stream is connected.
+	advance(2 * time.Minute)
+	got, err := client.GetEndpoints("test-service")
+	require.NoError(t, err)
+	assert.Equal(t, endpoints, got)
+
+	// Once the stream is down, endpoints become stale after the TTL.
+	mocked.error(errors.New("stream failed"))
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		client.connMu.Lock()
+		defer client.connMu.Unlock()
+		assert.False(collect, client.connected)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	advance(30 * time.Second)
+	_, err = client.GetEndpoints("test-service")
+	require.NoError(t, err)
+
+	advance(31 * time.Second)
+	_, err = client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrStaleEndpoints)
+}
+
+func TestXDSClient_GetEndpoints_maxEndpoints(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.maxEndpoints = 2
+
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	endpoints := []Endpoint{
+		{Host: "1.2.3.4", Port: 4321, Weight: 1},
+		{Host: "1.2.3.5", Port: 4321, Weight: 1},
+	}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+
+	assertEndpoints(t, client, endpoints)
+
+	// A response exceeding the maximum is rejected, retaining the previous endpoints.
+	tooMany, err := makeCLA(append(endpoints, Endpoint{Host: "1.2.3.6", Port: 4321, Weight: 1}))
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{tooMany}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		reqs := mocked.requests()
+		require.Len(collect, reqs, 3)
+
+		nack := reqs[2]
+		assert.Equal(collect, "1", nack.VersionInfo)
+		assert.Equal(collect, "nonce-2", nack.ResponseNonce)
+		if assert.NotNil(collect, nack.ErrorDetail) {
+			assert.Contains(collect, nack.ErrorDetail.Message, "exceeding the maximum of 2")
+		}
+	}, 10*time.Second, 100*time.Millisecond)
+
+	assertEndpoints(t, client, endpoints)
+}
+
+func TestXDSClient_GetEndpoints_typeURL(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	// The v2 ClusterLoadAssignment is decoded as the v3 message.
+	typeURL := "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
+	client.typeURL = typeURL
+	client.decode = claDecoder(typeURL, DuplicateWeightSum)
+
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 1}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+	cla.TypeUrl = typeURL
+
+	mocked.respond(&discovery.DiscoveryResponse{TypeUrl: typeURL, VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+
+	assertEndpoints(t, client, endpoints)
+	for _, req := range mocked.requests() {
+		assert.Equal(t, typeURL, req.TypeUrl)
+	}
+}
+
+func TestXDSClient_GetEndpoints_decode(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	// Resources are host:port addresses of the service.
+	client.typeURL = "type.googleapis.com/google.protobuf.StringValue"
+	client.decode = func(res *anypb.Any) (string, []Endpoint, error) {
+		var addr wrapperspb.StringValue
+		if err := res.UnmarshalTo(&addr); err != nil {
+			return "", nil, err
+		}
+		host, port, err := net.SplitHostPort(addr.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", []Endpoint{{Host: host, Port: portNum, Weight: 1}}, nil
+	}
+
+	_, err := client.GetEndpoints("test-service")
+	require.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	addr, err := anypb.New(wrapperspb.String("1.2.3.4:4321"))
+	require.NoError(t, err)
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{addr}})
+
+	assertEndpoints(t, client, []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 1}})
+	assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", mocked.requests()[0].TypeUrl)
+}
+
+func TestXDSClient_GetEndpoints_multipleResources(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	// First call to GetEndpoints starts watchEndpoints.
+	_, err := client.GetEndpoints("test-service")
+	require.Error(t, err)
+
+	// Response has CLAs for two clusters, with the watched service second.
+	otherCLA, err := makeNamedCLA("other-service_cluster", []Endpoint{{Host: "5.6.7.8", Port: 1234, Weight: 1}})
+	require.NoError(t, err)
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeNamedCLA("test-service_cluster", endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{otherCLA, cla}})
+
+	assertEndpoints(t, client, endpoints)
+
+	// Endpoints for the unwatched service are not cached.
+	_, ok := client.endpoints.Load("other-service")
+	assert.False(t, ok)
+}
+
+func TestXDSClient_GetEndpoints_multipleServices(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	// Subscribe to two services.
+	_, err := client.GetEndpoints("service1")
+	require.Error(t, err)
+	_, err = client.GetEndpoints("service2")
+	require.Error(t, err)
+
+	endpoints1 := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla1, err := makeNamedCLA("service1_cluster", endpoints1)
+	require.NoError(t, err)
+	endpoints2 := []Endpoint{{Host: "5.6.7.8", Port: 1234, Weight: 1}}
+	cla2, err := makeNamedCLA("service2_cluster", endpoints2)
+	require.NoError(t, err)
+
+	// Respond until a request for both resources has been answered.
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla1, cla2}})
+
+		got1, err := client.GetEndpoints("service1")
+		require.NoError(collect, err)
+		assert.Equal(collect, endpoints1, got1)
+		got2, err := client.GetEndpoints("service2")
+		require.NoError(collect, err)
+		assert.Equal(collect, endpoints2, got2)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	reqs := mocked.requests()
+	require.NotEmpty(t, reqs)
+	assert.Equal(t, []string{"service1_cluster", "service2_cluster"}, reqs[len(reqs)-1].ResourceNames)
+
+	// Both services share a single stream.
+	assert.Equal(t, 1, mocked.streamCount())
+}
+
+func TestResourcesToEndpoints(t *testing.T) {
+	endpoints1 := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla1, err := makeNamedCLA("service1_cluster", endpoints1)
+	require.NoError(t, err)
+	endpoints2 := []Endpoint{{Host: "5.6.7.8", Port: 1234, Weight: 1}}
+	cla2, err := makeNamedCLA("service2_cluster", endpoints2)
+	require.NoError(t, err)
+	endpoints3 := []Endpoint{{Host: "9.8.7.6", Port: 5678, Weight: 2}}
+	unnamedCLA, err := makeCLA(endpoints3)
+	require.NoError(t, err)
+
+	got, err := resourcesToEndpoints([]*anypb.Any{cla1, cla2, unnamedCLA}, "default", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{
+		"service1": endpoints1,
+		"service2": endpoints2,
+		"default":  endpoints3,
+	}, got)
+
+	notCLA, err := anypb.New(&endpoint.LbEndpoint{})
+	require.NoError(t, err)
+	_, err = resourcesToEndpoints([]*anypb.Any{cla1, notCLA}, "default", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	assert.Error(t, err)
+}
+
+func TestResourcesToEndpoints_identity(t *testing.T) {
+	endpoints := []Endpoint{
+		{Host: "1.2.3.4", Port: 4321, Weight: 42, ServerName: "pod-1.service", SPIFFEID: "spiffe://example.org/service"},
+		{Host: "1.2.3.5", Port: 4321, Weight: 42},
+	}
+	cla, err := makeNamedCLA("service_cluster", endpoints)
+	require.NoError(t, err)
+
+	got, err := resourcesToEndpoints([]*anypb.Any{cla}, "", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{"service": endpoints}, got)
+}
+
+func TestResourcesToEndpoints_health(t *testing.T) {
+	endpoints := []Endpoint{
+		{Host: "1.2.3.4", Port: 4321, Weight: 42, HealthStatus: core.HealthStatus_HEALTHY},
+		{Host: "1.2.3.5", Port: 4321, Weight: 42, HealthStatus: core.HealthStatus_DRAINING},
+		{Host: "1.2.3.6", Port: 4321, Weight: 42, HealthStatus: core.HealthStatus_UNHEALTHY},
+		{Host: "1.2.3.7", Port: 4321, Weight: 42},
+	}
+	cla, err := makeNamedCLA("service_cluster", endpoints)
+	require.NoError(t, err)
+
+	got, err := resourcesToEndpoints([]*anypb.Any{cla}, "", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{"service": endpoints}, got)
+}
+
+func TestResourcesToEndpoints_duplicates(t *testing.T) {
+	// Each endpoint is in its own locality.
+	cla, err := makeNamedCLA("service_cluster", []Endpoint{
+		{Host: "1.2.3.4", Port: 4321, Weight: 2},
+		{Host: "1.2.3.5", Port: 4321, Weight: 1},
+		{Host: "1.2.3.4", Port: 4321, Weight: 3},
+	})
+	require.NoError(t, err)
+
+	got, err := resourcesToEndpoints([]*anypb.Any{cla}, "", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{"service": {
+		{Host: "1.2.3.4", Port: 4321, Weight: 5},
+		{Host: "1.2.3.5", Port: 4321, Weight: 1},
+	}}, got)
+
+	got, err = resourcesToEndpoints([]*anypb.Any{cla}, "", claDecoder(resource.EndpointType, DuplicateWeightMax))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{"service": {
+		{Host: "1.2.3.4", Port: 4321, Weight: 3},
+		{Host: "1.2.3.5", Port: 4321, Weight: 1},
+	}}, got)
+}
+
+func TestResourcesToEndpoints_duplicatesHealth(t *testing.T) {
+	cla, err := makeNamedCLA("service_cluster", []Endpoint{
+		{Host: "1.2.3.4", Port: 4321, Weight: 2, HealthStatus: core.HealthStatus_DRAINING, ServerName: "draining"},
+		{Host: "1.2.3.4", Port: 4321, Weight: 3, HealthStatus: core.HealthStatus_HEALTHY, ServerName: "healthy"},
+		{Host: "1.2.3.4", Port: 4321, Weight: 4, HealthStatus: core.HealthStatus_UNHEALTHY},
+		{Host: "1.2.3.4", Port: 4321, Weight: 5, HealthStatus: core.HealthStatus_HEALTHY, ServerName: "healthy"},
+	})
+	require.NoError(t, err)
+
+	// Only copies with the same health status are merged, and the healthy
+	// copies are preferred.
+	got, err := resourcesToEndpoints([]*anypb.Any{cla}, "", claDecoder(resource.EndpointType, DuplicateWeightSum))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]Endpoint{"service": {
+		{Host: "1.2.3.4", Port: 4321, Weight: 8, HealthStatus: core.HealthStatus_HEALTHY, ServerName: "healthy"},
+	}}, got)
+}
+
+func TestPreferHealthy(t *testing.T) {
+	healthy := Endpoint{Host: "1.2.3.4", HealthStatus: core.HealthStatus_HEALTHY}
+	unknown := Endpoint{Host: "1.2.3.5"}
+	draining := Endpoint{Host: "1.2.3.6", HealthStatus: core.HealthStatus_DRAINING}
+	unhealthy := Endpoint{Host: "1.2.3.7", HealthStatus: core.HealthStatus_UNHEALTHY}
+
+	assert.Equal(t, []Endpoint{healthy, unknown}, PreferHealthy([]Endpoint{draining, healthy, unhealthy, unknown}))
+	// All endpoints are returned if none are healthy.
+	assert.Equal(t, []Endpoint{draining, unhealthy}, PreferHealthy([]Endpoint{draining, unhealthy}))
+}
+
+func TestXDSClient_GetEndpoints_dropUnhealthy(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.dropUnhealthy = true
+
+	_, err := client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	healthy := Endpoint{Host: "1.2.3.4", Port: 4321, Weight: 42, HealthStatus: core.HealthStatus_HEALTHY}
+	unhealthy := Endpoint{Host: "1.2.3.5", Port: 4321, Weight: 42, HealthStatus: core.HealthStatus_UNHEALTHY}
+	cla, err := makeCLA([]Endpoint{unhealthy, healthy})
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+	assertEndpoints(t, client, []Endpoint{healthy})
+
+	// A service without healthy endpoints has no endpoints.
+	cla, err = makeCLA([]Endpoint{unhealthy})
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{cla}})
+	assertEndpoints(t, client, []Endpoint{})
+}
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		backoffDelay time.Duration
+		minInterval  time.Duration
+		elapsed      time.Duration
+		want         time.Duration
+	}{
+		{
+			name:         "no minimum interval",
+			backoffDelay: 200 * time.Millisecond,
+			elapsed:      10 * time.Millisecond,
+			want:         200 * time.Millisecond,
+		},
+		{
+			name:         "flapping stream",
+			backoffDelay: 200 * time.Millisecond,
+			minInterval:  5 * time.Second,
+			elapsed:      10 * time.Millisecond,
+			want:         4990 * time.Millisecond,
+		},
+		{
+			name:         "long-lived stream",
+			backoffDelay: 200 * time.Millisecond,
+			minInterval:  5 * time.Second,
+			elapsed:      time.Minute,
+			want:         200 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, reconnectDelay(tt.backoffDelay, tt.minInterval, tt.elapsed))
+		})
+	}
+}
+
+func TestXDSClient_GetEndpoints_ackNack(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	// First call to GetEndpoints starts watchEndpoints.
+	_, err := client.GetEndpoints("test-service")
+	require.Error(t, err)
+
+	// First response is valid and should be ACKed.
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+
+	assertEndpoints(t, client, endpoints)
+
+	// Second response is an unexpected type and should be NACKed.
+	notCLA, err := anypb.New(&endpoint.LbEndpoint{})
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{notCLA}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		reqs := mocked.requests()
+		require.Len(collect, reqs, 3)
+
+		ack := reqs[1]
+		assert.Equal(collect, "1", ack.VersionInfo)
+		assert.Equal(collect, "nonce-1", ack.ResponseNonce)
+		assert.Nil(collect, ack.ErrorDetail)
+
+		nack := reqs[2]
+		assert.Equal(collect, "1", nack.VersionInfo)
+		assert.Equal(collect, "nonce-2", nack.ResponseNonce)
+		assert.NotNil(collect, nack.ErrorDetail)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Third response is valid and should be ACKed.
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "3", Nonce: "nonce-3", Resources: []*anypb.Any{cla}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		reqs := mocked.requests()
+		require.Len(collect, reqs, 4)
+
+		ack := reqs[3]
+		assert.Equal(collect, "3", ack.VersionInfo)
+		assert.Equal(collect, "nonce-3", ack.ResponseNonce)
+		assert.Nil(collect, ack.ErrorDetail)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestXDSClient_GetEndpoints_delta(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.delta = true
+
+	// First call to GetEndpoints starts watchEndpointsDelta.
+	_, err := client.GetEndpoints("test-service")
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "endpoints not yet discovered for test-service")
+
+	// Response adds the resource with a single endpoint.
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respondDelta(&discovery.DeltaDiscoveryResponse{
+		Resources: []*discovery.Resource{{Name: "test-service_cluster", Version: "1", Resource: cla}},
+		Nonce:     "nonce-1",
+	})
+
+	assertEndpoints(t, client, endpoints)
+
+	// Response for an unrelated resource is ignored.
+	other, err := makeCLA([]Endpoint{{Host: "5.6.7.8", Port: 1234, Weight: 1}})
+	require.NoError(t, err)
+	mocked.respondDelta(&discovery.DeltaDiscoveryResponse{
+		Resources: []*discovery.Resource{{Name: "other_cluster", Version: "1", Resource: other}},
+		Nonce:     "nonce-2",
+	})
+
+	// Response removes the resource.
+	mocked.respondDelta(&discovery.DeltaDiscoveryResponse{
+		RemovedResources: []string{"test-service_cluster"},
+		Nonce:            "nonce-3",
+	})
+
+	assertEndpoints(t, client, []Endpoint{})
+
+	reqs := mocked.deltaRequests()
+	require.GreaterOrEqual(t, len(reqs), 2)
+	assert.EqualExportedValues(t, &core.Node{Id: "test-client"}, reqs[0].Node)
+	assert.Equal(t, resource.EndpointType, reqs[0].TypeUrl)
+	assert.Equal(t, []string{"test-service_cluster"}, reqs[0].ResourceNamesSubscribe)
+	assert.Equal(t, "nonce-1", reqs[1].ResponseNonce)
+}
+
+func TestXDSClient_ListServices(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	// First call to ListServices subscribes to all clusters.
+	assert.Empty(t, client.ListServices())
+
+	clusters := makeClusters(t, "service-a_cluster", "service-b_cluster", "service-a_cluster")
+	mocked.respond(&discovery.DiscoveryResponse{TypeUrl: resource.ClusterType, VersionInfo: "1", Nonce: "nonce-1", Resources: clusters})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"service-a", "service-b"}, client.ListServices())
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// An invalid response is NACKed, retaining the discovered services.
+	notCluster, err := anypb.New(&endpoint.LbEndpoint{})
+	require.NoError(t, err)
+	mocked.respond(&discovery.DiscoveryResponse{TypeUrl: resource.ClusterType, VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{notCluster}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		reqs := mocked.requests()
+		require.Len(collect, reqs, 3)
+
+		assert.Equal(collect, resource.ClusterType, reqs[0].TypeUrl)
+		assert.Empty(collect, reqs[0].ResourceNames)
+
+		ack := reqs[1]
+		assert.Equal(collect, "1", ack.VersionInfo)
+		assert.Equal(collect, "nonce-1", ack.ResponseNonce)
+		assert.Nil(collect, ack.ErrorDetail)
+
+		nack := reqs[2]
+		assert.Equal(collect, "1", nack.VersionInfo)
+		assert.Equal(collect, "nonce-2", nack.ResponseNonce)
+		assert.NotNil(collect, nack.ErrorDetail)
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, []string{"service-a", "service-b"}, client.ListServices())
+}
+
+func TestXDSClient_ListServices_delta(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.delta = true
+
+	assert.Empty(t, client.ListServices())
+
+	clusters := makeClusters(t, "service-a_cluster", "service-b_cluster")
+	mocked.respondDelta(&discovery.DeltaDiscoveryResponse{
+		TypeUrl: resource.ClusterType,
+		Resources: []*discovery.Resource{
+			{Name: "service-a_cluster", Version: "1", Resource: clusters[0]},
+			{Name: "service-b_cluster", Version: "1", Resource: clusters[1]},
+		},
+		Nonce: "nonce-1",
+	})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"service-a", "service-b"}, client.ListServices())
+	}, 10*time.Second, 100*time.Millisecond)
+
+	mocked.respondDelta(&discovery.DeltaDiscoveryResponse{
+		TypeUrl:          resource.ClusterType,
+		RemovedResources: []string{"service-a_cluster"},
+		Nonce:            "nonce-2",
+	})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		assert.Equal(collect, []string{"service-b"}, client.ListServices())
+	}, 10*time.Second, 100*time.Millisecond)
+
+	reqs := mocked.deltaRequests()
+	require.GreaterOrEqual(t, len(reqs), 2)
+	assert.Equal(t, resource.ClusterType, reqs[0].TypeUrl)
+	assert.Equal(t, []string{"*"}, reqs[0].ResourceNamesSubscribe)
+	assert.Equal(t, "nonce-1", reqs[1].ResponseNonce)
+}
+
+// makeClusters returns a Cluster for each name, encoded as an anypb.Any.
+func makeClusters(t *testing.T, names ...string) []*anypb.Any {
+	clusters := make([]*anypb.Any, 0, len(names))
+	for _, name := range names {
+		cl, err := anypb.New(&cluster.Cluster{Name: name})
+		require.NoError(t, err)
+		clusters = append(clusters, cl)
+	}
+	return clusters
+}
+
+func TestXDSClient_GetEndpoints_metrics(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	recorder := &fakeRecorder{endpoints: make(map[string]int)}
+	client.metrics = recorder
+
+	_, err := client.GetEndpoints("test-service")
+	require.Error(t, err)
+
+	// First response is valid.
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}, {Host: "1.2.3.5", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+
+	assertEndpoints(t, client, endpoints)
+
+	// Second response cannot be decoded.
+	notCLA, err := anypb.New(&endpoint.LbEndpoint{})
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{notCLA}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		assert.Equal(collect, 2, recorder.responses)
+		assert.Equal(collect, 1, recorder.decodeFailures)
+		assert.Equal(collect, map[string]int{"test-service": 2}, recorder.endpoints)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestXDSClient_Watch(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	var mu sync.Mutex
+	var updates [][]Endpoint
+	cancel := client.Watch("test-service", func(endpoints []Endpoint) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, endpoints)
+	})
+
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "1", Nonce: "nonce-1", Resources: []*anypb.Any{cla}})
+
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(collect, [][]Endpoint{endpoints}, updates)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// A new watch receives the current endpoints immediately.
+	var got []Endpoint
+	cancel2 := client.Watch("test-service", func(endpoints []Endpoint) {
+		got = endpoints
+	})
+	defer cancel2()
+	assert.Equal(t, endpoints, got)
+
+	// A cancelled watch receives no further updates.
+	cancel()
+
+	endpoints2 := []Endpoint{{Host: "5.6.7.8", Port: 4321, Weight: 42}}
+	cla2, err := makeCLA(endpoints2)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{VersionInfo: "2", Nonce: "nonce-2", Resources: []*anypb.Any{cla2}})
+
+	assertEndpoints(t, client, endpoints2)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, [][]Endpoint{endpoints}, updates)
+}
+
+func TestXDSClient_evictIdle(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.subscriptionTTL = time.Minute
+	var evicted []string
+	client.OnEvict(func(service string) { evicted = append(evicted, service) })
+
+	_, err := client.GetEndpoints("idle-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+	cancel := client.Watch("watched-service", func([]Endpoint) {})
+	defer cancel()
+
+	client.storeEndpoints("idle-service", []Endpoint{{Host: "1.2.3.4", Port: 4321}})
+	assert.Equal(t, []string{"idle-service_cluster", "watched-service_cluster"}, client.resourceNames())
+
+	// Services requested within the TTL are retained.
+	client.evictIdle(time.Now())
+	assert.Equal(t, []string{"idle-service_cluster", "watched-service_cluster"}, client.resourceNames())
+	assert.Empty(t, evicted)
+
+	// Idle services are evicted, unless watched.
+	client.evictIdle(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, []string{"watched-service_cluster"}, client.resourceNames())
+	_, ok := client.endpoints.Load("idle-service")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"idle-service"}, evicted)
+
+	// The watch requests the remaining resources.
+	assert.Eventually(t, func() bool {
+		reqs := mocked.requests()
+		return len(reqs) > 0 && slices.Equal([]string{"watched-service_cluster"}, reqs[len(reqs)-1].ResourceNames)
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestEvictInterval(t *testing.T) {
+	assert.Equal(t, 30*time.Second, evictInterval(time.Minute))
+	// Short TTLs do not tick too frequently, or panic when halved to zero.
+	assert.Equal(t, minEvictInterval, evictInterval(time.Millisecond))
+	assert.Equal(t, minEvictInterval, evictInterval(time.Nanosecond))
+}
+
+func TestXDSClient_GetEndpoints_initialFetchTimeout(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+	client.initialFetchTimeout = 100 * time.Millisecond
+
+	_, err := client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+
+	// The server does not respond, so the service is treated as having no endpoints.
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		_, err := client.GetEndpoints("test-service")
+		assert.ErrorIs(collect, err, ErrNoEndpoints)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Endpoints received later replace the empty endpoints.
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla}})
+	assertEndpoints(t, client, endpoints)
+}
+
+func TestXDSClient_initialFetchTimeout_afterClose(t *testing.T) {
+	client, lis, _ := setupBufconn(t)
+	defer lis.Close()
+	client.initialFetchTimeout = 100 * time.Millisecond
+
+	var called atomic.Bool
+	cancel := client.Watch("test-service", func([]Endpoint) { called.Store(true) })
+	defer cancel()
+	require.NoError(t, client.Close())
+
+	// The timeout does not mark the service as having no endpoints once the
+	// client is closed.
+	assert.Never(t, func() bool {
+		_, ok := client.endpoints.Load("test-service")
+		return ok || called.Load()
+	}, 300*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestXDSClient_initialFetchTimeout_evicted(t *testing.T) {
+	client, lis, _ := setupBufconn(t)
+	defer lis.Close()
+	client.initialFetchTimeout = time.Minute
+	client.subscriptionTTL = time.Minute
+
+	_, err := client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+	client.subsMu.Lock()
+	evicted := client.fetchTimers["test-service"]
+	client.subsMu.Unlock()
+	require.NotNil(t, evicted)
+
+	// The timer is stopped when the subscription is evicted.
+	client.evictIdle(time.Now().Add(2 * time.Minute))
+	assert.False(t, evicted.Stop())
+
+	// A timer of an evicted subscription that fires regardless does not time
+	// out a later subscription to the service.
+	_, err = client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+	client.initialFetchTimedOut("test-service", evicted)
+	_, err = client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+}
+
+func TestXDSClient_WaitForEndpoints(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	endpoints := []Endpoint{{Host: "1.2.3.4", Port: 4321, Weight: 42}}
+	cla, err := makeCLA(endpoints)
+	require.NoError(t, err)
+
+	go func() {
+		// Respond once the client has subscribed.
+		assert.Eventually(t, func() bool { return len(mocked.requests()) > 0 }, 10*time.Second, 10*time.Millisecond)
+		mocked.respond(&discovery.DiscoveryResponse{Resources: []*anypb.Any{cla}})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	got, err := client.WaitForEndpoints(ctx, "test-service")
+	require.NoError(t, err)
+	assert.Equal(t, endpoints, got)
+}
+
+func TestXDSClient_WaitForEndpoints_timeout(t *testing.T) {
+	client, lis, _ := setupBufconn(t)
+	defer lis.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := client.WaitForEndpoints(ctx, "test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+}
+
+func TestValidateServiceName(t *testing.T) {
+	for _, service := range []string{"test-service", "test.ns.svc.cluster.local", "test_service:8080"} {
+		assert.NoError(t, ValidateServiceName(service), service)
+	}
+	for _, service := range []string{"", "test service", " test-service", "test-service\n", "test\tservice", "test\x00service", "test\u00a0service", "test\xffservice"} {
+		assert.ErrorIs(t, ValidateServiceName(service), ErrInvalidServiceName, service)
+	}
+}
+
+func TestXDSClient_GetEndpoints_invalidServiceName(t *testing.T) {
+	client, lis, mocked := setupBufconn(t)
+	defer lis.Close()
+
+	_, err := client.GetEndpoints("test service")
+	assert.ErrorIs(t, err, ErrInvalidServiceName)
+	assert.EqualError(t, err, `invalid service name "test service": contains whitespace or control character at offset 4`)
+
+	_, err = client.WaitForEndpoints(context.Background(), "test service")
+	assert.ErrorIs(t, err, ErrInvalidServiceName)
+
+	cancel := client.Watch("test service", func([]Endpoint) {
+		t.Error("unexpected endpoints for invalid service")
+	})
+	cancel()
+
+	// The invalid service is not subscribed to.
+	assert.Empty(t, client.resourceNames())
+	_, err = client.GetEndpoints("test-service")
+	assert.ErrorIs(t, err, ErrNotYetDiscovered)
+	require.Eventually(t, func() bool { return len(mocked.requests()) > 0 }, time.Second, 10*time.Millisecond)
+	for _, req := range mocked.requests() {
+		assert.Equal(t, []string{"test-service_cluster"}, req.ResourceNames)
+	}
+}
+
 // makeCLA returns a ClusterLoadAssignment for a slice of Endpoint, encoded as an anypb.Any.
 func makeCLA(endpoints []Endpoint) (*anypb.Any, error) {
+	return makeNamedCLA("", endpoints)
+}
+
+// makeNamedCLA returns a ClusterLoadAssignment for a cluster and a slice of Endpoint, encoded as an anypb.Any.
+func makeNamedCLA(clusterName string, endpoints []Endpoint) (*anypb.Any, error) {
 	localityEps := []*endpoint.LocalityLbEndpoints{}
 	for _, ep := range endpoints {
+		var metadata *core.Metadata
+		if ep.SPIFFEID != "" {
+			fields, err := structpb.NewStruct(map[string]any{spiffeIDMetadataKey: ep.SPIFFEID})
+			if err != nil {
+				return nil, err
+			}
+			metadata = &core.Metadata{FilterMetadata: map[string]*structpb.Struct{metadataNamespace: fields}}
+		}
 		localityEps = append(localityEps, &endpoint.LocalityLbEndpoints{
 			LbEndpoints: []*endpoint.LbEndpoint{
 				{
 					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 						Endpoint: &endpoint.Endpoint{
+							Hostname: ep.ServerName,
 							Address: &core.Address{
 								Address: &core.Address_SocketAddress{
 									SocketAddress: &core.SocketAddress{
@@ -242,41 +1376,56 @@ func makeCLA(endpoints []Endpoint) (*anypb.Any, error) {
 					LoadBalancingWeight: &wrapperspb.UInt32Value{
 						Value: uint32(ep.Weight),
 					},
+					Metadata:     metadata,
+					HealthStatus: ep.HealthStatus,
 				},
 			},
 		})
 	}
-	return anypb.New(&endpoint.ClusterLoadAssignment{Endpoints: localityEps})
+	return anypb.New(&endpoint.ClusterLoadAssignment{ClusterName: clusterName, Endpoints: localityEps})
 }
 
 // assertEndpoints asserts that the client eventually returns the specified endpoints from GetEndpoints.
 func assertEndpoints(t *testing.T, client *XDSClient, endpoints []Endpoint) {
 	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
 		got, err := client.GetEndpoints("test-service")
-		require.NoError(collect, err)
+		if len(endpoints) == 0 {
+			require.ErrorIs(collect, err, ErrNoEndpoints)
+		} else {
+			require.NoError(collect, err)
+		}
 		assert.Equal(collect, endpoints, got)
 	}, 10*time.Second, 100*time.Millisecond)
 }
 
 type MockAggregatedDiscoveryService struct {
 	discovery.UnimplementedAggregatedDiscoveryServiceServer
-	t      *testing.T
-	reqs   []*discovery.DiscoveryRequest
-	respCh chan *discovery.DiscoveryResponse
-	errCh  chan error
+	t           *testing.T
+	mu          sync.Mutex
+	streams     int
+	reqs        []*discovery.DiscoveryRequest
+	respCh      chan *discovery.DiscoveryResponse
+	deltaReqs   []*discovery.DeltaDiscoveryRequest
+	deltaRespCh chan *discovery.DeltaDiscoveryResponse
+	errCh       chan error
 }
 
 func newMockAggregatedDiscoveryService(t *testing.T) *MockAggregatedDiscoveryService {
 	return &MockAggregatedDiscoveryService{
-		t:      t,
-		respCh: make(chan *discovery.DiscoveryResponse),
-		errCh:  make(chan error),
+		t:           t,
+		respCh:      make(chan *discovery.DiscoveryResponse),
+		deltaRespCh: make(chan *discovery.DeltaDiscoveryResponse),
+		errCh:       make(chan error),
 	}
 }
 
 func (m *MockAggregatedDiscoveryService) StreamAggregatedResources(
 	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer,
 ) error {
+	m.mu.Lock()
+	m.streams++
+	m.mu.Unlock()
+
 	for {
 		// Wait for a DiscoveryRequest
 		req, err := stream.Recv()
@@ -284,7 +1433,9 @@ func (m *MockAggregatedDiscoveryService) StreamAggregatedResources(
 			return err
 		}
 
+		m.mu.Lock()
 		m.reqs = append(m.reqs, req)
+		m.mu.Unlock()
 
 		// Wait for the test harness to send us either a response or error to return to the client.
 		select {
@@ -301,6 +1452,65 @@ func (m *MockAggregatedDiscoveryService) StreamAggregatedResources(
 	}
 }
 
+func (m *MockAggregatedDiscoveryService) DeltaAggregatedResources(
+	stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer,
+) error {
+	for {
+		// Wait for a DeltaDiscoveryRequest
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		m.deltaReqs = append(m.deltaReqs, req)
+		m.mu.Unlock()
+
+		// Wait for the test harness to send us either a response or error to return to the client.
+		select {
+		case resp, ok := <-m.deltaRespCh:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case err := <-m.errCh:
+			return err
+		}
+	}
+}
+
+// streamCount returns the number of SotW streams opened so far.
+func (m *MockAggregatedDiscoveryService) streamCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams
+}
+
+// requests returns the DiscoveryRequests received so far.
+func (m *MockAggregatedDiscoveryService) requests() []*discovery.DiscoveryRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*discovery.DiscoveryRequest{}, m.reqs...)
+}
+
+// deltaRequests returns the DeltaDiscoveryRequests received so far.
+func (m *MockAggregatedDiscoveryService) deltaRequests() []*discovery.DeltaDiscoveryRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*discovery.DeltaDiscoveryRequest{}, m.deltaReqs...)
+}
+
+// respondDelta sends a response on deltaRespCh for the server to send to the client.
+func (m *MockAggregatedDiscoveryService) respondDelta(resp *discovery.DeltaDiscoveryResponse) {
+	select {
+	case m.deltaRespCh <- resp:
+	case <-time.After(5 * time.Second):
+		m.t.Fatal("Timed out waiting to send to delta response channel")
+	}
+}
+
 // respond sends a response on respCh for the server to send to the client.
 func (m *MockAggregatedDiscoveryService) respond(resp *discovery.DiscoveryResponse) {
 	select {
@@ -340,13 +1550,11 @@ func setupBufconn(t *testing.T, opts ...grpc.DialOption) (*XDSClient, *bufconn.L
 		NodeID:    "test-client",
 	}
 
-	if len(opts) == 0 {
-		opts = []grpc.DialOption{grpc.WithContextDialer(
-			func(context.Context, string) (net.Conn, error) {
-				return lis.Dial()
-			},
-		)}
-	}
+	opts = append([]grpc.DialOption{grpc.WithContextDialer(
+		func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		},
+	)}, opts...)
 	client, err := NewXDSClient(cfg, opts...)
 	require.NoError(t, err)
 
@@ -360,3 +1568,31 @@ func makeLogger() *slog.Logger {
 	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
 	return slog.New(slog.NewTextHandler(os.Stderr, opts))
 }
+
+// fakeRecorder is a metrics.Recorder that records xDS metrics.
+type fakeRecorder struct {
+	metrics.NoopRecorder
+
+	mu             sync.Mutex
+	responses      int
+	decodeFailures int
+	endpoints      map[string]int
+}
+
+func (r *fakeRecorder) XDSResponseReceived() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses++
+}
+
+func (r *fakeRecorder) XDSDecodeFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decodeFailures++
+}
+
+func (r *fakeRecorder) XDSEndpoints(service string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints[service] = count
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package xds
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ListServices returns the sorted names of the services whose clusters have
+// been discovered. The first call subscribes to all clusters (CDS) on the ADS
+// stream, so the catalog is empty until the xDS server has responded.
+func (c *XDSClient) ListServices() []string {
+	if !c.watchClusters.Swap(true) {
+		c.notifySubscriptions()
+	}
+	c.startWatch()
+
+	c.servicesMu.Lock()
+	defer c.servicesMu.Unlock()
+
+	return slices.Sorted(maps.Keys(c.services))
+}
+
+// applyClusters updates the discovered services from a CDS response, and
+// updates req to ACK or NACK it.
+func (c *XDSClient) applyClusters(logger *slog.Logger, req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	req.ResponseNonce = resp.Nonce
+
+	services, err := clusterServices(resp.Resources)
+	if err != nil {
+		logger.Error("Failed to decode xDS cluster discovery response", "version", resp.VersionInfo, "error", err)
+		c.metrics.XDSDecodeFailure()
+		req.ErrorDetail = nackStatus(err)
+		return
+	}
+
+	logger.Debug("xDS services updated", "services", len(services))
+	c.setServices(services)
+
+	req.VersionInfo = resp.VersionInfo
+	req.ErrorDetail = nil
+}
+
+// applyClustersDelta updates clusters and the discovered services from a delta
+// CDS response, returning the request that ACKs or NACKs it.
+func (c *XDSClient) applyClustersDelta(logger *slog.Logger, clusters map[string]string, resp *discovery.DeltaDiscoveryResponse) *discovery.DeltaDiscoveryRequest {
+	req := &discovery.DeltaDiscoveryRequest{
+		TypeUrl:       resource.ClusterType,
+		ResponseNonce: resp.Nonce,
+	}
+
+	for _, res := range resp.Resources {
+		service, err := clusterService(res.Resource)
+		if err != nil {
+			logger.Error("Failed to decode xDS cluster", "resource", res.Name, "version", res.Version, "error", err)
+			c.metrics.XDSDecodeFailure()
+			req.ErrorDetail = nackStatus(err)
+			continue
+		}
+		clusters[res.Name] = service
+	}
+	for _, name := range resp.RemovedResources {
+		delete(clusters, name)
+	}
+
+	services := make(map[string]struct{}, len(clusters))
+	for _, service := range clusters {
+		services[service] = struct{}{}
+	}
+	logger.Debug("xDS services updated", "services", len(services))
+	c.setServices(services)
+
+	return req
+}
+
+// setServices replaces the set of discovered services.
+func (c *XDSClient) setServices(services map[string]struct{}) {
+	c.servicesMu.Lock()
+	defer c.servicesMu.Unlock()
+
+	c.services = services
+}
+
+// clusterService decodes a Cluster resource, returning the name of its service.
+func clusterService(res *anypb.Any) (string, error) {
+	var cl cluster.Cluster
+	if err := res.UnmarshalTo(&cl); err != nil {
+		return "", fmt.Errorf("failed to unmarshal Cluster: %w", err)
+	}
+	return serviceForResource(cl.Name), nil
+}
+
+// clusterServices decodes Cluster resources, returning the set of their
+// services. An error is returned if any resource cannot be decoded.
+func clusterServices(resources []*anypb.Any) (map[string]struct{}, error) {
+	services := make(map[string]struct{}, len(resources))
+	for _, res := range resources {
+		service, err := clusterService(res)
+		if err != nil {
+			return nil, err
+		}
+		services[service] = struct{}{}
+	}
+	return services, nil
+}
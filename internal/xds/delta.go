@@ -0,0 +1,215 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// watchEndpointsDelta watches endpoints for all subscribed services using a delta (incremental) ADS stream.
+// The endpoints map is updated as resources are added, updated or removed.
+// Resources are subscribed to and unsubscribed from as the set of subscribed services changes.
+// versions holds the last applied version of each resource, which are sent as
+// the initial resource versions when the stream is re-established.
+// watchEndpointsDelta returns if the stream is closed or any send/receive request fails.
+// It returns a bool indicating whether the backoff in the caller should be reset, as well as an error.
+func (c *XDSClient) watchEndpointsDelta(ctx context.Context, logger *slog.Logger, versions map[string]string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger.Debug("Connecting to xDS server using delta ADS")
+	stream, err := c.client.DeltaAggregatedResources(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to create delta xDS stream: %w", err)
+	}
+
+	defer func() {
+		if err := stream.CloseSend(); err != nil {
+			logger.Error("Error closing delta xDS stream", "error", err)
+		}
+	}()
+
+	recvCh := receive(ctx, stream.Recv)
+
+	// subscribed is the set of resource names subscribed to on this stream.
+	subscribed := make(map[string]struct{})
+	subscribe, _ := diffSubscriptions(subscribed, c.resourceNames())
+	for _, name := range subscribe {
+		subscribed[name] = struct{}{}
+	}
+
+	req := &discovery.DeltaDiscoveryRequest{
+		Node:                   c.node,
+		TypeUrl:                c.typeURL,
+		ResourceNamesSubscribe: subscribe,
+	}
+	for _, name := range subscribe {
+		if version, ok := versions[name]; ok {
+			if req.InitialResourceVersions == nil {
+				req.InitialResourceVersions = make(map[string]string)
+			}
+			req.InitialResourceVersions[name] = version
+		}
+	}
+
+	// clustersReq is the next CDS request, once the service catalog is
+	// watched, and clusters maps the names of the discovered clusters to
+	// their services.
+	var clustersReq *discovery.DeltaDiscoveryRequest
+	clusters := make(map[string]string)
+
+	// resetBackoff tracks whether we have seen a valid response, and should reset the backoff.
+	var resetBackoff bool
+	// send tracks whether req should be sent, and sendClusters whether clustersReq should be.
+	send := len(subscribe) > 0
+	var sendClusters bool
+	for {
+		if clustersReq == nil && c.watchClusters.Load() {
+			// Subscribe to all clusters.
+			clustersReq = &discovery.DeltaDiscoveryRequest{
+				Node:                   c.node,
+				TypeUrl:                resource.ClusterType,
+				ResourceNamesSubscribe: []string{"*"},
+			}
+			sendClusters = true
+		}
+
+		if send {
+			if err := stream.Send(req); err != nil {
+				return resetBackoff, fmt.Errorf("failed to send delta xDS discovery request: %w", err)
+			}
+
+			logger.Debug("Sent delta xDS discovery request")
+		}
+
+		if sendClusters {
+			if err := stream.Send(clustersReq); err != nil {
+				return resetBackoff, fmt.Errorf("failed to send delta xDS cluster discovery request: %w", err)
+			}
+
+			logger.Debug("Sent delta xDS cluster discovery request")
+			sendClusters = false
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("Delta xDS watch cancelled")
+			return resetBackoff, nil
+		case <-c.subsCh:
+			// Subscriptions have changed, so subscribe to or unsubscribe from the changed resources.
+			subscribe, unsubscribe := diffSubscriptions(subscribed, c.resourceNames())
+			for _, name := range subscribe {
+				subscribed[name] = struct{}{}
+			}
+			for _, name := range unsubscribe {
+				delete(subscribed, name)
+				delete(versions, name)
+			}
+
+			send = len(subscribe) > 0 || len(unsubscribe) > 0
+			req = &discovery.DeltaDiscoveryRequest{
+				TypeUrl:                  c.typeURL,
+				ResourceNamesSubscribe:   subscribe,
+				ResourceNamesUnsubscribe: unsubscribe,
+			}
+		case r := <-recvCh:
+			resp, err := r.resp, r.err
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					logger.Debug("Delta xDS watch stream ended")
+					resetBackoff = true
+				} else {
+					err = fmt.Errorf("failed to receive delta xDS discovery response: %w", err)
+				}
+				return resetBackoff, err
+			}
+
+			resetBackoff = true
+			c.setConnected(true)
+			c.metrics.XDSResponseReceived()
+
+			if resp.TypeUrl == resource.ClusterType {
+				send = false
+				if clustersReq != nil {
+					sendClusters = true
+					clustersReq = c.applyClustersDelta(logger, clusters, resp)
+				}
+				continue
+			}
+
+			send = true
+
+			// The next request ACKs (or NACKs) the response. Subscriptions are retained by the server.
+			req = &discovery.DeltaDiscoveryRequest{
+				TypeUrl:       c.typeURL,
+				ResponseNonce: resp.Nonce,
+			}
+
+			for _, res := range resp.Resources {
+				if _, ok := subscribed[res.Name]; !ok {
+					continue
+				}
+
+				_, endpoints, err := c.decode(res.Resource)
+				if err != nil {
+					logger.Error("Failed to decode xDS resource", "resource", res.Name, "version", res.Version, "error", err)
+					c.metrics.XDSDecodeFailure()
+					c.decodeFailed(serviceForResource(res.Name), res.Version, err)
+					// NACK the response.
+					req.ErrorDetail = nackStatus(err)
+					continue
+				}
+
+				service := serviceForResource(res.Name)
+				if err := c.checkMaxEndpoints(map[string][]Endpoint{service: endpoints}); err != nil {
+					logger.Error("Rejected xDS resource", "resource", res.Name, "version", res.Version, "error", err)
+					c.metrics.XDSDecodeFailure()
+					c.decodeFailed(service, res.Version, err)
+					// NACK the response.
+					req.ErrorDetail = nackStatus(err)
+					continue
+				}
+				logger.Debug("xDS endpoints updated", "service", service, slog.Any("endpoints", endpoints))
+				c.storeEndpoints(service, endpoints)
+				versions[res.Name] = res.Version
+			}
+
+			for _, name := range resp.RemovedResources {
+				if _, ok := subscribed[name]; !ok {
+					continue
+				}
+
+				service := serviceForResource(name)
+				logger.Debug("xDS endpoints removed", "service", service)
+				c.storeEndpoints(service, []Endpoint{})
+				delete(versions, name)
+			}
+		}
+	}
+}
+
+// diffSubscriptions returns the resource names in names that are not in
+// subscribed, and the resource names in subscribed that are not in names.
+func diffSubscriptions(subscribed map[string]struct{}, names []string) (subscribe, unsubscribe []string) {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+		if _, ok := subscribed[name]; !ok {
+			subscribe = append(subscribe, name)
+		}
+	}
+	for name := range subscribed {
+		if _, ok := wanted[name]; !ok {
+			unsubscribe = append(unsubscribe, name)
+		}
+	}
+	return subscribe, unsubscribe
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package xdsconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/internal/backoff"
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc"
+)
+
+// Environment variables used to configure xDS when the corresponding options
+// are not set.
+const (
+	EnabledEnvVar   = "EXPERIMENTAL_ENABLE_XDS"
+	ServerURIEnvVar = "EXPERIMENTAL_XDS_SERVER_URI"
+	NodeIDEnvVar    = "EXPERIMENTAL_XDS_NODE_ID"
+)
+
+// Config is the xDS configuration of a client, which is set by the client's
+// options and shared by the HTTP and gRPC clients.
+type Config struct {
+	// ServerURI is an optional URI of an xDS server to use when resolving addresses.
+	ServerURI string
+
+	// Enabled optionally sets whether xDS is enabled explicitly, rather than
+	// whenever a server URI is set.
+	Enabled *bool
+
+	// Fallback falls back to not using xDS if xDS cannot be configured,
+	// rather than failing.
+	Fallback bool
+
+	// NodeID is an optional xDS node ID to use when resolving addresses. It
+	// defaults to the workload's SPIFFE ID.
+	NodeID string
+
+	// Node is an optional template for the xDS node, e.g. to set its cluster,
+	// locality and metadata.
+	Node *core.Node
+
+	// DiscoveryTimeout is how long to wait for the endpoints of a service to
+	// be discovered via xDS when it is first dialed.
+	DiscoveryTimeout time.Duration
+
+	// InitialFetchTimeout is how long to wait for the endpoints of a service
+	// before treating it as having none.
+	InitialFetchTimeout time.Duration
+
+	// BackoffInitialDelay and BackoffMaxDelay optionally override the backoff
+	// between xDS stream retries.
+	BackoffInitialDelay time.Duration
+	BackoffMaxDelay     time.Duration
+	// BackoffStrategy optionally overrides how the backoff grows.
+	BackoffStrategy backoff.Strategy
+
+	// MaxEndpoints and MaxRecvMsgSize optionally cap the number of endpoints
+	// accepted for a service and the size of xDS responses.
+	MaxEndpoints   int
+	MaxRecvMsgSize int
+
+	// DialOptions are optional extra options for dialing the xDS server.
+	DialOptions []grpc.DialOption
+
+	// MinReconnectInterval is the minimum time between xDS streams.
+	MinReconnectInterval time.Duration
+
+	// DropUnhealthy drops endpoints that are not healthy.
+	DropUnhealthy bool
+
+	// DuplicateWeight determines the weight of duplicate endpoints.
+	DuplicateWeight xds.DuplicateWeight
+
+	// SubscriptionTTL is how long a service may go unrequested before its xDS
+	// subscription is evicted.
+	SubscriptionTTL time.Duration
+
+	// EndpointTTL optionally bounds how long cached endpoints are used while
+	// the xDS stream is down.
+	EndpointTTL time.Duration
+}
+
+// FromEnv sets any configuration not provided by options from the
+// environment.
+func (c *Config) FromEnv() error {
+	if c.Enabled == nil {
+		if v := os.Getenv(EnabledEnvVar); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", EnabledEnvVar, err)
+			}
+			c.Enabled = &enabled
+		}
+	}
+	if c.ServerURI == "" {
+		c.ServerURI = os.Getenv(ServerURIEnvVar)
+	}
+	if c.NodeID == "" {
+		c.NodeID = os.Getenv(NodeIDEnvVar)
+	}
+	return nil
+}
+
+// IsEnabled returns whether xDS is enabled, which it is by default if a server
+// URI is set.
+func (c *Config) IsEnabled() bool {
+	if c.Enabled != nil {
+		return *c.Enabled
+	}
+	return c.ServerURI != ""
+}
+
+// NewClient returns an xDS client for the configuration, or nil if xDS is not
+// enabled. If xDS is enabled but cannot be configured, e.g. because no server
+// URI is set, an error is returned, unless Fallback is set, in which case a
+// warning is logged and nil is returned. SPIRE must be ready, as the node ID
+// defaults to the workload's SPIFFE ID.
+func (c *Config) NewClient(spire *spirehelper.SPIREHelper) (*xds.XDSClient, error) {
+	if !c.IsEnabled() {
+		return nil, nil
+	}
+
+	client, err := c.newClient(spire)
+	if err != nil {
+		if !c.Fallback {
+			return nil, err
+		}
+		spire.Logger.Warn("Failed to configure xDS, falling back to not using xDS", "error", err)
+		return nil, nil
+	}
+	return client, nil
+}
+
+func (c *Config) newClient(spire *spirehelper.SPIREHelper) (*xds.XDSClient, error) {
+	if c.ServerURI == "" {
+		return nil, errors.New("xDS is enabled but no xDS server URI is set")
+	}
+
+	// Default the node ID to the workload's SPIFFE ID, so that the
+	// subscription is attributable to the workload.
+	nodeID := c.NodeID
+	if nodeID == "" {
+		identity, err := spire.GetIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get xDS node ID: %w", err)
+		}
+		nodeID = identity.String()
+	}
+
+	client, err := xds.NewXDSClient(xds.XDSClientConfig{
+		Logger:               spire.Logger,
+		ServerURI:            c.ServerURI,
+		NodeID:               nodeID,
+		Node:                 c.Node,
+		Metrics:              spire.Metrics,
+		SubscriptionTTL:      c.SubscriptionTTL,
+		EndpointTTL:          c.EndpointTTL,
+		DropUnhealthy:        c.DropUnhealthy,
+		DuplicateWeight:      c.DuplicateWeight,
+		MinReconnectInterval: c.MinReconnectInterval,
+		InitialFetchTimeout:  c.InitialFetchTimeout,
+		BackoffInitialDelay:  c.BackoffInitialDelay,
+		BackoffMaxDelay:      c.BackoffMaxDelay,
+		BackoffStrategy:      c.BackoffStrategy,
+		MaxEndpoints:         c.MaxEndpoints,
+		MaxRecvMsgSize:       c.MaxRecvMsgSize,
+	}, c.DialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create xDS client: %w", err)
+	}
+	return client, nil
+}
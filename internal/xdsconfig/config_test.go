@@ -0,0 +1,97 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package xdsconfig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/internal/spirehelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_FromEnv(t *testing.T) {
+	t.Setenv(ServerURIEnvVar, "env-server:18000")
+	t.Setenv(NodeIDEnvVar, "env-node")
+
+	c := &Config{}
+	require.NoError(t, c.FromEnv())
+	assert.Equal(t, "env-server:18000", c.ServerURI)
+	assert.Equal(t, "env-node", c.NodeID)
+
+	// Options take precedence over the environment.
+	c = &Config{ServerURI: "option-server:18000", NodeID: "option-node"}
+	require.NoError(t, c.FromEnv())
+	assert.Equal(t, "option-server:18000", c.ServerURI)
+	assert.Equal(t, "option-node", c.NodeID)
+}
+
+func TestConfig_FromEnv_enabled(t *testing.T) {
+	t.Setenv(EnabledEnvVar, "true")
+
+	c := &Config{}
+	require.NoError(t, c.FromEnv())
+	require.NotNil(t, c.Enabled)
+	assert.True(t, *c.Enabled)
+
+	// Options take precedence over the environment.
+	disabled := false
+	c = &Config{Enabled: &disabled}
+	require.NoError(t, c.FromEnv())
+	assert.False(t, *c.Enabled)
+
+	t.Setenv(EnabledEnvVar, "maybe")
+	c = &Config{}
+	assert.ErrorContains(t, c.FromEnv(), "invalid EXPERIMENTAL_ENABLE_XDS")
+}
+
+func TestConfig_NewClient(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name       string
+		config     Config
+		wantClient bool
+		wantErr    string
+	}{
+		{
+			name:   "no server URI",
+			config: Config{},
+		},
+		{
+			name:    "enabled without server URI",
+			config:  Config{Enabled: &enabled},
+			wantErr: "xDS is enabled but no xDS server URI is set",
+		},
+		{
+			name:   "enabled without server URI with fallback",
+			config: Config{Enabled: &enabled, Fallback: true},
+		},
+		{
+			name:   "disabled with server URI",
+			config: Config{Enabled: &disabled, ServerURI: "passthrough:///xds-server"},
+		},
+		{
+			name:       "server URI",
+			config:     Config{ServerURI: "passthrough:///xds-server", NodeID: "test-node"},
+			wantClient: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := tt.config.NewClient(spirehelper.NewSPIREHelper(context.Background()))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if !tt.wantClient {
+				assert.Nil(t, client)
+				return
+			}
+			require.NotNil(t, client)
+			assert.NoError(t, client.Close())
+		})
+	}
+}
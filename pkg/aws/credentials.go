@@ -0,0 +1,245 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package aws provides AWS credentials for workloads by exchanging JWT-SVIDs
+// using AWS STS AssumeRoleWithWebIdentity.
+//
+// A CredentialRetriever is an aws.CredentialsProvider of the AWS SDK for Go
+// v2, so is used as the credentials of an aws.Config:
+//
+//	cfg.Credentials = cofideaws.NewCredentialRetriever(jwtSource, roleARN)
+//
+// The package is a separate module, so that workloads that do not use AWS do
+// not depend on the AWS SDK.
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+const (
+	// DefaultAudience is the default audience of the JWT-SVIDs exchanged for
+	// credentials, which must match the audience of the IAM OIDC provider.
+	DefaultAudience = "sts.amazonaws.com"
+
+	defaultSTSEndpoint   = "https://sts.amazonaws.com"
+	defaultSessionName   = "cofide-sdk-go"
+	defaultRefreshWindow = 5 * time.Minute
+
+	stsAPIVersion = "2011-06-15"
+
+	// CredentialsSource is the Source of the credentials retrieved by a
+	// CredentialRetriever.
+	CredentialsSource = "CofideJWTSVIDCredentials"
+)
+
+// CredentialRetriever retrieves temporary AWS credentials for an IAM role by
+// exchanging a JWT-SVID using AWS STS AssumeRoleWithWebIdentity. Credentials
+// are cached, and refreshed when they are within the refresh window of their
+// expiry.
+type CredentialRetriever struct {
+	source  jwtsvid.Source
+	roleARN string
+
+	audience      string
+	sessionName   string
+	stsEndpoint   string
+	duration      time.Duration
+	refreshWindow time.Duration
+	httpClient    *http.Client
+
+	mu    sync.Mutex
+	creds *aws.Credentials
+}
+
+var _ aws.CredentialsProvider = (*CredentialRetriever)(nil)
+
+type CredentialRetrieverOption func(*CredentialRetriever)
+
+// WithAudience sets the audience of the JWT-SVIDs exchanged for credentials.
+// By default DefaultAudience is used.
+func WithAudience(audience string) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		r.audience = audience
+	}
+}
+
+// WithSessionName sets the role session name of the credentials, which is
+// recorded in CloudTrail.
+func WithSessionName(sessionName string) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		r.sessionName = sessionName
+	}
+}
+
+// WithSTSEndpoint sets the URL of the STS endpoint, e.g. a regional endpoint.
+// By default the global endpoint is used.
+func WithSTSEndpoint(endpoint string) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		r.stsEndpoint = endpoint
+	}
+}
+
+// WithDuration sets the requested lifetime of the credentials. By default the
+// lifetime is the role's default session duration.
+func WithDuration(duration time.Duration) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		r.duration = duration
+	}
+}
+
+// WithRefreshWindow sets how long before their expiry credentials are
+// refreshed. By default credentials are refreshed 5 minutes before expiry.
+func WithRefreshWindow(window time.Duration) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		r.refreshWindow = window
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to call STS.
+func WithHTTPClient(client *http.Client) CredentialRetrieverOption {
+	return func(r *CredentialRetriever) {
+		if client != nil {
+			r.httpClient = client
+		}
+	}
+}
+
+// NewCredentialRetriever returns a CredentialRetriever that assumes the IAM
+// role roleARN using JWT-SVIDs from source, e.g. a workloadapi.JWTSource.
+func NewCredentialRetriever(source jwtsvid.Source, roleARN string, opts ...CredentialRetrieverOption) *CredentialRetriever {
+	r := &CredentialRetriever{
+		source:        source,
+		roleARN:       roleARN,
+		audience:      DefaultAudience,
+		sessionName:   defaultSessionName,
+		stsEndpoint:   defaultSTSEndpoint,
+		refreshWindow: defaultRefreshWindow,
+		httpClient:    http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Retrieve returns cached credentials, or retrieves new credentials if they
+// are within the refresh window of their expiry. Concurrent calls may each
+// retrieve new credentials, so the retriever may be wrapped in an
+// aws.CredentialsCache to share a single retrieval.
+func (r *CredentialRetriever) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	r.mu.Lock()
+	creds := r.creds
+	r.mu.Unlock()
+	if creds != nil && time.Until(creds.Expires) > r.refreshWindow {
+		return *creds, nil
+	}
+
+	svid, err := r.source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: r.audience})
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to fetch JWT-SVID: %w", err)
+	}
+
+	creds, err = r.assumeRole(ctx, svid.Marshal())
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	r.mu.Lock()
+	// Keep credentials retrieved concurrently that expire later.
+	if r.creds == nil || creds.Expires.After(r.creds.Expires) {
+		r.creds = creds
+	}
+	r.mu.Unlock()
+	return *creds, nil
+}
+
+// assumeRoleResponse is the response of AssumeRoleWithWebIdentity.
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// errorResponse is the response of STS for a failed request.
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// assumeRole calls AssumeRoleWithWebIdentity using token. The request does not
+// need to be signed.
+func (r *CredentialRetriever) assumeRole(ctx context.Context, token string) (*aws.Credentials, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {stsAPIVersion},
+		"RoleArn":          {r.roleARN},
+		"RoleSessionName":  {r.sessionName},
+		"WebIdentityToken": {token},
+	}
+	if r.duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(r.duration.Seconds())))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call STS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read STS response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if err := xml.Unmarshal(body, &errResp); err != nil || errResp.Code == "" {
+			return nil, fmt.Errorf("STS AssumeRoleWithWebIdentity failed with status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("STS AssumeRoleWithWebIdentity failed: %s: %s", errResp.Code, errResp.Message)
+	}
+
+	var assumeResp assumeRoleResponse
+	if err := xml.Unmarshal(body, &assumeResp); err != nil {
+		return nil, fmt.Errorf("failed to decode STS response: %w", err)
+	}
+
+	// Empty credentials would otherwise be cached, and fail every request.
+	if assumeResp.Credentials.AccessKeyID == "" || assumeResp.Credentials.SecretAccessKey == "" || assumeResp.Credentials.Expiration.IsZero() {
+		return nil, errors.New("STS AssumeRoleWithWebIdentity returned no credentials")
+	}
+
+	return &aws.Credentials{
+		AccessKeyID:     assumeResp.Credentials.AccessKeyID,
+		SecretAccessKey: assumeResp.Credentials.SecretAccessKey,
+		SessionToken:    assumeResp.Credentials.SessionToken,
+		Source:          CredentialsSource,
+		CanExpire:       true,
+		Expires:         assumeResp.Credentials.Expiration,
+	}, nil
+}
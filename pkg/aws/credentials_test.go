@@ -0,0 +1,180 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package aws
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJWTSource is a jwtsvid.Source that returns JWT-SVIDs for a fixed subject.
+type fakeJWTSource struct {
+	t *testing.T
+}
+
+func (s *fakeJWTSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	token := makeJWT(s.t, "spiffe://example.org/workload", params.Audience)
+	return jwtsvid.ParseInsecure(token, []string{params.Audience})
+}
+
+// makeJWT returns a JWT signed with a throwaway key.
+func makeJWT(t *testing.T, subject, audience string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT"})
+	require.NoError(t, err)
+	claims, err := json.Marshal(map[string]any{"sub": subject, "aud": audience, "exp": time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newSTSServer(t *testing.T, expiration time.Time) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRoleWithWebIdentity", r.PostForm.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/workload", r.PostForm.Get("RoleArn"))
+
+		svid, err := jwtsvid.ParseInsecure(r.PostForm.Get("WebIdentityToken"), []string{DefaultAudience})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, `<ErrorResponse><Error><Code>InvalidIdentityToken</Code><Message>%s</Message></Error></ErrorResponse>`, err)
+			return
+		}
+		assert.Equal(t, "spiffe://example.org/workload", svid.ID.String())
+
+		_, _ = fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, calls.Load(), expiration.UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestCredentialRetriever_Retrieve(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv, calls := newSTSServer(t, expiration)
+
+	r := NewCredentialRetriever(&fakeJWTSource{t: t}, "arn:aws:iam::123456789012:role/workload", WithSTSEndpoint(srv.URL))
+
+	creds, err := r.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIAEXAMPLE1", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.Equal(t, "token", creds.SessionToken)
+	assert.True(t, expiration.Equal(creds.Expires))
+	assert.True(t, creds.CanExpire)
+	assert.Equal(t, CredentialsSource, creds.Source)
+
+	// Credentials are cached until they are near expiry.
+	creds, err = r.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIAEXAMPLE1", creds.AccessKeyID)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCredentialRetriever_Retrieve_refresh(t *testing.T) {
+	// The credentials expire within the refresh window.
+	srv, calls := newSTSServer(t, time.Now().Add(time.Minute))
+
+	r := NewCredentialRetriever(&fakeJWTSource{t: t}, "arn:aws:iam::123456789012:role/workload", WithSTSEndpoint(srv.URL))
+
+	_, err := r.Retrieve(context.Background())
+	require.NoError(t, err)
+	creds, err := r.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIAEXAMPLE2", creds.AccessKeyID)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCredentialRetriever_Retrieve_error(t *testing.T) {
+	srv, _ := newSTSServer(t, time.Now().Add(time.Hour))
+
+	// STS rejects JWT-SVIDs with the wrong audience.
+	r := NewCredentialRetriever(&fakeJWTSource{t: t}, "arn:aws:iam::123456789012:role/workload", WithSTSEndpoint(srv.URL), WithAudience("other"))
+
+	_, err := r.Retrieve(context.Background())
+	assert.ErrorContains(t, err, "STS AssumeRoleWithWebIdentity failed: InvalidIdentityToken")
+}
+
+func TestCredentialRetriever_Retrieve_emptyCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer srv.Close()
+
+	r := NewCredentialRetriever(&fakeJWTSource{t: t}, "arn:aws:iam::123456789012:role/workload", WithSTSEndpoint(srv.URL))
+
+	_, err := r.Retrieve(context.Background())
+	assert.ErrorContains(t, err, "returned no credentials")
+	assert.Nil(t, r.creds)
+}
+
+func TestCredentialRetriever_Retrieve_unlockedDuringSTSCall(t *testing.T) {
+	srv, _ := newSTSServer(t, time.Now().Add(time.Hour))
+	called := make(chan struct{})
+	release := make(chan struct{})
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		close(called)
+		<-release
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	r := NewCredentialRetriever(&fakeJWTSource{t: t}, "arn:aws:iam::123456789012:role/workload", WithSTSEndpoint(srv.URL), WithHTTPClient(client))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Retrieve(context.Background())
+		errCh <- err
+	}()
+
+	// The retriever is not locked while STS is called.
+	<-called
+	require.True(t, r.mu.TryLock())
+	r.mu.Unlock()
+
+	close(release)
+	require.NoError(t, <-errCh)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
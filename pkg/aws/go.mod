@@ -0,0 +1,18 @@
+module github.com/cofide/cofide-sdk-go/pkg/aws
+
+go 1.25.7
+
+require (
+	github.com/aws/aws-sdk-go-v2 v1.47.1
+	github.com/spiffe/go-spiffe/v2 v2.7.0
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/aws/smithy-go v1.28.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-jose/go-jose/v4 v4.1.4 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
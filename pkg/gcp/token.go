@@ -0,0 +1,255 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gcp provides GCP access tokens for workloads by exchanging JWT-SVIDs
+// using Workload Identity Federation.
+//
+// A TokenSource is an oauth2.TokenSource, and NewClientOption configures
+// Google API clients to use one:
+//
+//	opt := gcp.NewClientOption(jwtSource, gcp.ProviderName(projectNumber, pool, provider))
+//	client, err := storage.NewClient(ctx, opt)
+//
+// It is versioned as its own module, keeping golang.org/x/oauth2 and
+// google.golang.org/api out of the dependencies of the core SDK.
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+const (
+	// DefaultScope is the default OAuth scope of access tokens.
+	DefaultScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	defaultSTSEndpoint   = "https://sts.googleapis.com/v1/token"
+	defaultRefreshWindow = 5 * time.Minute
+
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ProviderName returns the resource name of a Workload Identity Federation
+// provider, for use with NewTokenSource.
+func ProviderName(projectNumber, pool, provider string) string {
+	return fmt.Sprintf("//iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/providers/%s", projectNumber, pool, provider)
+}
+
+// TokenSource returns GCP access tokens for a Workload Identity Federation
+// provider by exchanging a JWT-SVID as the subject token using the GCP STS
+// token exchange endpoint. Tokens are cached, and refreshed when they are
+// within the refresh window of their expiry, so the source need not be wrapped
+// in an oauth2.ReuseTokenSource.
+//
+// The federated access token can be used directly with resources that grant
+// access to the workload's principal.
+type TokenSource struct {
+	source   jwtsvid.Source
+	provider string
+
+	audience      string
+	scopes        []string
+	stsEndpoint   string
+	refreshWindow time.Duration
+	httpClient    *http.Client
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+var _ oauth2.TokenSource = (*TokenSource)(nil)
+
+type TokenSourceOption func(*TokenSource)
+
+// WithAudience sets the audience of the JWT-SVIDs exchanged for tokens, which
+// must be an allowed audience of the provider. By default the provider's
+// default allowed audience, https: followed by its resource name, is used.
+func WithAudience(audience string) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.audience = audience
+	}
+}
+
+// WithScopes sets the OAuth scopes of access tokens. By default DefaultScope
+// is used.
+func WithScopes(scopes ...string) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.scopes = scopes
+	}
+}
+
+// WithSTSEndpoint sets the URL of the STS token exchange endpoint.
+func WithSTSEndpoint(endpoint string) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.stsEndpoint = endpoint
+	}
+}
+
+// WithRefreshWindow sets how long before their expiry tokens are refreshed.
+// By default tokens are refreshed 5 minutes before expiry.
+func WithRefreshWindow(window time.Duration) TokenSourceOption {
+	return func(s *TokenSource) {
+		s.refreshWindow = window
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to call STS.
+func WithHTTPClient(client *http.Client) TokenSourceOption {
+	return func(s *TokenSource) {
+		if client != nil {
+			s.httpClient = client
+		}
+	}
+}
+
+// NewTokenSource returns a TokenSource for the Workload Identity Federation
+// provider with resource name provider (see ProviderName), using JWT-SVIDs
+// from source, e.g. a workloadapi.JWTSource.
+func NewTokenSource(source jwtsvid.Source, provider string, opts ...TokenSourceOption) *TokenSource {
+	s := &TokenSource{
+		source:        source,
+		provider:      provider,
+		audience:      "https:" + provider,
+		scopes:        []string{DefaultScope},
+		stsEndpoint:   defaultSTSEndpoint,
+		refreshWindow: defaultRefreshWindow,
+		httpClient:    http.DefaultClient,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// NewClientOption returns an option for Google API clients that authenticates
+// them using a TokenSource created with NewTokenSource.
+func NewClientOption(source jwtsvid.Source, provider string, opts ...TokenSourceOption) option.ClientOption {
+	return option.WithTokenSource(NewTokenSource(source, provider, opts...))
+}
+
+// Token returns a cached token, or exchanges a JWT-SVID for a new token if it
+// is within the refresh window of its expiry.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is Token, using ctx to fetch the JWT-SVID and call STS.
+// Concurrent calls may each exchange a JWT-SVID for a new token.
+func (s *TokenSource) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if token != nil && time.Until(token.Expiry) > s.refreshWindow {
+		return token, nil
+	}
+
+	svid, err := s.source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: s.audience})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWT-SVID: %w", err)
+	}
+
+	token, err = s.exchange(ctx, svid.Marshal())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	// Keep a token exchanged concurrently that expires later.
+	if s.token == nil || token.Expiry.After(s.token.Expiry) {
+		s.token = token
+	}
+	s.mu.Unlock()
+	return token, nil
+}
+
+// exchangeRequest is a token exchange request to GCP STS.
+type exchangeRequest struct {
+	Audience           string `json:"audience"`
+	GrantType          string `json:"grantType"`
+	RequestedTokenType string `json:"requestedTokenType"`
+	Scope              string `json:"scope"`
+	SubjectToken       string `json:"subjectToken"`
+	SubjectTokenType   string `json:"subjectTokenType"`
+}
+
+// exchangeResponse is the response of GCP STS, which holds an error
+// description if the exchange failed.
+type exchangeResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchange exchanges subjectToken for an access token.
+func (s *TokenSource) exchange(ctx context.Context, subjectToken string) (*oauth2.Token, error) {
+	reqBody, err := json.Marshal(exchangeRequest{
+		Audience:           s.provider,
+		GrantType:          tokenExchangeGrantType,
+		RequestedTokenType: accessTokenType,
+		Scope:              strings.Join(s.scopes, " "),
+		SubjectToken:       subjectToken,
+		SubjectTokenType:   jwtTokenType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode STS request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.stsEndpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create STS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	issued := time.Now()
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call STS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read STS response: %w", err)
+	}
+
+	var exchangeResp exchangeResponse
+	if err := json.Unmarshal(body, &exchangeResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("STS token exchange failed with status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to decode STS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("STS token exchange failed: %s: %s", exchangeResp.Error, exchangeResp.ErrorDescription)
+	}
+
+	// An empty token would otherwise be cached, and fail every request.
+	if exchangeResp.AccessToken == "" || exchangeResp.ExpiresIn <= 0 {
+		return nil, errors.New("STS token exchange returned no access token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: exchangeResp.AccessToken,
+		TokenType:   exchangeResp.TokenType,
+		Expiry:      issued.Add(time.Duration(exchangeResp.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package gcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	htransport "google.golang.org/api/transport/http"
+)
+
+var testProvider = ProviderName("123456789012", "pool", "spire")
+
+// jwtSource is a jwtsvid.Source that issues JWT-SVIDs for
+// spiffe://example.org/workload, signed with a throwaway key.
+type jwtSource struct {
+	signer jose.Signer
+}
+
+func newJWTSource(t *testing.T) *jwtSource {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	require.NoError(t, err)
+	return &jwtSource{signer: signer}
+}
+
+func (s *jwtSource) FetchJWTSVID(_ context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	token, err := jwt.Signed(s.signer).Claims(jwt.Claims{
+		Subject:  "spiffe://example.org/workload",
+		Audience: jwt.Audience{params.Audience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return jwtsvid.ParseInsecure(token, []string{params.Audience})
+}
+
+func newSTSServer(t *testing.T, expiresIn int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req exchangeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, testProvider, req.Audience)
+		assert.Equal(t, tokenExchangeGrantType, req.GrantType)
+		assert.Equal(t, jwtTokenType, req.SubjectTokenType)
+		assert.Equal(t, DefaultScope, req.Scope)
+
+		svid, err := jwtsvid.ParseInsecure(req.SubjectToken, []string{"https:" + testProvider})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": err.Error()})
+			return
+		}
+		assert.Equal(t, "spiffe://example.org/workload", svid.ID.String())
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":      fmt.Sprintf("access-token-%d", calls.Load()),
+			"issued_token_type": accessTokenType,
+			"token_type":        "Bearer",
+			"expires_in":        expiresIn,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestProviderName(t *testing.T) {
+	assert.Equal(t, "//iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/pool/providers/spire", testProvider)
+}
+
+func TestTokenSource_Token(t *testing.T) {
+	srv, calls := newSTSServer(t, 3600)
+
+	s := NewTokenSource(newJWTSource(t), testProvider, WithSTSEndpoint(srv.URL))
+
+	token, err := s.TokenContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-token-1", token.AccessToken)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+
+	// Tokens are cached until they are near expiry.
+	token, err = s.TokenContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-token-1", token.AccessToken)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestTokenSource_Token_refresh(t *testing.T) {
+	// The tokens expire within the refresh window.
+	srv, calls := newSTSServer(t, 60)
+
+	s := NewTokenSource(newJWTSource(t), testProvider, WithSTSEndpoint(srv.URL))
+
+	_, err := s.TokenContext(context.Background())
+	require.NoError(t, err)
+	token, err := s.TokenContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "access-token-2", token.AccessToken)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestTokenSource_Token_error(t *testing.T) {
+	srv, _ := newSTSServer(t, 3600)
+
+	// STS rejects JWT-SVIDs with an audience that is not allowed.
+	s := NewTokenSource(newJWTSource(t), testProvider, WithSTSEndpoint(srv.URL), WithAudience("other"))
+
+	_, err := s.TokenContext(context.Background())
+	assert.ErrorContains(t, err, "STS token exchange failed: invalid_grant")
+}
+
+func TestTokenSource_Token_noAccessToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"token_type": "Bearer"})
+	}))
+	defer srv.Close()
+
+	s := NewTokenSource(newJWTSource(t), testProvider, WithSTSEndpoint(srv.URL))
+
+	_, err := s.Token()
+	assert.ErrorContains(t, err, "returned no access token")
+	assert.Nil(t, s.token)
+}
+
+func TestTokenSource_oauth2(t *testing.T) {
+	sts, _ := newSTSServer(t, 3600)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer api.Close()
+
+	// Requests of an oauth2 client are authorized using the federated token.
+	s := NewTokenSource(newJWTSource(t), testProvider, WithSTSEndpoint(sts.URL))
+	resp, err := oauth2.NewClient(context.Background(), s).Get(api.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer access-token-1", string(body))
+}
+
+func TestNewClientOption(t *testing.T) {
+	sts, _ := newSTSServer(t, 3600)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer api.Close()
+
+	// Google API clients are authorized using the federated token.
+	client, _, err := htransport.NewClient(context.Background(), NewClientOption(newJWTSource(t), testProvider, WithSTSEndpoint(sts.URL)))
+	require.NoError(t, err)
+	resp, err := client.Get(api.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer access-token-1", string(body))
+}
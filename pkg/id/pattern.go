@@ -0,0 +1,83 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// AuthorizePattern returns a [tlsconfig.Authorizer] that authorizes an ID when
+// it matches pattern, e.g. spiffe://*.example.org/ns/*/sa/billing. The trust
+// domain and each segment of the path are glob patterns, in which * does not
+// match across a "." in the trust domain or a "/" in the path. An ID matches
+// if its trust domain matches, and it has the same number of path segments as
+// the pattern, each of which matches. An error is returned if the pattern is
+// invalid.
+func AuthorizePattern(pattern string) (tlsconfig.Authorizer, error) {
+	scheme, rest, ok := strings.Cut(pattern, "://")
+	if !ok || !strings.EqualFold(scheme, "spiffe") {
+		return nil, fmt.Errorf("pattern %q must start with spiffe://", pattern)
+	}
+
+	// Trust domains are case-insensitive, and are normalised to lower case.
+	trustDomain, path, hasPath := strings.Cut(rest, "/")
+	if trustDomain == "" {
+		return nil, fmt.Errorf("pattern %q has an empty trust domain", pattern)
+	}
+	tdGlob, err := glob.Compile(strings.ToLower(trustDomain), '.')
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile trust domain glob %q: %w", trustDomain, err)
+	}
+
+	var segmentGlobs []glob.Glob
+	if hasPath {
+		for _, segment := range strings.Split(path, "/") {
+			if segment == "" {
+				return nil, fmt.Errorf("pattern %q has an empty path segment", pattern)
+			}
+			g, err := glob.Compile(segment, '/')
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile path segment glob %q: %w", segment, err)
+			}
+			segmentGlobs = append(segmentGlobs, g)
+		}
+	}
+
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		if err := matchPattern(id, tdGlob, segmentGlobs); err != nil {
+			return fmt.Errorf("ID %q does not match pattern %q: %w", id.String(), pattern, err)
+		}
+		return nil
+	}, nil
+}
+
+// matchPattern returns an error if the trust domain of id does not match
+// tdGlob, or its path segments do not match segmentGlobs.
+func matchPattern(id spiffeid.ID, tdGlob glob.Glob, segmentGlobs []glob.Glob) error {
+	if !tdGlob.Match(id.TrustDomain().Name()) {
+		return errors.New("trust domain does not match")
+	}
+
+	var segments []string
+	if path := id.Path(); path != "" {
+		segments = strings.Split(strings.TrimPrefix(path, "/"), "/")
+	}
+	if len(segments) != len(segmentGlobs) {
+		return fmt.Errorf("path has %d segments, expected %d", len(segments), len(segmentGlobs))
+	}
+	for i, g := range segmentGlobs {
+		if !g.Match(segments[i]) {
+			return fmt.Errorf("path segment %d %q does not match", i+1, segments[i])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizePattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		id      string
+		wantErr string
+	}{
+		{
+			name:    "exact",
+			pattern: "spiffe://example.org/ns/prod/sa/billing",
+			id:      "spiffe://example.org/ns/prod/sa/billing",
+		},
+		{
+			name:    "wildcards",
+			pattern: "spiffe://*.example.org/ns/*/sa/billing",
+			id:      "spiffe://foo.example.org/ns/prod/sa/billing",
+		},
+		{
+			name:    "trust domain case",
+			pattern: "SPIFFE://*.Example.org/ns/*/sa/billing",
+			id:      "spiffe://foo.example.org/ns/prod/sa/billing",
+		},
+		{
+			name:    "partial segment wildcard",
+			pattern: "spiffe://example.org/ns/prod-*/sa/billing",
+			id:      "spiffe://example.org/ns/prod-eu/sa/billing",
+		},
+		{
+			name:    "no path",
+			pattern: "spiffe://example.org",
+			id:      "spiffe://example.org",
+		},
+		{
+			name:    "trust domain wildcard does not cross dots",
+			pattern: "spiffe://*.example.org/ns/*/sa/billing",
+			id:      "spiffe://foo.bar.example.org/ns/prod/sa/billing",
+			wantErr: "trust domain does not match",
+		},
+		{
+			name:    "path segment mismatch",
+			pattern: "spiffe://example.org/ns/*/sa/billing",
+			id:      "spiffe://example.org/ns/prod/sa/payments",
+			wantErr: `path segment 4 "payments" does not match`,
+		},
+		{
+			name:    "fewer segments",
+			pattern: "spiffe://example.org/ns/*/sa/billing",
+			id:      "spiffe://example.org/ns/prod",
+			wantErr: "path has 2 segments, expected 4",
+		},
+		{
+			name:    "more segments",
+			pattern: "spiffe://example.org/ns/*",
+			id:      "spiffe://example.org/ns/prod/sa/billing",
+			wantErr: "path has 4 segments, expected 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorizer, err := AuthorizePattern(tt.pattern)
+			require.NoError(t, err)
+
+			err = authorizer(spiffeid.RequireFromString(tt.id), nil)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAuthorizePattern_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		wantErr string
+	}{
+		{name: "no scheme", pattern: "example.org/ns/prod", wantErr: "must start with spiffe://"},
+		{name: "wrong scheme", pattern: "https://example.org/ns/prod", wantErr: "must start with spiffe://"},
+		{name: "empty trust domain", pattern: "spiffe:///ns/prod", wantErr: "empty trust domain"},
+		{name: "empty segment", pattern: "spiffe://example.org/ns//sa/billing", wantErr: "empty path segment"},
+		{name: "trailing slash", pattern: "spiffe://example.org/ns/prod/", wantErr: "empty path segment"},
+		{name: "invalid glob", pattern: "spiffe://example.org/ns/[prod", wantErr: "failed to compile path segment glob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := AuthorizePattern(tt.pattern)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
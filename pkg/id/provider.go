@@ -0,0 +1,92 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// ProviderOption configures an authorizer created by AuthorizeFromProvider.
+type ProviderOption func(*providerAuthorizer)
+
+// WithProviderTTL caches the set of MatchFunc returned by the provider for
+// ttl, rather than calling the provider for each authorization, e.g. if it is
+// expensive to call.
+func WithProviderTTL(ttl time.Duration) ProviderOption {
+	return func(a *providerAuthorizer) {
+		a.ttl = ttl
+	}
+}
+
+// WithAllowEmpty authorizes any ID when the provider returns an empty set of
+// MatchFunc. By default no ID is authorized.
+func WithAllowEmpty() ProviderOption {
+	return func(a *providerAuthorizer) {
+		a.allowEmpty = true
+	}
+}
+
+// AuthorizeFromProvider returns a [tlsconfig.Authorizer] that authorizes an ID
+// when it matches all of the MatchFunc currently returned by p, e.g. a policy
+// that is periodically reloaded from a ConfigMap. This allows the policy to
+// change without restarting the process. p must be safe to call concurrently.
+func AuthorizeFromProvider(p func() []MatchFunc, opts ...ProviderOption) tlsconfig.Authorizer {
+	a := &providerAuthorizer{
+		provider: p,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a.authorize
+}
+
+// providerAuthorizer authorizes IDs using the MatchFunc of a provider, which
+// are cached for ttl.
+type providerAuthorizer struct {
+	provider   func() []MatchFunc
+	ttl        time.Duration
+	allowEmpty bool
+	now        func() time.Time
+
+	mu      sync.Mutex
+	funcs   []MatchFunc
+	expires time.Time
+}
+
+func (a *providerAuthorizer) authorize(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+	funcs := a.matchFuncs()
+	if len(funcs) == 0 {
+		if a.allowEmpty {
+			return nil
+		}
+		return errors.New("no authorization policy is provided")
+	}
+
+	return MatchSpiffeID(id, funcs...)
+}
+
+// matchFuncs returns the current MatchFunc of the provider, calling it if the
+// cached set has expired.
+func (a *providerAuthorizer) matchFuncs() []MatchFunc {
+	if a.ttl <= 0 {
+		return a.provider()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if a.expires.IsZero() || !now.Before(a.expires) {
+		a.funcs = a.provider()
+		a.expires = now.Add(a.ttl)
+	}
+	return a.funcs
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizeFromProvider(t *testing.T) {
+	billing := spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/billing")
+	payments := spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/payments")
+
+	policy := []MatchFunc{Equals("sa", "billing")}
+	authorizer := AuthorizeFromProvider(func() []MatchFunc { return policy })
+
+	assert.NoError(t, authorizer(billing, nil))
+	assert.Error(t, authorizer(payments, nil))
+
+	// Changes to the policy apply to the next authorization.
+	policy = []MatchFunc{Equals("ns", "production"), Equals("sa", "payments")}
+	assert.Error(t, authorizer(billing, nil))
+	assert.NoError(t, authorizer(payments, nil))
+
+	// An empty policy denies by default.
+	policy = nil
+	assert.ErrorContains(t, authorizer(billing, nil), "no authorization policy")
+}
+
+func TestAuthorizeFromProvider_allowEmpty(t *testing.T) {
+	authorizer := AuthorizeFromProvider(func() []MatchFunc { return nil }, WithAllowEmpty())
+
+	assert.NoError(t, authorizer(spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/billing"), nil))
+}
+
+func TestAuthorizeFromProvider_ttl(t *testing.T) {
+	billing := spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/billing")
+
+	var calls int
+	policy := []MatchFunc{Equals("sa", "billing")}
+	a := &providerAuthorizer{
+		provider: func() []MatchFunc {
+			calls++
+			return policy
+		},
+		now: time.Now,
+	}
+	WithProviderTTL(time.Minute)(a)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	assert.NoError(t, a.authorize(billing, nil))
+	assert.Equal(t, 1, calls)
+
+	// The cached policy is used until the TTL has elapsed.
+	policy = []MatchFunc{Equals("sa", "payments")}
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, a.authorize(billing, nil))
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(30 * time.Second)
+	assert.Error(t, a.authorize(billing, nil))
+	assert.Equal(t, 2, calls)
+}
@@ -7,6 +7,9 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/gobwas/glob"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
@@ -37,23 +40,124 @@ func (s *SPIFFEID) Matches(funcs ...MatchFunc) error {
 	return nil
 }
 
+// MatchSpiffeID applies a set of MatchFunc to an upstream [spiffeid.ID], as
+// ParseID followed by Matches would, without the round trip through a string.
+func MatchSpiffeID(id spiffeid.ID, funcs ...MatchFunc) error {
+	kv, err := FromSpiffeID(id).ParsePath()
+	if err != nil {
+		return fmt.Errorf("failed to parse path: %w", err)
+	}
+
+	for _, f := range funcs {
+		if err := f(kv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MatchResult is the result of evaluating a MatchFunc.
+type MatchResult struct {
+	// Index is the position of the MatchFunc in the evaluated list.
+	Index int
+	// Err is the error returned by the MatchFunc, or nil if it matched.
+	Err error
+}
+
+// EvaluateMatch parses a SPIFFE ID and applies a set of MatchFunc to it, as an
+// authorizer created by AuthorizeMatch would. This allows authorization
+// policies to be tested against sample IDs without a TLS handshake.
+func EvaluateMatch(id string, funcs ...MatchFunc) error {
+	sid, err := ParseID(id)
+	if err != nil {
+		return err
+	}
+
+	return sid.Matches(funcs...)
+}
+
+// EvaluateMatchVerbose is like EvaluateMatch, but applies every MatchFunc
+// rather than stopping at the first that fails, and returns the result of
+// each. An error is only returned if the ID cannot be parsed.
+func EvaluateMatchVerbose(id string, funcs ...MatchFunc) ([]MatchResult, error) {
+	sid, err := ParseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := sid.ParsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MatchResult, 0, len(funcs))
+	for i, f := range funcs {
+		results = append(results, MatchResult{Index: i, Err: f(kv)})
+	}
+
+	return results, nil
+}
+
+// HasPrefix returns whether the path of a SPIFFEID contains all of the
+// key/value pairs in kv, ignoring any other keys.
+func (s *SPIFFEID) HasPrefix(kv map[string]string) bool {
+	return s.Matches(PrefixEquals(kv)) == nil
+}
+
 // AuthorizeMatch returns a [tlsconfig.Authorizer] that authorizes an ID when
 // it matches all of the provided MatchFunc.
 func AuthorizeMatch(funcs ...MatchFunc) tlsconfig.Authorizer {
 	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
-		sid, err := ParseID(id.String())
-		if err != nil {
-			return err
+		return MatchSpiffeID(id, funcs...)
+	}
+}
+
+// AuthorizeTrustDomainMatch returns a [tlsconfig.Authorizer] that authorizes an
+// ID when it matches all of the MatchFunc registered for its trust domain in
+// matchers, which is keyed by trust domain name (e.g. "foo.example"). IDs from
+// trust domains without an entry in matchers are rejected.
+//
+// This is intended for federated deployments, where the bundles for each
+// federated trust domain are provided by the SPIRE workload API.
+func AuthorizeTrustDomainMatch(matchers map[string][]MatchFunc) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		funcs, ok := matchers[id.TrustDomain().Name()]
+		if !ok {
+			return fmt.Errorf("trust domain %q is not authorized", id.TrustDomain().Name())
 		}
 
-		err = sid.Matches(funcs...)
-		if err != nil {
-			return err
+		return AuthorizeMatch(funcs...)(id, verifiedChains)
+	}
+}
+
+// AuthorizeOneOf returns a [tlsconfig.Authorizer] that authorizes an ID when it
+// is equal to any of ids.
+func AuthorizeOneOf(ids ...*SPIFFEID) tlsconfig.Authorizer {
+	allowed := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		allowed[id.String()] = struct{}{}
+	}
+
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		if _, ok := allowed[id.String()]; !ok {
+			return fmt.Errorf("ID %q is not authorized", id.String())
 		}
 		return nil
 	}
 }
 
+// AuthorizeWithAudit returns a [tlsconfig.Authorizer] that authorizes an ID
+// using inner, and then calls logFn with the ID and the outcome, e.g. to keep
+// an audit log of peer identities. The decision of inner is not altered.
+func AuthorizeWithAudit(inner tlsconfig.Authorizer, logFn func(id spiffeid.ID, allowed bool, err error)) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		err := inner(id, verifiedChains)
+		logFn(id, err == nil, err)
+		return err
+	}
+}
+
 // Equals returns a MatchFunc that matches any ID that contains the specified
 // key/value pair.
 func Equals(key, value string) MatchFunc {
@@ -66,6 +170,22 @@ func Equals(key, value string) MatchFunc {
 	}
 }
 
+// PrefixEquals returns a MatchFunc that matches any ID that contains all of the
+// specified key/value pairs, ignoring any other keys. This allows hierarchical
+// IDs to be matched by their leading keys, e.g. ns and sa.
+func PrefixEquals(pairs map[string]string) MatchFunc {
+	keys := slices.Sorted(maps.Keys(pairs))
+	return func(kv map[string]string) error {
+		for _, key := range keys {
+			if err := Equals(key, pairs[key])(kv); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
 // IsEmptyKey returns a MatchFunc that matches any ID that contains the
 // specified key with an empty value.
 func IsEmpty(key string) MatchFunc {
@@ -109,26 +229,85 @@ func MatchGlob(key, globStr string) MatchFunc {
 	}
 }
 
+// EqualsFold is like Equals, but compares the value case-insensitively.
+func EqualsFold(key, value string) MatchFunc {
+	return func(kv map[string]string) error {
+		if val, ok := kv[key]; !ok || !strings.EqualFold(val, value) {
+			return fmt.Errorf("key %s does not match value %s ignoring case", key, value)
+		}
+
+		return nil
+	}
+}
+
+// MatchGlobFold is like MatchGlob, but matches the value case-insensitively by
+// matching the value in lower case against the glob pattern in lower case.
+func MatchGlobFold(key, globStr string) MatchFunc {
+	return func(kv map[string]string) error {
+		g, err := glob.Compile(strings.ToLower(globStr))
+		if err != nil {
+			return fmt.Errorf("failed to compile glob %q: %w", globStr, err)
+		}
+		if _, ok := kv[key]; !ok {
+			return fmt.Errorf("key %q not found", key)
+		}
+		if !g.Match(strings.ToLower(kv[key])) {
+			return fmt.Errorf("key %q with value %q does not match glob %q ignoring case", key, kv[key], globStr)
+		}
+
+		return nil
+	}
+}
+
+// OneOf returns a MatchFunc that matches any ID whose path is equal to the
+// path of any of ids. As a MatchFunc only receives the path of an ID, the trust
+// domains of ids are not checked; use AuthorizeOneOf to match full IDs.
+func OneOf(ids ...*SPIFFEID) MatchFunc {
+	paths := make([]map[string]string, 0, len(ids))
+	for _, id := range ids {
+		kv, err := id.ParsePath()
+		if err != nil {
+			continue
+		}
+		paths = append(paths, kv)
+	}
+
+	return func(kv map[string]string) error {
+		for _, path := range paths {
+			if maps.Equal(kv, path) {
+				return nil
+			}
+		}
+		return errors.New("path does not match any of the allowed IDs")
+	}
+}
+
 // Or returns a MatchFunc that combines the specified MatchFunc using a logical
-// OR.
+// OR. If none of them match, the returned error joins all of their errors.
 func Or(funcs ...MatchFunc) MatchFunc {
 	return func(kv map[string]string) error {
 		errs := make([]error, 0, len(funcs))
 		for _, f := range funcs {
 			err := f(kv)
-			errs = append(errs, err)
-		}
-
-		hasPassedTest := false
-		for _, err := range errs {
 			if err == nil {
-				hasPassedTest = true
-				break
+				return nil
 			}
+			errs = append(errs, err)
 		}
 
-		if !hasPassedTest {
-			return fmt.Errorf("none of the tests passed")
+		return fmt.Errorf("none of the OR conditions matched: %w", errors.Join(errs...))
+	}
+}
+
+// And returns a MatchFunc that combines the specified MatchFunc using a logical
+// AND, e.g. for use within Or. The returned error identifies the first
+// MatchFunc that did not match.
+func And(funcs ...MatchFunc) MatchFunc {
+	return func(kv map[string]string) error {
+		for i, f := range funcs {
+			if err := f(kv); err != nil {
+				return fmt.Errorf("AND condition %d of %d did not match: %w", i+1, len(funcs), err)
+			}
 		}
 
 		return nil
@@ -139,9 +318,8 @@ func Or(funcs ...MatchFunc) MatchFunc {
 // MatchFunc.
 func Not(f MatchFunc) MatchFunc {
 	return func(kv map[string]string) error {
-		err := f(kv)
-		if err == nil {
-			return errors.New("did not receive an error in NOT call")
+		if err := f(kv); err == nil {
+			return fmt.Errorf("path %v matched a NOT condition", kv)
 		}
 
 		return nil
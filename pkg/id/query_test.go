@@ -4,7 +4,12 @@
 package id
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSPIFFEID_Matches(t *testing.T) {
@@ -143,3 +148,260 @@ func TestSPIFFEID_Matches(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthorizeTrustDomainMatch(t *testing.T) {
+	authorizer := AuthorizeTrustDomainMatch(map[string][]MatchFunc{
+		"foo.example": {Equals("ns", "foo")},
+		"bar.example": {Equals("ns", "bar")},
+	})
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{
+			name: "foo trust domain match",
+			id:   "spiffe://foo.example/ns/foo/sa/default",
+		},
+		{
+			name: "bar trust domain match",
+			id:   "spiffe://bar.example/ns/bar/sa/default",
+		},
+		{
+			name:    "foo trust domain mismatch",
+			id:      "spiffe://foo.example/ns/bar/sa/default",
+			wantErr: true,
+		},
+		{
+			name:    "unknown trust domain",
+			id:      "spiffe://baz.example/ns/foo/sa/default",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorizer(MustParseID(tt.id).ToSpiffeID(), nil)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithAudit(t *testing.T) {
+	type decision struct {
+		id      string
+		allowed bool
+		err     error
+	}
+	var decisions []decision
+	authorizer := AuthorizeWithAudit(AuthorizeMatch(Equals("sa", "billing")), func(id spiffeid.ID, allowed bool, err error) {
+		decisions = append(decisions, decision{id: id.String(), allowed: allowed, err: err})
+	})
+
+	allowedID := spiffeid.RequireFromString("spiffe://example.org/ns/prod/sa/billing")
+	deniedID := spiffeid.RequireFromString("spiffe://example.org/ns/prod/sa/other")
+
+	assert.NoError(t, authorizer(allowedID, nil))
+	err := authorizer(deniedID, nil)
+	assert.ErrorContains(t, err, "key sa does not match value billing")
+
+	require.Len(t, decisions, 2)
+	assert.Equal(t, decision{id: allowedID.String(), allowed: true}, decisions[0])
+	assert.Equal(t, deniedID.String(), decisions[1].id)
+	assert.False(t, decisions[1].allowed)
+	assert.Equal(t, err, decisions[1].err)
+}
+
+func TestAuthorizeOneOf(t *testing.T) {
+	authorizer := AuthorizeOneOf(
+		MustParseID("spiffe://foo.example/ns/foo/sa/default"),
+		MustNewID("bar.example", map[string]string{"ns": "bar", "sa": "default"}),
+	)
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{
+			name: "first ID",
+			id:   "spiffe://foo.example/ns/foo/sa/default",
+		},
+		{
+			name: "second ID",
+			id:   "spiffe://bar.example/ns/bar/sa/default",
+		},
+		{
+			name:    "different path",
+			id:      "spiffe://foo.example/ns/foo/sa/admin",
+			wantErr: true,
+		},
+		{
+			name:    "different trust domain",
+			id:      "spiffe://baz.example/ns/foo/sa/default",
+			wantErr: true,
+		},
+		{
+			name:    "additional keys",
+			id:      "spiffe://foo.example/ns/foo/sa/default/env/prod",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorizer(MustParseID(tt.id).ToSpiffeID(), nil)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	match := OneOf(
+		MustParseID("spiffe://foo.example/ns/foo/sa/default"),
+		MustParseID("spiffe://foo.example/ns/bar/sa/default"),
+	)
+
+	assert.NoError(t, MustParseID("spiffe://foo.example/sa/default/ns/bar").Matches(match))
+	assert.NoError(t, MustParseID("spiffe://other.example/ns/foo/sa/default").Matches(match))
+	assert.Error(t, MustParseID("spiffe://foo.example/ns/baz/sa/default").Matches(match))
+	assert.Error(t, MustParseID("spiffe://foo.example/ns/foo").Matches(match))
+}
+
+func TestPrefixEquals(t *testing.T) {
+	id := MustParseID("spiffe://example.org/ns/prod/sa/billing/component/worker")
+
+	tests := []struct {
+		name string
+		kv   map[string]string
+		want bool
+	}{
+		{
+			name: "empty",
+			kv:   map[string]string{},
+			want: true,
+		},
+		{
+			name: "leading keys",
+			kv:   map[string]string{"ns": "prod", "sa": "billing"},
+			want: true,
+		},
+		{
+			name: "all keys",
+			kv:   map[string]string{"ns": "prod", "sa": "billing", "component": "worker"},
+			want: true,
+		},
+		{
+			name: "different value",
+			kv:   map[string]string{"ns": "prod", "sa": "payments"},
+			want: false,
+		},
+		{
+			name: "missing key",
+			kv:   map[string]string{"ns": "prod", "team": "billing"},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, id.HasPrefix(tt.kv))
+			assert.Equal(t, tt.want, id.Matches(PrefixEquals(tt.kv)) == nil)
+		})
+	}
+}
+
+func TestEvaluateMatch(t *testing.T) {
+	funcs := []MatchFunc{Equals("ns", "production"), Equals("sa", "billing")}
+
+	assert.NoError(t, EvaluateMatch("spiffe://example.org/ns/production/sa/billing", funcs...))
+	assert.EqualError(t, EvaluateMatch("spiffe://example.org/ns/production/sa/default", funcs...), "key sa does not match value billing")
+	assert.ErrorContains(t, EvaluateMatch("spiffe://example.org/ns", funcs...), "failed to parse path")
+	assert.ErrorContains(t, EvaluateMatch("not-an-id", funcs...), "failed to parse spiffe id")
+}
+
+func TestEvaluateMatchVerbose(t *testing.T) {
+	funcs := []MatchFunc{Equals("ns", "staging"), Equals("sa", "billing"), IsNotEmpty("deploy")}
+
+	results, err := EvaluateMatchVerbose("spiffe://example.org/ns/production/sa/billing", funcs...)
+	require.NoError(t, err)
+	assert.Equal(t, []MatchResult{
+		{Index: 0, Err: errors.New("key ns does not match value staging")},
+		{Index: 1},
+		{Index: 2, Err: errors.New("key deploy is empty")},
+	}, results)
+
+	_, err = EvaluateMatchVerbose("not-an-id", funcs...)
+	assert.Error(t, err)
+}
+
+func TestLogicalMatchErrors(t *testing.T) {
+	id := MustParseID("spiffe://example.org/ns/kube-system/sa/default")
+
+	err := id.Matches(Or(Equals("ns", "default"), IsEmpty("sa")))
+	assert.EqualError(t, err, "none of the OR conditions matched: key ns does not match value default\nkey sa is not empty")
+
+	err = id.Matches(And(Equals("ns", "kube-system"), Equals("sa", "coredns")))
+	assert.EqualError(t, err, "AND condition 2 of 2 did not match: key sa does not match value coredns")
+
+	err = id.Matches(Not(Equals("ns", "kube-system")))
+	assert.EqualError(t, err, "path map[ns:kube-system sa:default] matched a NOT condition")
+
+	assert.NoError(t, id.Matches(Or(Equals("ns", "default"), And(Equals("ns", "kube-system"), Not(IsEmpty("sa"))))))
+}
+
+func TestFoldMatchers(t *testing.T) {
+	id := MustParseID("spiffe://example.org/ns/Production/sa/Billing")
+
+	assert.NoError(t, id.Matches(EqualsFold("ns", "production")))
+	assert.Error(t, id.Matches(Equals("ns", "production")))
+	assert.Error(t, id.Matches(EqualsFold("ns", "staging")))
+	assert.Error(t, id.Matches(EqualsFold("NS", "production")))
+
+	assert.NoError(t, id.Matches(MatchGlobFold("sa", "BILL*")))
+	assert.Error(t, id.Matches(MatchGlob("sa", "bill*")))
+	assert.Error(t, id.Matches(MatchGlobFold("sa", "pay*")))
+}
+
+func TestMatchSpiffeID(t *testing.T) {
+	funcs := []MatchFunc{Equals("ns", "production"), Equals("sa", "billing")}
+
+	assert.NoError(t, MatchSpiffeID(spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/billing"), funcs...))
+	assert.EqualError(t, MatchSpiffeID(spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/default"), funcs...), "key sa does not match value billing")
+	assert.ErrorContains(t, MatchSpiffeID(spiffeid.RequireFromString("spiffe://example.org/ns"), funcs...), "failed to parse path")
+}
+
+func BenchmarkAuthorizeMatch(b *testing.B) {
+	id := spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/billing/deploy/api")
+	funcs := []MatchFunc{Equals("ns", "production"), Equals("sa", "billing")}
+
+	b.Run("spiffeid", func(b *testing.B) {
+		authorizer := AuthorizeMatch(funcs...)
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := authorizer(id, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// The previous implementation, which parsed the ID from its string form.
+	b.Run("string", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			sid, err := ParseID(id.String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := sid.Matches(funcs...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,38 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// MatchSemver returns a MatchFunc that matches any ID that contains the
+// specified key with a value that is a semantic version satisfying constraint,
+// e.g. ver/2.3.1 for the constraint ">=2.0.0". Constraints use the syntax of
+// [semver.NewConstraint], e.g. ">=1.2.0, <2.0.0", "~1.2" or "^1.2.3". An error
+// is returned if the constraint is invalid.
+func MatchSemver(key, constraint string) (MatchFunc, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse semver constraint %q: %w", constraint, err)
+	}
+
+	return func(kv map[string]string) error {
+		value, ok := kv[key]
+		if !ok {
+			return fmt.Errorf("key %q not found", key)
+		}
+		v, err := semver.NewVersion(value)
+		if err != nil {
+			return fmt.Errorf("key %q with value %q is not a semantic version: %w", key, value, err)
+		}
+		if !c.Check(v) {
+			return fmt.Errorf("key %q with version %q does not satisfy constraint %q", key, value, constraint)
+		}
+
+		return nil
+	}, nil
+}
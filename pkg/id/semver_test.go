@@ -0,0 +1,68 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package id
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchSemver(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		wantMatch  bool
+	}{
+		{constraint: "2.3.1", version: "2.3.1", wantMatch: true},
+		{constraint: "=2.3.1", version: "2.3.2", wantMatch: false},
+		{constraint: "=v2.3", version: "2.3.0", wantMatch: true},
+		{constraint: "!=2.3.1", version: "2.3.2", wantMatch: true},
+		{constraint: ">2.0.0", version: "2.0.1", wantMatch: true},
+		{constraint: ">2.0.0", version: "2.0.0", wantMatch: false},
+		{constraint: ">=2.0.0", version: "2.0.0", wantMatch: true},
+		{constraint: ">=2.0.0", version: "10.0.0", wantMatch: true},
+		{constraint: ">=2.0.0", version: "v1.9.9", wantMatch: false},
+		{constraint: ">=2.0.0", version: "2.0.0-rc.1", wantMatch: false},
+		{constraint: "<2.0.0", version: "1.9.9", wantMatch: true},
+		{constraint: "<=2.0.0", version: "2.0.0", wantMatch: true},
+		{constraint: "<=2.0.0", version: "2.0.1", wantMatch: false},
+		{constraint: "~1.2.3", version: "1.2.9", wantMatch: true},
+		{constraint: "~1.2.3", version: "1.3.0", wantMatch: false},
+		{constraint: "^1.2.3", version: "1.9.0", wantMatch: true},
+		{constraint: "^1.2.3", version: "2.0.0", wantMatch: false},
+		{constraint: ">=1.2.0, <2.0.0", version: "1.5.0", wantMatch: true},
+		{constraint: ">=1.2.0, <2.0.0", version: "2.1.0", wantMatch: false},
+		{constraint: ">1.0.0-alpha.2", version: "1.0.0-alpha.10", wantMatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			match, err := MatchSemver("ver", tt.constraint)
+			require.NoError(t, err)
+
+			err = match(map[string]string{"ver": tt.version})
+			if tt.wantMatch {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "does not satisfy constraint")
+			}
+		})
+	}
+}
+
+func TestMatchSemver_errors(t *testing.T) {
+	kv := map[string]string{"ver": "2.3.1", "name": "billing"}
+
+	match, err := MatchSemver("missing", ">=2.0.0")
+	require.NoError(t, err)
+	assert.ErrorContains(t, match(kv), `key "missing" not found`)
+
+	match, err = MatchSemver("name", ">=2.0.0")
+	require.NoError(t, err)
+	assert.ErrorContains(t, match(kv), `key "name" with value "billing" is not a semantic version`)
+
+	_, err = MatchSemver("ver", ">=two")
+	assert.ErrorContains(t, err, `failed to parse semver constraint ">=two"`)
+}
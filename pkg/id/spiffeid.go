@@ -23,6 +23,9 @@ import (
 // For example:
 // spiffe://foo.example.org/ns/production/sa/billing
 //
+// Trust domains are case-insensitive, and are normalised to lower case when
+// IDs are created or parsed. Keys and values in the path are case-sensitive.
+//
 // Verifying these IDs should be done by comparing the trust domain and preferably a minimum set of keys.
 // If the SPIFFE ID holds (new) keys that are not known to the verifier, the verifier should ignore these keys.
 // This allows for a flexible way to encode data in the SPIFFE ID without breaking the verification.
@@ -43,16 +46,31 @@ func NewID(trustDomain string, kv map[string]string) (*SPIFFEID, error) {
 	}
 	sort.Strings(keys)
 
-	pathKV := make([]string, 0, len(kv)*2)
+	segments := make([]string, 0, len(kv)*2)
 	for _, k := range keys {
-		pathKV = append(pathKV, k, kv[k])
+		segments = append(segments, k, kv[k])
 	}
-	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	return NewIDFromSegments(trustDomain, segments...)
+}
+
+// NewIDFromSegments creates a SPIFFE ID from key/value pairs given as
+// alternating key and value segments, preserving their order in the path.
+func NewIDFromSegments(trustDomain string, segments ...string) (*SPIFFEID, error) {
+	if len(segments)%2 != 0 {
+		return nil, fmt.Errorf("segments need to be key/value pairs, got %d segments", len(segments))
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("empty key or value not allowed")
+		}
+	}
+
+	td, err := spiffeid.TrustDomainFromString(strings.ToLower(trustDomain))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create trust domain: %w", err)
 	}
 
-	path := "/" + strings.Join(pathKV, "/")
+	path := "/" + strings.Join(segments, "/")
 	path = strings.TrimSuffix(path, "/")
 
 	id, err := spiffeid.FromPath(td, path)
@@ -73,7 +91,7 @@ func MustNewID(trustDomain string, kv map[string]string) *SPIFFEID {
 
 // ParseID parses a SPIFFE ID provided as a string and returns a SPIFFEID.
 func ParseID(id string) (*SPIFFEID, error) {
-	upstreamID, err := spiffeid.FromString(id)
+	upstreamID, err := spiffeid.FromString(normalizeID(id))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse spiffe id: %w", err)
 	}
@@ -86,6 +104,19 @@ func ParseID(id string) (*SPIFFEID, error) {
 	return svid, nil
 }
 
+// normalizeID returns id with its scheme and trust domain in lower case.
+func normalizeID(id string) string {
+	scheme, rest, ok := strings.Cut(id, "://")
+	if !ok {
+		return id
+	}
+	trustDomain, path, _ := strings.Cut(rest, "/")
+	if path != "" || strings.HasSuffix(rest, "/") {
+		path = "/" + path
+	}
+	return strings.ToLower(scheme) + "://" + strings.ToLower(trustDomain) + path
+}
+
 // MustParseID is the same as ParseID, but panics on error.
 func MustParseID(id string) *SPIFFEID {
 	svid, err := ParseID(id)
@@ -96,8 +127,12 @@ func MustParseID(id string) *SPIFFEID {
 }
 
 // ParsePath parses the path component of a SPIFFEID and returns it as a map.
+// An ID without a path, e.g. spiffe://example.org, has no key/value pairs.
 func (s *SPIFFEID) ParsePath() (map[string]string, error) {
 	path := s.id.Path()
+	if path == "" {
+		return map[string]string{}, nil
+	}
 	path = strings.Trim(path, "/")
 	pathParts := strings.Split(path, "/")
 
@@ -113,6 +148,45 @@ func (s *SPIFFEID) ParsePath() (map[string]string, error) {
 	return kv, nil
 }
 
+// Path returns the path component of a SPIFFEID, e.g. /ns/production/sa/billing.
+func (s *SPIFFEID) Path() string {
+	return s.id.Path()
+}
+
+// KVOrdered returns the key/value pairs of the path of a SPIFFEID, sorted by
+// key as in NewID. It returns nil if the path is not made of key/value pairs.
+func (s *SPIFFEID) KVOrdered() [][2]string {
+	kv, err := s.ParsePath()
+	if err != nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([][2]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, [2]string{k, kv[k]})
+	}
+	return pairs
+}
+
+// WithKey returns a new SPIFFEID derived from s with the key/value pair added
+// to its path, replacing any existing value of the key. As with NewID, the
+// pairs of the new path are sorted by key. s is not modified.
+func (s *SPIFFEID) WithKey(key, value string) (*SPIFFEID, error) {
+	kv, err := s.ParsePath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse path: %w", err)
+	}
+	kv[key] = value
+
+	return NewID(s.id.TrustDomain().Name(), kv)
+}
+
 // TrustDomain returns the trust domain of a SPIFFEID as a string.
 func (s *SPIFFEID) TrustDomain() string {
 	return s.id.TrustDomain().String()
@@ -123,9 +197,18 @@ func (s *SPIFFEID) String() string {
 	return s.id.String()
 }
 
+// Equal returns whether two SPIFFEIDs have the same trust domain and path.
+// A nil SPIFFEID is only equal to another nil SPIFFEID.
+func (s *SPIFFEID) Equal(other *SPIFFEID) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return s.id == other.id
+}
+
 // EXPERIMENTAL: Return a WIMSE compliant identifier
 func (s *SPIFFEID) WIMSEIDString() string {
-	return "wimse://" + s.TrustDomain() + s.id.Path()
+	return "wimse://" + s.TrustDomain() + s.Path()
 }
 
 // ToSpiffeID returns a [spiffeid.ID] representation of the SPIFFEID.
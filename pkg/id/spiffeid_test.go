@@ -31,6 +31,24 @@ func TestParseID(t *testing.T) {
 				id: spiffeid.RequireFromPath(spiffeid.RequireTrustDomainFromString("example.com"), "/ns/default/sa/default"),
 			},
 		},
+		{
+			name: "test parse of a spiffe ID with an upper case trust domain",
+			args: args{
+				id: "SPIFFE://Example.COM/ns/default/sa/default",
+			},
+			want: &SPIFFEID{
+				id: spiffeid.RequireFromPath(spiffeid.RequireTrustDomainFromString("example.com"), "/ns/default/sa/default"),
+			},
+		},
+		{
+			name: "test parse of a spiffe ID without a path",
+			args: args{
+				id: "spiffe://example.com",
+			},
+			want: &SPIFFEID{
+				id: spiffeid.RequireFromString("spiffe://example.com"),
+			},
+		},
 		{
 			name: "test parse of a spiffe ID with incorrect path KV pairs",
 			args: args{
@@ -81,6 +99,16 @@ func TestNewID(t *testing.T) {
 				id: spiffeid.RequireFromPath(spiffeid.RequireTrustDomainFromString("example.com"), "/ns/test/sa/default"),
 			},
 		},
+		{
+			name: "Create SPIFFE ID with upper case trust domain",
+			args: args{
+				trustDomain: "Example.COM",
+				kv:          map[string]string{"ns": "Test"},
+			},
+			want: &SPIFFEID{
+				id: spiffeid.RequireFromPath(spiffeid.RequireTrustDomainFromString("example.com"), "/ns/Test"),
+			},
+		},
 		{
 			name: "Create SPIFFE ID with empty trust domain",
 			args: args{
@@ -132,6 +160,23 @@ func TestNewID(t *testing.T) {
 	}
 }
 
+func TestNewIDFromSegments(t *testing.T) {
+	id, err := NewIDFromSegments("example.com", "sa", "default", "ns", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.com/sa/default/ns/test", id.String())
+
+	id, err = NewIDFromSegments("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.com", id.String())
+
+	_, err = NewIDFromSegments("example.com", "ns", "test", "sa")
+	assert.Error(t, err)
+	_, err = NewIDFromSegments("example.com", "ns", "")
+	assert.Error(t, err)
+	_, err = NewIDFromSegments("", "ns", "test")
+	assert.Error(t, err)
+}
+
 func TestWIMSEID(t *testing.T) {
 	tests := []struct {
 		name string
@@ -155,3 +200,151 @@ func TestWIMSEID(t *testing.T) {
 		assert.Equal(t, tt.want, spiffeID.WIMSEIDString())
 	}
 }
+
+func TestSPIFFEID_Equal(t *testing.T) {
+	id := MustParseID("spiffe://example.org/ns/production/sa/billing")
+
+	tests := []struct {
+		name  string
+		a     *SPIFFEID
+		b     *SPIFFEID
+		equal bool
+	}{
+		{
+			name:  "same ID",
+			a:     id,
+			b:     MustParseID("spiffe://example.org/ns/production/sa/billing"),
+			equal: true,
+		},
+		{
+			name:  "constructed ID",
+			a:     id,
+			b:     MustNewID("example.org", map[string]string{"ns": "production", "sa": "billing"}),
+			equal: true,
+		},
+		{
+			name:  "different trust domain",
+			a:     id,
+			b:     MustParseID("spiffe://example.com/ns/production/sa/billing"),
+			equal: false,
+		},
+		{
+			name:  "different path",
+			a:     id,
+			b:     MustParseID("spiffe://example.org/ns/production/sa/default"),
+			equal: false,
+		},
+		{
+			name:  "nil argument",
+			a:     id,
+			b:     nil,
+			equal: false,
+		},
+		{
+			name:  "nil receiver",
+			a:     nil,
+			b:     id,
+			equal: false,
+		},
+		{
+			name:  "both nil",
+			equal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.equal, tt.a.Equal(tt.b))
+		})
+	}
+}
+
+func TestSPIFFEID_Path(t *testing.T) {
+	assert.Equal(t, "/ns/production/sa/billing", MustParseID("spiffe://example.org/ns/production/sa/billing").Path())
+	assert.Equal(t, "", MustNewID("example.org", map[string]string{}).Path())
+}
+
+func TestSPIFFEID_ParsePath_empty(t *testing.T) {
+	// An ID without a path round trips through its string representation.
+	want := MustNewID("example.org", map[string]string{})
+	got, err := ParseID(want.String())
+	require.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	kv, err := got.ParsePath()
+	require.NoError(t, err)
+	assert.Empty(t, kv)
+	assert.Empty(t, got.KVOrdered())
+	assert.NoError(t, got.Matches(IsEmpty("ns")))
+	assert.Error(t, got.Matches(Equals("ns", "production")))
+}
+
+func TestSPIFFEID_KVOrdered(t *testing.T) {
+	kv := map[string]string{"sa": "billing", "ns": "production", "cluster": "eu"}
+	want := [][2]string{{"cluster", "eu"}, {"ns", "production"}, {"sa", "billing"}}
+
+	// The order is consistent with NewID, regardless of the order of the path.
+	assert.Equal(t, want, MustNewID("example.org", kv).KVOrdered())
+	assert.Equal(t, want, MustParseID("spiffe://example.org/sa/billing/ns/production/cluster/eu").KVOrdered())
+}
+
+func TestSPIFFEID_WithKey(t *testing.T) {
+	parent := MustParseID("spiffe://example.org/sa/billing/ns/production")
+
+	tests := []struct {
+		name    string
+		id      *SPIFFEID
+		key     string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "add key",
+			id:    parent,
+			key:   "component",
+			value: "worker",
+			want:  "spiffe://example.org/component/worker/ns/production/sa/billing",
+		},
+		{
+			name:  "overwrite key",
+			id:    parent,
+			key:   "sa",
+			value: "payments",
+			want:  "spiffe://example.org/ns/production/sa/payments",
+		},
+		{
+			name:  "empty path",
+			id:    MustNewID("example.org", map[string]string{}),
+			key:   "ns",
+			value: "production",
+			want:  "spiffe://example.org/ns/production",
+		},
+		{
+			name:    "empty value",
+			id:      parent,
+			key:     "component",
+			wantErr: "empty key or value not allowed",
+		},
+		{
+			name:    "invalid path",
+			id:      FromSpiffeID(spiffeid.RequireFromString("spiffe://example.org/ns")),
+			key:     "sa",
+			value:   "billing",
+			wantErr: "failed to parse path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			child, err := tt.id.WithKey(tt.key, tt.value)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, child.String())
+		})
+	}
+
+	// The parent is not modified.
+	assert.Equal(t, "spiffe://example.org/sa/billing/ns/production", parent.String())
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics defines a hook for recording metrics about the internals of
+// the SDK, such as xDS endpoint discovery and SPIRE bootstrap.
+//
+// The SDK does not depend on a metrics library. Users implement Recorder to
+// export metrics using their library of choice, e.g. Prometheus.
+package metrics
+
+import "time"
+
+// Component names passed to Recorder.Retry.
+const (
+	ComponentSPIRE = "spire"
+	ComponentXDS   = "xds"
+)
+
+// Recorder records metrics about the internals of the SDK. Implementations
+// must be safe for concurrent use and should not block.
+type Recorder interface {
+	// XDSResponseReceived is called when an xDS discovery response is received.
+	XDSResponseReceived()
+
+	// XDSDecodeFailure is called when an xDS discovery response cannot be decoded.
+	XDSDecodeFailure()
+
+	// XDSEndpoints is called with the number of endpoints for a service when
+	// they are updated.
+	XDSEndpoints(service string, count int)
+
+	// Retry is called when a retry loop of a component backs off, with the
+	// backoff duration.
+	Retry(component string, backoff time.Duration)
+
+	// SPIREReady is called once SPIRE is ready, with the time taken to become ready.
+	SPIREReady(elapsed time.Duration)
+
+	// Dial is called when the transport resolves a host to connect to, with
+	// whether the host was resolved using xDS.
+	Dial(host string, viaXDS bool)
+}
+
+// BundleRecorder may optionally be implemented by a Recorder to record updates
+// of the SPIRE trust bundle, e.g. to alert if the bundle has not been
+// refreshed recently, indicating a stuck SPIRE agent.
+type BundleRecorder interface {
+	// BundleUpdated is called when the trust bundle is updated, with the time
+	// of the update.
+	BundleUpdated(at time.Time)
+}
+
+// NoopRecorder is a Recorder that does nothing.
+type NoopRecorder struct{}
+
+func (NoopRecorder) XDSResponseReceived()                          {}
+func (NoopRecorder) XDSDecodeFailure()                             {}
+func (NoopRecorder) XDSEndpoints(service string, count int)        {}
+func (NoopRecorder) Retry(component string, backoff time.Duration) {}
+func (NoopRecorder) SPIREReady(elapsed time.Duration)              {}
+func (NoopRecorder) Dial(host string, viaXDS bool)                 {}
@@ -0,0 +1,124 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package otel records SPIFFE identities and xDS endpoints as OpenTelemetry
+// span attributes on requests sent by a Cofide HTTP client and received by a
+// Cofide HTTP server.
+//
+// Attributes are added to the span in the context of each request, which is
+// typically started by otelhttp. Nothing is recorded if the span is not
+// recording, e.g. when no tracer provider is configured.
+package otel
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys recorded on spans.
+const (
+	// LocalSPIFFEIDKey is the SPIFFE ID of the local workload.
+	LocalSPIFFEIDKey = attribute.Key("spiffe.local.id")
+	// PeerSPIFFEIDKey is the SPIFFE ID presented by the peer.
+	PeerSPIFFEIDKey = attribute.Key("spiffe.peer.id")
+	// PeerTrustDomainKey is the trust domain of the peer's SPIFFE ID.
+	PeerTrustDomainKey = attribute.Key("spiffe.peer.trust_domain")
+	// EndpointKey is the address of the endpoint discovered via xDS that a
+	// request was sent to.
+	EndpointKey = attribute.Key("cofide.xds.endpoint")
+)
+
+// IdentityProvider provides the SPIFFE ID of the local workload. It is
+// implemented by Cofide HTTP clients and servers.
+type IdentityProvider interface {
+	GetIdentity() (*id.SPIFFEID, error)
+}
+
+// Transport returns client middleware, e.g. for WithRoundTripperMiddleware,
+// that records the local and peer SPIFFE IDs and the xDS endpoint of each
+// request on its span. It should be wrapped by the middleware that starts the
+// span. local may be nil, in which case the local SPIFFE ID is not recorded.
+func Transport(local IdentityProvider) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			span := trace.SpanFromContext(req.Context())
+			if !span.IsRecording() {
+				return next.RoundTrip(req)
+			}
+
+			setLocalAttributes(span, local)
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return resp, err
+			}
+
+			if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+				setPeerAttributes(span, resp.TLS.PeerCertificates[0])
+			}
+			if resp.Request != nil {
+				if endpoint, ok := transport.EndpointFromContext(resp.Request.Context()); ok {
+					span.SetAttributes(EndpointKey.String(net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))))
+				}
+			}
+			return resp, nil
+		})
+	}
+}
+
+// Handler returns server middleware that records the local and peer SPIFFE
+// IDs of each request on its span, before calling next. It should be wrapped
+// by the middleware that starts the span. local may be nil, in which case the
+// local SPIFFE ID is not recorded.
+func Handler(local IdentityProvider, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if span.IsRecording() {
+			setLocalAttributes(span, local)
+			if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				setPeerAttributes(span, r.TLS.PeerCertificates[0])
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setLocalAttributes records the SPIFFE ID of the local workload on span, if
+// it is known.
+func setLocalAttributes(span trace.Span, local IdentityProvider) {
+	if local == nil {
+		return
+	}
+	identity, err := local.GetIdentity()
+	if err != nil {
+		return
+	}
+	span.SetAttributes(LocalSPIFFEIDKey.String(identity.String()))
+}
+
+// setPeerAttributes records the SPIFFE ID in the peer's leaf certificate on
+// span, if it has one.
+func setPeerAttributes(span trace.Span, cert *x509.Certificate) {
+	peerID, err := x509svid.IDFromCert(cert)
+	if err != nil {
+		return
+	}
+	span.SetAttributes(
+		PeerSPIFFEIDKey.String(peerID.String()),
+		PeerTrustDomainKey.String(peerID.TrustDomain().Name()),
+	)
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
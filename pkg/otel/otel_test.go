@@ -0,0 +1,107 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package otel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cofide/cofide-sdk-go/internal/transport"
+	"github.com/cofide/cofide-sdk-go/internal/xds"
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingSpan is a span that records its attributes.
+type recordingSpan struct {
+	noop.Span
+	attrs []attribute.KeyValue
+}
+
+func (s *recordingSpan) IsRecording() bool { return true }
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kv...)
+}
+
+type fakeIdentity struct{}
+
+func (fakeIdentity) GetIdentity() (*id.SPIFFEID, error) {
+	return id.MustParseID("spiffe://example.org/ns/client/sa/default"), nil
+}
+
+func peerCert(t *testing.T) *x509.Certificate {
+	u, err := url.Parse("spiffe://other.example/ns/server/sa/default")
+	require.NoError(t, err)
+	return &x509.Certificate{URIs: []*url.URL{u}}
+}
+
+func TestTransport(t *testing.T) {
+	endpoint := xds.Endpoint{Host: "10.0.0.1", Port: 8443}
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.WithContext(transport.ContextWithEndpoint(req.Context(), endpoint))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Request:    req,
+			TLS:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peerCert(t)}},
+		}, nil
+	})
+	rt := Transport(fakeIdentity{})(next)
+
+	span := &recordingSpan{}
+	req := httptest.NewRequest(http.MethodGet, "https://service/", nil)
+	req = req.WithContext(trace.ContextWithSpan(req.Context(), span))
+	_, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		LocalSPIFFEIDKey.String("spiffe://example.org/ns/client/sa/default"),
+		PeerSPIFFEIDKey.String("spiffe://other.example/ns/server/sa/default"),
+		PeerTrustDomainKey.String("other.example"),
+		EndpointKey.String("10.0.0.1:8443"),
+	}, span.attrs)
+}
+
+func TestTransport_notRecording(t *testing.T) {
+	var called bool
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+	})
+
+	// Without a span in the context, requests are passed through.
+	req := httptest.NewRequest(http.MethodGet, "https://service/", nil).WithContext(context.Background())
+	_, err := Transport(nil)(next).RoundTrip(req)
+	require.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestHandler(t *testing.T) {
+	var called bool
+	h := Handler(fakeIdentity{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	span := &recordingSpan{}
+	req := httptest.NewRequest(http.MethodGet, "https://service/", nil)
+	req = req.WithContext(trace.ContextWithSpan(req.Context(), span))
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peerCert(t)}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.True(t, called)
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		LocalSPIFFEIDKey.String("spiffe://example.org/ns/client/sa/default"),
+		PeerSPIFFEIDKey.String("spiffe://other.example/ns/server/sa/default"),
+		PeerTrustDomainKey.String("other.example"),
+	}, span.attrs)
+}
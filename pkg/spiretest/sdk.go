@@ -0,0 +1,41 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spiretest
+
+import (
+	"net/http"
+
+	cofide_grpc "github.com/cofide/cofide-sdk-go/grpc/client"
+	cofide_grpc_server "github.com/cofide/cofide-sdk-go/grpc/server"
+	cofide_http "github.com/cofide/cofide-sdk-go/http/client"
+	cofide_http_server "github.com/cofide/cofide-sdk-go/http/server"
+)
+
+// NewHTTPClient creates an HTTP client using the SVID served by api, blocking
+// until it is received. opts are applied after the SPIRE address is set.
+func NewHTTPClient(api *WorkloadAPI, opts ...cofide_http.ClientOption) (*cofide_http.Client, error) {
+	opts = append([]cofide_http.ClientOption{cofide_http.WithSPIREAddress(api.Addr())}, opts...)
+	return cofide_http.NewClient(opts...)
+}
+
+// NewHTTPServer creates an HTTP server using the SVID served by api. opts are
+// applied after the SPIRE address is set.
+func NewHTTPServer(api *WorkloadAPI, server *http.Server, opts ...cofide_http_server.ServerOption) *cofide_http_server.Server {
+	opts = append([]cofide_http_server.ServerOption{cofide_http_server.WithSPIREAddress(api.Addr())}, opts...)
+	return cofide_http_server.NewServer(server, opts...)
+}
+
+// NewGRPCClient creates a gRPC client using the SVID served by api, blocking
+// until it is received. opts are applied after the SPIRE address is set.
+func NewGRPCClient(api *WorkloadAPI, opts ...cofide_grpc.ClientOption) (*cofide_grpc.Client, error) {
+	opts = append([]cofide_grpc.ClientOption{cofide_grpc.WithSPIREAddress(api.Addr())}, opts...)
+	return cofide_grpc.NewClient(opts...)
+}
+
+// NewGRPCServer creates a gRPC server using the SVID served by api. opts are
+// applied after the SPIRE address is set.
+func NewGRPCServer(api *WorkloadAPI, opts ...cofide_grpc_server.ServerOption) *cofide_grpc_server.Server {
+	opts = append([]cofide_grpc_server.ServerOption{cofide_grpc_server.WithSPIREAddress(api.Addr())}, opts...)
+	return cofide_grpc_server.NewServer(opts...)
+}
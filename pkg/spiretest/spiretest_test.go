@@ -0,0 +1,95 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+package spiretest_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-sdk-go/pkg/id"
+	"github.com/cofide/cofide-sdk-go/pkg/spiretest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cofide_http "github.com/cofide/cofide-sdk-go/http/client"
+	cofide_http_server "github.com/cofide/cofide-sdk-go/http/server"
+)
+
+func TestHTTP_mTLS(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	serverAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/server")
+	clientAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/client")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := spiffeid.FromURI(r.TLS.PeerCertificates[0].URIs[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(peer.String()))
+	})
+	server := spiretest.NewHTTPServer(serverAPI, &http.Server{Handler: handler},
+		cofide_http_server.WithSVIDMatch(id.Equals("sa", "client")),
+	)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// Serving stops once the listener is closed.
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(func() { _ = lis.Close() })
+
+	client, err := spiretest.NewHTTPClient(clientAPI, cofide_http.WithSVIDMatch(id.Equals("sa", "server")))
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://" + lis.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/ns/test/sa/client", string(body))
+
+	// The server rejects a client with an unauthorized identity.
+	otherAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/other")
+	other, err := spiretest.NewHTTPClient(otherAPI)
+	require.NoError(t, err)
+	_, err = other.Get("http://" + lis.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestWorkloadAPI_Rotate(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+	api := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/workload", "workload.example.org")
+
+	client, err := spiretest.NewHTTPClient(api)
+	require.NoError(t, err)
+	cert, err := client.CurrentCertificate()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"workload.example.org"}, cert.DNSNames)
+
+	require.NoError(t, api.Rotate())
+	rotated := api.SVID().Certificates[0]
+	assert.NotEqual(t, cert.SerialNumber, rotated.SerialNumber)
+	assert.Equal(t, []string{"workload.example.org"}, rotated.DNSNames)
+
+	// The client receives the rotated SVID.
+	assert.EventuallyWithT(t, func(collect *assert.CollectT) {
+		cert, err := client.CurrentCertificate()
+		require.NoError(collect, err)
+		assert.Equal(collect, rotated.SerialNumber, cert.SerialNumber)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCA_IssueSVID_otherTrustDomain(t *testing.T) {
+	ca, err := spiretest.NewCA("example.org")
+	require.NoError(t, err)
+
+	_, err = ca.IssueSVID(spiffeid.RequireFromString("spiffe://other.org/workload"))
+	assert.ErrorContains(t, err, "not a member of trust domain")
+}
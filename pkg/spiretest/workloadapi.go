@@ -0,0 +1,255 @@
+// Copyright 2024 Cofide Limited.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package spiretest provides an in-memory fake SPIFFE Workload API, so that
+// code using the SDK's clients and servers can be tested without a SPIRE
+// agent.
+//
+// A CA issues the SVIDs of a trust domain. Each workload under test is served
+// its SVID by its own WorkloadAPI, whose address is passed to the SDK using
+// WithSPIREAddress, or by using constructors such as NewHTTPClient:
+//
+//	ca, err := spiretest.NewCA("example.org")
+//	...
+//	serverAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/server")
+//	clientAPI := spiretest.NewWorkloadAPI(t, ca, "spiffe://example.org/ns/test/sa/client")
+//	server := spiretest.NewHTTPServer(serverAPI, &http.Server{Handler: handler})
+//	client, err := spiretest.NewHTTPClient(clientAPI)
+package spiretest
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc"
+)
+
+// WorkloadAPI is a fake SPIFFE Workload API serving the X509-SVID of a single
+// workload, and the trust bundle of its CA, on a unix socket.
+type WorkloadAPI struct {
+	ca     *CA
+	addr   string
+	server *grpc.Server
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	svid      *x509svid.SVID
+	federated []*x509bundle.Bundle
+	// changed is closed, and replaced, when the SVID or bundles change.
+	changed chan struct{}
+}
+
+// NewWorkloadAPI starts a fake Workload API serving an X509-SVID for id,
+// issued by ca, with dnsNames as its DNS SANs. It is stopped when tb and its
+// subtests complete. tb fails immediately if the Workload API cannot be
+// started.
+func NewWorkloadAPI(tb testing.TB, ca *CA, id string, dnsNames ...string) *WorkloadAPI {
+	tb.Helper()
+
+	spiffeID, err := spiffeid.FromString(id)
+	if err != nil {
+		tb.Fatalf("invalid SPIFFE ID: %v", err)
+	}
+	svid, err := ca.IssueSVID(spiffeID, dnsNames...)
+	if err != nil {
+		tb.Fatalf("failed to issue SVID: %v", err)
+	}
+
+	// The socket is created outside tb.TempDir, whose paths may exceed the
+	// maximum length of a unix socket path.
+	dir, err := os.MkdirTemp("", "spiretest")
+	if err != nil {
+		tb.Fatalf("failed to create socket directory: %v", err)
+	}
+	tb.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		tb.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+
+	w := &WorkloadAPI{
+		ca:      ca,
+		addr:    "unix://" + socketPath,
+		server:  grpc.NewServer(),
+		svid:    svid,
+		changed: make(chan struct{}),
+	}
+	workload.RegisterSpiffeWorkloadAPIServer(w.server, &workloadAPIServer{w: w})
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		_ = w.server.Serve(lis)
+	}()
+	tb.Cleanup(w.Stop)
+
+	return w
+}
+
+// Addr returns the address of the Workload API, e.g. for WithSPIREAddress.
+func (w *WorkloadAPI) Addr() string {
+	return w.addr
+}
+
+// SVID returns the X509-SVID currently served.
+func (w *WorkloadAPI) SVID() *x509svid.SVID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.svid
+}
+
+// SetSVID serves svid in place of the current X509-SVID, e.g. to test
+// rotation. Connected workloads are sent the new SVID.
+func (w *WorkloadAPI) SetSVID(svid *x509svid.SVID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.svid = svid
+	w.notify()
+}
+
+// Rotate issues and serves a new X509-SVID with the ID and DNS SANs of the
+// current one.
+func (w *WorkloadAPI) Rotate() error {
+	current := w.SVID()
+	svid, err := w.ca.IssueSVID(current.ID, current.Certificates[0].DNSNames...)
+	if err != nil {
+		return err
+	}
+	w.SetSVID(svid)
+	return nil
+}
+
+// SetFederatedBundles serves bundles as the trust bundles of federated trust
+// domains, in addition to the bundle of the CA's trust domain.
+func (w *WorkloadAPI) SetFederatedBundles(bundles ...*x509bundle.Bundle) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.federated = bundles
+	w.notify()
+}
+
+// Stop stops the Workload API, closing the streams of connected workloads.
+func (w *WorkloadAPI) Stop() {
+	w.server.Stop()
+	w.wg.Wait()
+}
+
+// notify wakes the streams of connected workloads. w.mu must be held.
+func (w *WorkloadAPI) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// x509SVIDResponse returns the current X509-SVID response, and a channel
+// that is closed when it changes.
+func (w *WorkloadAPI) x509SVIDResponse() (*workload.X509SVIDResponse, <-chan struct{}, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key, err := x509.MarshalPKCS8PrivateKey(w.svid.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal SVID key: %w", err)
+	}
+	resp := &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{{
+			SpiffeId:    w.svid.ID.String(),
+			X509Svid:    rawCerts(w.svid.Certificates),
+			X509SvidKey: key,
+			Bundle:      rawCerts(w.ca.Bundle().X509Authorities()),
+		}},
+		FederatedBundles: make(map[string][]byte, len(w.federated)),
+	}
+	for _, bundle := range w.federated {
+		resp.FederatedBundles[bundle.TrustDomain().IDString()] = rawCerts(bundle.X509Authorities())
+	}
+	return resp, w.changed, nil
+}
+
+// x509BundlesResponse returns the current X.509 bundles response, and a
+// channel that is closed when it changes.
+func (w *WorkloadAPI) x509BundlesResponse() (*workload.X509BundlesResponse, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	bundles := append([]*x509bundle.Bundle{w.ca.Bundle()}, w.federated...)
+	resp := &workload.X509BundlesResponse{Bundles: make(map[string][]byte, len(bundles))}
+	for _, bundle := range bundles {
+		resp.Bundles[bundle.TrustDomain().IDString()] = rawCerts(bundle.X509Authorities())
+	}
+	return resp, w.changed
+}
+
+// rawCerts concatenates the DER encodings of certs.
+func rawCerts(certs []*x509.Certificate) []byte {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	return raw
+}
+
+// workloadAPIServer implements the Workload API for a WorkloadAPI. JWT-SVIDs
+// are not supported.
+type workloadAPIServer struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	w *WorkloadAPI
+}
+
+func (s *workloadAPIServer) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	for {
+		resp, changed, err := s.w.x509SVIDResponse()
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if !wait(stream.Context(), changed) {
+			return nil
+		}
+	}
+}
+
+func (s *workloadAPIServer) FetchX509Bundles(_ *workload.X509BundlesRequest, stream workload.SpiffeWorkloadAPI_FetchX509BundlesServer) error {
+	for {
+		resp, changed := s.w.x509BundlesResponse()
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if !wait(stream.Context(), changed) {
+			return nil
+		}
+	}
+}
+
+// FetchJWTBundles sends an empty set of JWT bundles, as the BundleSource
+// waits for them before it is ready.
+func (s *workloadAPIServer) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	if err := stream.Send(&workload.JWTBundlesResponse{Bundles: map[string][]byte{}}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// wait waits until changed is closed, returning false if ctx is done first.
+func wait(ctx context.Context, changed <-chan struct{}) bool {
+	select {
+	case <-changed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}